@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes timers, so that runtime components can run on
+// simulated time.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer sends the time on its channel once its duration has elapsed, unless
+// stopped first.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// RealClock is the wall clock.
+type RealClock struct{}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// FixedClock is always at the same time, and its timers never fire.
+type FixedClock struct {
+	Time time.Time
+}
+
+type fixedTimer struct{}
+
+func (c FixedClock) Now() time.Time {
+	return c.Time
+}
+
+func (FixedClock) NewTimer(d time.Duration) Timer {
+	return fixedTimer{}
+}
+
+func (fixedTimer) C() <-chan time.Time {
+	return nil
+}
+
+func (fixedTimer) Stop() bool {
+	return true
+}
+
+// AcceleratedClock runs Factor times faster than the wall clock from Start,
+// which it was at when created with NewAcceleratedClock. Factor must be
+// positive.
+type AcceleratedClock struct {
+	Start  time.Time
+	Factor float64
+	origin time.Time
+}
+
+type acceleratedTimer struct {
+	*time.Timer
+	c chan time.Time
+}
+
+func NewAcceleratedClock(start time.Time, factor float64) (*AcceleratedClock, error) {
+	if !(factor > 0) || math.IsInf(factor, 1) {
+		return nil, fmt.Errorf("clock factor %v, expected a positive factor", factor)
+	}
+	return &AcceleratedClock{Start: start, Factor: factor, origin: time.Now()}, nil
+}
+
+func (c *AcceleratedClock) Now() time.Time {
+	return c.Start.Add(time.Duration(float64(time.Since(c.origin)) * c.Factor))
+}
+
+func (c *AcceleratedClock) NewTimer(d time.Duration) Timer {
+	t := &acceleratedTimer{c: make(chan time.Time, 1)}
+	t.Timer = time.AfterFunc(time.Duration(float64(d)/c.Factor), func() {
+		t.c <- c.Now()
+	})
+	return t
+}
+
+func (t *acceleratedTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// FakeClock only moves when told to, firing the timers it moves past. It is
+// safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].deadline.Before(c.timers[j].deadline)
+	})
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward, firing the timers it moves past.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].deadline.After(c.now) {
+		c.timers[0].c <- c.now
+		c.timers = c.timers[1:]
+	}
+}
+
+// Step moves the clock to the first pending timer and fires it, returning
+// false when there is none.
+func (c *FakeClock) Step() bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	d := c.timers[0].deadline.Sub(c.now)
+	c.mu.Unlock()
+	c.Advance(d)
+	return true
+}
+
+// WaitTimers blocks until at least n timers are pending.
+func (c *FakeClock) WaitTimers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+
+	start := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	minute := clock.NewTimer(time.Minute)
+	hour := clock.NewTimer(time.Hour)
+	stopped := clock.NewTimer(30 * time.Minute)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Errorf("stopped.Stop() should only succeed once")
+	}
+
+	clock.Advance(30 * time.Second)
+	select {
+	case <-minute.C():
+		t.Errorf("minute timer fired after 30s")
+	default:
+	}
+
+	if !clock.Step() || !clock.Now().Equal(start.Add(time.Minute)) {
+		t.Errorf("clock.Step() moved to %v, expected %v", clock.Now(), start.Add(time.Minute))
+	}
+	if got := <-minute.C(); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("minute timer fired at %v, expected %v", got, start.Add(time.Minute))
+	}
+
+	clock.Advance(2 * time.Hour)
+	if got := <-hour.C(); !got.Equal(start.Add(121 * time.Minute)) {
+		t.Errorf("hour timer fired at %v, expected %v", got, start.Add(121*time.Minute))
+	}
+	select {
+	case <-stopped.C():
+		t.Errorf("stopped timer fired")
+	default:
+	}
+	if clock.Step() {
+		t.Errorf("clock.Step() without pending timers returned true")
+	}
+
+}
+
+func TestFixedClock(t *testing.T) {
+
+	start := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	clock := FixedClock{Time: start}
+	timer := clock.NewTimer(time.Nanosecond)
+	select {
+	case <-timer.C():
+		t.Errorf("fixed clock timer fired")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if !clock.Now().Equal(start) {
+		t.Errorf("clock.Now() = %v, expected %v", clock.Now(), start)
+	}
+
+}
+
+func TestAcceleratedClock(t *testing.T) {
+
+	// An hour per real second
+	start := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	clock, err := NewAcceleratedClock(start, 3600)
+	if err != nil {
+		t.Fatalf("NewAcceleratedClock(%v, 3600) returned %v", start, err)
+	}
+	timer := clock.NewTimer(time.Minute)
+	select {
+	case got := <-timer.C():
+		if got.Before(start.Add(time.Minute)) {
+			t.Errorf("timer fired at %v, expected after %v", got, start.Add(time.Minute))
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timer of a minute did not fire in a second")
+	}
+	if !clock.NewTimer(time.Hour).Stop() {
+		t.Errorf("timer.Stop() of a pending timer returned false")
+	}
+
+	for _, factor := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		if _, err := NewAcceleratedClock(start, factor); err == nil {
+			t.Errorf("NewAcceleratedClock(%v, %v) returned no error", start, factor)
+		}
+	}
+
+}
+
+func TestControllerSimulatedDay(t *testing.T) {
+
+	// Paris UTC, a day in milliseconds
+	latitude := 48.87
+	longitude := 2.67
+	start := time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	controller := NewController(latitude, longitude, time.Hour, Zone{Name: "office", Profile: DefaultProfile})
+	controller.Clock = clock
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setpoints := make(chan Setpoint)
+	go controller.Run(ctx, setpoints)
+
+	var dates []time.Time
+	for clock.Now().Before(start.Add(24 * time.Hour)) {
+		setpoint := <-setpoints
+		if expected := DefaultProfile.Lighting(clock.Now(), latitude, longitude); setpoint.Lighting != expected {
+			t.Errorf("controller.Run() at %v emitted %+v, expected %+v", clock.Now(), setpoint.Lighting, expected)
+		}
+		dates = append(dates, clock.Now())
+		clock.WaitTimers(1)
+		clock.Step()
+	}
+
+	for i := 1; i < len(dates); i++ {
+		if dates[i].Sub(dates[i-1]) > time.Hour {
+			t.Errorf("controller.Run() emitted nothing between %v and %v", dates[i-1], dates[i])
+		}
+	}
+	for _, event := range solarEvents(start, latitude, longitude)[1:] {
+		found := false
+		for _, date := range dates {
+			found = found || (date.Sub(event) < time.Minute && event.Sub(date) < time.Minute)
+		}
+		if !found {
+			t.Errorf("controller.Run() emitted nothing at the solar event %v", event)
+		}
+	}
+	t.Logf("controller.Run() emitted at %v", dates)
+
+}
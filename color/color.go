@@ -0,0 +1,256 @@
+// Package color converts correlated color temperatures (CCT), optionally
+// tinted off the Planckian locus by a Duv, to and from the color spaces
+// understood by lights: CIE 1931 xy and XYZ, CIE 1960 uv, sRGB, HSV and mireds.
+package color
+
+import "math"
+
+const (
+	minCCT = 1000
+	maxCCT = 15000
+)
+
+// UV is a CIE 1960 UCS chromaticity, in which Duv is measured.
+type UV struct {
+	U float64
+	V float64
+}
+
+// XY is a CIE 1931 chromaticity.
+type XY struct {
+	X float64
+	Y float64
+}
+
+// XYZ is a CIE 1931 tristimulus value, Y being the relative luminance.
+type XYZ struct {
+	X float64
+	Y float64
+	Z float64
+}
+
+// RGB holds red, green and blue components between 0 and 1, either linear or
+// gamma encoded depending on the function that produced it.
+type RGB struct {
+	R float64
+	G float64
+	B float64
+}
+
+// HSV holds a hue in degrees between 0 and 360, a saturation and a value
+// between 0 and 1.
+type HSV struct {
+	H float64
+	S float64
+	V float64
+}
+
+// Mired converts a color temperature in Kelvin to micro reciprocal degrees.
+func Mired(kelvin float64) float64 {
+	return 1e6 / kelvin
+}
+
+// Kelvin converts a color temperature in micro reciprocal degrees to Kelvin.
+func Kelvin(mired float64) float64 {
+	return 1e6 / mired
+}
+
+// Planckian returns the chromaticity of a blackbody at the given temperature,
+// using Krystek's approximation valid between 1000K and 15000K.
+func Planckian(cct float64) UV {
+	return UV{
+		U: (0.860117757 + 1.54118254e-4*cct + 1.28641212e-7*cct*cct) / (1 + 8.42420235e-4*cct + 7.08145163e-7*cct*cct),
+		V: (0.317398726 + 4.22806245e-5*cct + 4.20481691e-8*cct*cct) / (1 - 2.89741816e-5*cct + 1.61456053e-7*cct*cct),
+	}
+}
+
+// normal returns the unit vector normal to the Planckian locus at the given
+// temperature, pointing towards positive Duv (green).
+func normal(cct float64) UV {
+	before := Planckian(cct - 0.5)
+	after := Planckian(cct + 0.5)
+	du := after.U - before.U
+	dv := after.V - before.V
+	n := math.Hypot(du, dv)
+	return UV{U: dv / n, V: -du / n}
+}
+
+// CCTToUV returns the chromaticity at the given color temperature, shifted by
+// duv perpendicularly to the Planckian locus.
+func CCTToUV(cct float64, duv float64) UV {
+	p := Planckian(cct)
+	n := normal(cct)
+	return UV{U: p.U + duv*n.U, V: p.V + duv*n.V}
+}
+
+// CCTToXY returns the chromaticity at the given color temperature, shifted by
+// duv perpendicularly to the Planckian locus.
+func CCTToXY(cct float64, duv float64) XY {
+	return CCTToUV(cct, duv).XY()
+}
+
+// UVToCCT returns the correlated color temperature of a chromaticity, that is
+// the temperature of the closest point of the Planckian locus, and its signed
+// distance to the locus.
+func UVToCCT(uv UV) (float64, float64) {
+	distance := func(cct float64) float64 {
+		p := Planckian(cct)
+		return math.Hypot(uv.U-p.U, uv.V-p.V)
+	}
+	// Golden section search in mireds, where the locus is close to uniform
+	low, high := Mired(maxCCT), Mired(minCCT)
+	ratio := (math.Sqrt(5) - 1) / 2
+	for high-low > 1e-6 {
+		a := high - ratio*(high-low)
+		b := low + ratio*(high-low)
+		if distance(Kelvin(a)) < distance(Kelvin(b)) {
+			high = b
+		} else {
+			low = a
+		}
+	}
+	cct := Kelvin((low + high) / 2)
+	p := Planckian(cct)
+	n := normal(cct)
+	return cct, (uv.U-p.U)*n.U + (uv.V-p.V)*n.V
+}
+
+// XYToCCT returns the correlated color temperature of a chromaticity and its
+// signed distance to the Planckian locus.
+func XYToCCT(xy XY) (float64, float64) {
+	return UVToCCT(xy.UV())
+}
+
+// CCTToRGB returns the gamma encoded sRGB color at the given color
+// temperature and duv, scaled so that its brightest component is 1.
+func CCTToRGB(cct float64, duv float64) RGB {
+	return CCTToXY(cct, duv).XYZ(1).LinearRGB().Normalize().SRGB()
+}
+
+// RGBToCCT returns the correlated color temperature and duv of a gamma
+// encoded sRGB color.
+func RGBToCCT(rgb RGB) (float64, float64) {
+	return XYToCCT(rgb.Linear().XYZ().XY())
+}
+
+func (uv UV) XY() XY {
+	d := 2*uv.U - 8*uv.V + 4
+	return XY{X: 3 * uv.U / d, Y: 2 * uv.V / d}
+}
+
+func (xy XY) UV() UV {
+	d := -2*xy.X + 12*xy.Y + 3
+	return UV{U: 4 * xy.X / d, V: 6 * xy.Y / d}
+}
+
+// XYZ returns the tristimulus value of the chromaticity at luminance y.
+func (xy XY) XYZ(y float64) XYZ {
+	return XYZ{X: xy.X * y / xy.Y, Y: y, Z: (1 - xy.X - xy.Y) * y / xy.Y}
+}
+
+func (c XYZ) XY() XY {
+	s := c.X + c.Y + c.Z
+	return XY{X: c.X / s, Y: c.Y / s}
+}
+
+// LinearRGB converts to linear sRGB (D65 white point). Components may fall
+// outside of 0 and 1 for colors outside of the sRGB gamut.
+func (c XYZ) LinearRGB() RGB {
+	return RGB{
+		R: 3.2404542*c.X - 1.5371385*c.Y - 0.4985314*c.Z,
+		G: -0.9692660*c.X + 1.8760108*c.Y + 0.0415560*c.Z,
+		B: 0.0556434*c.X - 0.2040259*c.Y + 1.0572252*c.Z,
+	}
+}
+
+// XYZ converts from linear sRGB.
+func (c RGB) XYZ() XYZ {
+	return XYZ{
+		X: 0.4124564*c.R + 0.3575761*c.G + 0.1804375*c.B,
+		Y: 0.2126729*c.R + 0.7151522*c.G + 0.0721750*c.B,
+		Z: 0.0193339*c.R + 0.1191920*c.G + 0.9503041*c.B,
+	}
+}
+
+// Normalize clips negative components and scales the color so that its
+// brightest component is 1.
+func (c RGB) Normalize() RGB {
+	c = RGB{R: math.Max(c.R, 0), G: math.Max(c.G, 0), B: math.Max(c.B, 0)}
+	m := math.Max(c.R, math.Max(c.G, c.B))
+	if m == 0 {
+		return c
+	}
+	return RGB{R: c.R / m, G: c.G / m, B: c.B / m}
+}
+
+func encode(c float64) float64 {
+	if c <= 0.0031308 {
+		return 12.92 * c
+	}
+	return 1.055*math.Pow(c, 1/2.4) - 0.055
+}
+
+func decode(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// SRGB applies the sRGB transfer function to a linear color.
+func (c RGB) SRGB() RGB {
+	return RGB{R: encode(c.R), G: encode(c.G), B: encode(c.B)}
+}
+
+// Linear removes the sRGB transfer function from a gamma encoded color.
+func (c RGB) Linear() RGB {
+	return RGB{R: decode(c.R), G: decode(c.G), B: decode(c.B)}
+}
+
+func (c RGB) HSV() HSV {
+	max := math.Max(c.R, math.Max(c.G, c.B))
+	min := math.Min(c.R, math.Min(c.G, c.B))
+	delta := max - min
+	var h float64
+	if delta == 0 {
+		h = 0
+	} else if max == c.R {
+		h = 60 * math.Mod((c.G-c.B)/delta+6, 6)
+	} else if max == c.G {
+		h = 60 * ((c.B-c.R)/delta + 2)
+	} else {
+		h = 60 * ((c.R-c.G)/delta + 4)
+	}
+	var s float64
+	if max > 0 {
+		s = delta / max
+	}
+	return HSV{H: h, S: s, V: max}
+}
+
+// RGB returns the color, its hue being taken modulo 360 degrees.
+func (c HSV) RGB() RGB {
+	h := math.Mod(c.H, 360)
+	if h < 0 {
+		h += 360
+	}
+	h /= 60
+	chroma := c.V * c.S
+	x := chroma * (1 - math.Abs(math.Mod(h, 2)-1))
+	m := c.V - chroma
+	var r, g, b float64
+	if h < 1 {
+		r, g, b = chroma, x, 0
+	} else if h < 2 {
+		r, g, b = x, chroma, 0
+	} else if h < 3 {
+		r, g, b = 0, chroma, x
+	} else if h < 4 {
+		r, g, b = 0, x, chroma
+	} else if h < 5 {
+		r, g, b = x, 0, chroma
+	} else {
+		r, g, b = chroma, 0, x
+	}
+	return RGB{R: r + m, G: g + m, B: b + m}
+}
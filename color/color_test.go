@@ -0,0 +1,174 @@
+package color
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCCTToXY(t *testing.T) {
+
+	// Planckian locus chromaticities
+	temps := make(map[float64]XY)
+	temps[2000] = XY{0.5267, 0.4133}
+	temps[2856] = XY{0.4476, 0.4074}
+	temps[3000] = XY{0.4369, 0.4041}
+	temps[4000] = XY{0.3805, 0.3768}
+	temps[5000] = XY{0.3451, 0.3516}
+	temps[6500] = XY{0.3135, 0.3237}
+
+	for k, v := range temps {
+		got := CCTToXY(k, 0)
+		diff := math.Hypot(got.X-v.X, got.Y-v.Y)
+		if diff > 0.0005 {
+			t.Errorf("CCTToXY(%f, 0) = %v, expected %v, diff %f", k, got, v, diff)
+		} else {
+			t.Logf("CCTToXY(%f, 0) = %v, expected %v, diff %f", k, got, v, diff)
+		}
+	}
+
+}
+
+func TestXYToCCT(t *testing.T) {
+
+	// CIE standard illuminants
+	illuminants := make(map[XY][2]float64)
+	illuminants[XY{0.44757, 0.40745}] = [2]float64{2856, 0}
+	illuminants[XY{0.34567, 0.35850}] = [2]float64{5003, 0.0033}
+	illuminants[XY{0.33242, 0.34743}] = [2]float64{5503, 0.0032}
+	illuminants[XY{0.31271, 0.32902}] = [2]float64{6504, 0.0032}
+
+	for k, v := range illuminants {
+		cct, duv := XYToCCT(k)
+		if math.Abs(cct-v[0]) > 5 || math.Abs(duv-v[1]) > 0.0002 {
+			t.Errorf("XYToCCT(%v) = %f, %f, expected %f, %f", k, cct, duv, v[0], v[1])
+		} else {
+			t.Logf("XYToCCT(%v) = %f, %f, expected %f, %f", k, cct, duv, v[0], v[1])
+		}
+	}
+
+}
+
+func TestCCTRoundTrip(t *testing.T) {
+
+	for cct := float64(1000); cct <= 15000; cct += 250 {
+		for _, duv := range []float64{-0.02, -0.005, 0, 0.005, 0.02} {
+			gotCCT, gotDuv := XYToCCT(CCTToXY(cct, duv))
+			if math.Abs(gotCCT-cct)/cct > 0.0005 || math.Abs(gotDuv-duv) > 0.00001 {
+				t.Errorf("XYToCCT(CCTToXY(%f, %f)) = %f, %f", cct, duv, gotCCT, gotDuv)
+			}
+		}
+	}
+
+}
+
+func TestSRGB(t *testing.T) {
+
+	// D65 white, and sRGB primaries
+	colors := make(map[XYZ]RGB)
+	colors[XYZ{0.95047, 1, 1.08883}] = RGB{1, 1, 1}
+	colors[XYZ{0.4124564, 0.2126729, 0.0193339}] = RGB{1, 0, 0}
+	colors[XYZ{0.3575761, 0.7151522, 0.1191920}] = RGB{0, 1, 0}
+	colors[XYZ{0.1804375, 0.0721750, 0.9503041}] = RGB{0, 0, 1}
+	colors[XYZ{0.2034, 0.2140, 0.2330}] = RGB{0.5, 0.5, 0.5}
+
+	for k, v := range colors {
+		got := k.LinearRGB().SRGB()
+		diff := math.Max(math.Abs(got.R-v.R), math.Max(math.Abs(got.G-v.G), math.Abs(got.B-v.B)))
+		if diff > 0.001 {
+			t.Errorf("%v.LinearRGB().SRGB() = %v, expected %v, diff %f", k, got, v, diff)
+		} else {
+			t.Logf("%v.LinearRGB().SRGB() = %v, expected %v, diff %f", k, got, v, diff)
+		}
+		back := got.Linear().XYZ()
+		diff = math.Max(math.Abs(back.X-k.X), math.Max(math.Abs(back.Y-k.Y), math.Abs(back.Z-k.Z)))
+		if diff > 0.001 {
+			t.Errorf("%v.Linear().XYZ() = %v, expected %v, diff %f", got, back, k, diff)
+		}
+	}
+
+}
+
+func TestCCTToRGB(t *testing.T) {
+
+	temps := make(map[float64]RGB)
+	temps[2000] = RGB{1, 0.54, 0.08}
+	temps[6504] = RGB{1, 0.97, 0.99}
+
+	for k, v := range temps {
+		got := CCTToRGB(k, 0)
+		diff := math.Max(math.Abs(got.R-v.R), math.Max(math.Abs(got.G-v.G), math.Abs(got.B-v.B)))
+		if diff > 0.02 {
+			t.Errorf("CCTToRGB(%f, 0) = %v, expected %v, diff %f", k, got, v, diff)
+		} else {
+			t.Logf("CCTToRGB(%f, 0) = %v, expected %v, diff %f", k, got, v, diff)
+		}
+		cct, _ := RGBToCCT(got)
+		if math.Abs(cct-k) > 10 {
+			t.Errorf("RGBToCCT(%v) = %f, expected %f", got, cct, k)
+		}
+	}
+
+	// D65 has a positive duv and is white in sRGB
+	got := CCTToRGB(6504, 0.0032)
+	if math.Min(got.R, math.Min(got.G, got.B)) < 0.999 {
+		t.Errorf("CCTToRGB(6504, 0.0032) = %v, expected white", got)
+	}
+
+}
+
+func TestHSV(t *testing.T) {
+
+	colors := make(map[RGB]HSV)
+	colors[RGB{0, 0, 0}] = HSV{0, 0, 0}
+	colors[RGB{1, 1, 1}] = HSV{0, 0, 1}
+	colors[RGB{1, 0, 0}] = HSV{0, 1, 1}
+	colors[RGB{0, 1, 0}] = HSV{120, 1, 1}
+	colors[RGB{0, 0, 1}] = HSV{240, 1, 1}
+	colors[RGB{1, 0.5, 0}] = HSV{30, 1, 1}
+	colors[RGB{0.5, 0.25, 0.5}] = HSV{300, 0.5, 0.5}
+
+	for k, v := range colors {
+		got := k.HSV()
+		if math.Abs(got.H-v.H) > 1e-9 || math.Abs(got.S-v.S) > 1e-9 || math.Abs(got.V-v.V) > 1e-9 {
+			t.Errorf("%v.HSV() = %v, expected %v", k, got, v)
+		} else {
+			t.Logf("%v.HSV() = %v, expected %v", k, got, v)
+		}
+		back := got.RGB()
+		if math.Abs(back.R-k.R) > 1e-9 || math.Abs(back.G-k.G) > 1e-9 || math.Abs(back.B-k.B) > 1e-9 {
+			t.Errorf("%v.RGB() = %v, expected %v", got, back, k)
+		}
+	}
+
+	// Hues out of [0, 360) wrap around
+	hues := make(map[float64]RGB)
+	hues[-60] = RGB{1, 0, 1}
+	hues[-330] = RGB{1, 0.5, 0}
+	hues[480] = RGB{0, 1, 0}
+	for k, v := range hues {
+		got := HSV{H: k, S: 1, V: 1}.RGB()
+		if math.Abs(got.R-v.R) > 1e-9 || math.Abs(got.G-v.G) > 1e-9 || math.Abs(got.B-v.B) > 1e-9 {
+			t.Errorf("HSV{%f, 1, 1}.RGB() = %v, expected %v", k, got, v)
+		}
+	}
+
+}
+
+func TestMired(t *testing.T) {
+
+	temps := make(map[float64]float64)
+	temps[2000] = 500
+	temps[2700] = 370.37
+	temps[4000] = 250
+	temps[6500] = 153.85
+
+	for k, v := range temps {
+		got := Mired(k)
+		if math.Abs(got-v) > 0.01 || math.Abs(Kelvin(got)-k) > 1e-9 {
+			t.Errorf("Mired(%f) = %f, expected %f", k, got, v)
+		} else {
+			t.Logf("Mired(%f) = %f, expected %f", k, got, v)
+		}
+	}
+
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Compensation selects how a profile handles high latitudes, where the sun
+// may not rise or set for days.
+type Compensation int
+
+const (
+	// NoCompensation follows the sun at the observer latitude.
+	NoCompensation Compensation = iota
+	// VirtualLatitude follows the sun at ReferenceLatitude, or
+	// DefaultReferenceLatitude when unset, whenever the observer is further
+	// from the equator.
+	VirtualLatitude
+	// ComfortDay follows the sun at the latitude where the day length is the
+	// observer day length bounded between MinDayLength and MaxDayLength.
+	ComfortDay
+)
+
+// DefaultReferenceLatitude is the latitude VirtualLatitude follows the sun at
+// when the profile has no ReferenceLatitude, where the sun still rises and sets
+// every day.
+const DefaultReferenceLatitude = 55
+
+// dayLength returns the duration between sunrise and sunset, which is 0 during
+// the polar night and 24h during the midnight sun.
+func dayLength(date time.Time, latitude float64) time.Duration {
+	cosHA := math.Cos(toRadians(90.833))/(math.Cos(toRadians(latitude))*math.Cos(decl(date))) - (math.Tan(toRadians(latitude)) * math.Tan(decl(date)))
+	if cosHA >= 1 {
+		return 0
+	} else if cosHA <= -1 {
+		return 24 * time.Hour
+	}
+	return time.Duration(8 * toDegrees(math.Acos(cosHA)) * float64(time.Minute))
+}
+
+// comfortLatitude returns the latitude, in the observer hemisphere, where the
+// day length is the closest to the target.
+func comfortLatitude(date time.Time, latitude float64, target time.Duration) float64 {
+	sign := math.Copysign(1, latitude)
+	low, high := float64(0), float64(89)
+	increasing := dayLength(date, sign*high) > dayLength(date, sign*low)
+	for high-low > 0.01 {
+		mid := (low + high) / 2
+		if (dayLength(date, sign*mid) < target) == increasing {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return sign * (low + high) / 2
+}
+
+// latitude returns the latitude the profile evaluates the sun at.
+func (p Profile) latitude(date time.Time, latitude float64) float64 {
+	switch p.Compensation {
+	case VirtualLatitude:
+		reference := math.Abs(p.ReferenceLatitude)
+		if reference == 0 {
+			reference = DefaultReferenceLatitude
+		}
+		if math.Abs(latitude) > reference {
+			return math.Copysign(reference, latitude)
+		}
+	case ComfortDay:
+		length := dayLength(date, latitude)
+		if length < p.MinDayLength {
+			return comfortLatitude(date, latitude, p.MinDayLength)
+		} else if p.MaxDayLength > 0 && length > p.MaxDayLength {
+			return comfortLatitude(date, latitude, p.MaxDayLength)
+		}
+	}
+	return latitude
+}
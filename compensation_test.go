@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDayLength(t *testing.T) {
+
+	// Paris and Tromsø UTC
+	type observer struct {
+		date     time.Time
+		latitude float64
+	}
+	observers := make(map[observer]time.Duration)
+	observers[observer{time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC), 48.87}] = 16*time.Hour + 10*time.Minute
+	observers[observer{time.Date(2021, 12, 21, 12, 0, 0, 0, time.UTC), 48.87}] = 8*time.Hour + 14*time.Minute
+	observers[observer{time.Date(2021, 3, 20, 12, 0, 0, 0, time.UTC), 0}] = 12*time.Hour + 7*time.Minute
+	observers[observer{time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC), 69.65}] = 24 * time.Hour
+	observers[observer{time.Date(2021, 12, 21, 12, 0, 0, 0, time.UTC), 69.65}] = 0
+
+	for k, v := range observers {
+		got := dayLength(k.date, k.latitude)
+		if math.Abs(got.Minutes()-v.Minutes()) > 5 {
+			t.Errorf("dayLength(%v, %f) = %v, expected %v", k.date, k.latitude, got, v)
+		} else {
+			t.Logf("dayLength(%v, %f) = %v, expected %v", k.date, k.latitude, got, v)
+		}
+	}
+
+}
+
+func TestVirtualLatitude(t *testing.T) {
+
+	// Tromsø UTC
+	latitude := 69.65
+	longitude := 18.96
+	profile := Profile{Compensation: VirtualLatitude, ReferenceLatitude: 55}
+
+	for h := 0; h < 24; h++ {
+		d := time.Date(2021, 12, 21, h, 0, 0, 0, time.UTC)
+		if got, expected := profile.ColorTemp(d, latitude, longitude), ColorTemp(d, 55, longitude); got != expected {
+			t.Errorf("profile.ColorTemp(%v) = %d, expected %d", d, got, expected)
+		}
+		if got, expected := profile.ColorTemp(d, -latitude, longitude), ColorTemp(d, -55, longitude); got != expected {
+			t.Errorf("profile.ColorTemp(%v) in the southern hemisphere = %d, expected %d", d, got, expected)
+		}
+		if got, expected := profile.ColorTemp(d, 45, longitude), ColorTemp(d, 45, longitude); got != expected {
+			t.Errorf("profile.ColorTemp(%v) below the reference latitude = %d, expected %d", d, got, expected)
+		}
+		unset := Profile{Compensation: VirtualLatitude}
+		if got, expected := unset.ColorTemp(d, latitude, longitude), ColorTemp(d, DefaultReferenceLatitude, longitude); got != expected {
+			t.Errorf("profile.ColorTemp(%v) without a reference latitude = %d, expected %d", d, got, expected)
+		}
+	}
+
+}
+
+func TestComfortDay(t *testing.T) {
+
+	// Tromsø UTC
+	latitude := 69.65
+	longitude := 18.96
+	profile := Profile{Compensation: ComfortDay, MinDayLength: 8 * time.Hour, MaxDayLength: 16 * time.Hour}
+	dates := make(map[time.Time]time.Duration)
+	dates[time.Date(2021, 12, 21, 12, 0, 0, 0, time.UTC)] = 8 * time.Hour
+	dates[time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC)] = 16 * time.Hour
+	dates[time.Date(2021, 3, 20, 12, 0, 0, 0, time.UTC)] = dayLength(time.Date(2021, 3, 20, 12, 0, 0, 0, time.UTC), latitude)
+
+	for k, v := range dates {
+		got := dayLength(k, profile.latitude(k, latitude))
+		if math.Abs(got.Minutes()-v.Minutes()) > 1 {
+			t.Errorf("comfort day length on %v = %v, expected %v", k, got, v)
+		} else {
+			t.Logf("comfort day length on %v = %v, expected %v", k, got, v)
+		}
+	}
+
+	// Daylight at noon in December and night at midnight in June
+	noon := time.Date(2021, 12, 21, 11, 0, 0, 0, time.UTC)
+	midnight := time.Date(2021, 6, 21, 23, 0, 0, 0, time.UTC)
+	if got := profile.ColorTemp(noon, latitude, longitude); got < 3000 {
+		t.Errorf("profile.ColorTemp(%v) = %d, expected daylight", noon, got)
+	}
+	if got := profile.ColorTemp(midnight, latitude, longitude); got > 3000 {
+		t.Errorf("profile.ColorTemp(%v) = %d, expected night", midnight, got)
+	}
+	if got := profile.ColorTemp(noon.AddDate(0, -6, 0), -latitude, longitude); got < 3000 {
+		t.Errorf("profile.ColorTemp(%v) in the southern hemisphere = %d, expected daylight", noon.AddDate(0, -6, 0), got)
+	}
+
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Zone is a group of lights following the same profile. When Smoother is set,
+// it decides which setpoints are sent and their transition, otherwise every
+// setpoint is sent with the Transition of the zone. No setpoint is sent for a
+// disabled zone.
+type Zone struct {
+	Name       string
+	Profile    Profile
+	Smoother   *Smoother
+	Transition time.Duration
+	Disabled   bool
+}
+
+// Setpoint is the lighting a zone should be set to, fading over Transition.
+type Setpoint struct {
+	Zone string
+	Lighting
+	Transition time.Duration
+}
+
+// Controller emits the setpoints of its zones at a regular interval, or
+// DefaultInterval when not positive, and at every solar event, on the time of
+// its Clock. Manual settings recorded in
+// Overrides, when set, take precedence over the profiles.
+type Controller struct {
+	Zones     []Zone
+	Interval  time.Duration
+	Overrides *OverrideManager
+	Clock     Clock
+	mu        sync.Mutex
+	latitude  float64
+	longitude float64
+	update    chan struct{}
+}
+
+// DefaultInterval is the interval of controllers without a positive one.
+const DefaultInterval = time.Minute
+
+func NewController(latitude float64, longitude float64, interval time.Duration, zones ...Zone) *Controller {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Controller{
+		Zones:     zones,
+		Interval:  interval,
+		Clock:     RealClock{},
+		latitude:  latitude,
+		longitude: longitude,
+		update:    make(chan struct{}, 1),
+	}
+}
+
+// ZoneNames returns the names of the zones.
+func (c *Controller) ZoneNames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, len(c.Zones))
+	for i, zone := range c.Zones {
+		names[i] = zone.Name
+	}
+	return names
+}
+
+func (c *Controller) Location() (float64, float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latitude, c.longitude
+}
+
+// SetLocation moves the observer, the setpoints being emitted again right away.
+func (c *Controller) SetLocation(latitude float64, longitude float64) {
+	c.mu.Lock()
+	c.latitude, c.longitude = latitude, longitude
+	c.mu.Unlock()
+	c.Refresh()
+}
+
+// SetProfile changes the profile of a zone, the setpoints being emitted again
+// right away. It returns false if there is no such zone.
+func (c *Controller) SetProfile(zone string, profile Profile) bool {
+	c.mu.Lock()
+	defer c.Refresh()
+	defer c.mu.Unlock()
+	for i := range c.Zones {
+		if c.Zones[i].Name == zone {
+			c.Zones[i].Profile = profile
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateProfile sets the profile of the zones following a profile of the same
+// name, the setpoints being emitted again right away. It returns the number
+// of zones updated.
+func (c *Controller) UpdateProfile(profile Profile) int {
+	c.mu.Lock()
+	defer c.Refresh()
+	defer c.mu.Unlock()
+	n := 0
+	for i := range c.Zones {
+		if c.Zones[i].Profile.Name == profile.Name {
+			c.Zones[i].Profile = profile
+			n++
+		}
+	}
+	return n
+}
+
+// SetEnabled enables or disables a zone, the setpoints being emitted again
+// right away. It returns false if there is no such zone.
+func (c *Controller) SetEnabled(zone string, enabled bool) bool {
+	c.mu.Lock()
+	defer c.Refresh()
+	defer c.mu.Unlock()
+	for i := range c.Zones {
+		if c.Zones[i].Name == zone {
+			c.Zones[i].Disabled = !enabled
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled reports whether a zone exists and is enabled.
+func (c *Controller) Enabled(zone string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.Zones {
+		if c.Zones[i].Name == zone {
+			return !c.Zones[i].Disabled
+		}
+	}
+	return false
+}
+
+// Refresh emits the setpoints again right away, for instance after a manual
+// setting was recorded in Overrides.
+func (c *Controller) Refresh() {
+	select {
+	case c.update <- struct{}{}:
+	default:
+	}
+}
+
+// Lighting returns the lighting of a zone at the given date, before smoothing.
+// It returns false if there is no such zone.
+func (c *Controller) Lighting(zone string, date time.Time) (Lighting, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.Zones {
+		if c.Zones[i].Name == zone {
+			return c.lighting(&c.Zones[i], date), true
+		}
+	}
+	return Lighting{}, false
+}
+
+func (c *Controller) lighting(zone *Zone, date time.Time) Lighting {
+	lighting := zone.Profile.Lighting(date, c.latitude, c.longitude)
+	if c.Overrides != nil {
+		lighting = c.Overrides.Apply(zone.Name, lighting, date)
+	}
+	return lighting
+}
+
+// Setpoints returns the setpoints of the zones at the given date. Zones whose
+// Smoother has nothing to send are left out.
+func (c *Controller) Setpoints(date time.Time) []Setpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var setpoints []Setpoint
+	for i := range c.Zones {
+		zone := &c.Zones[i]
+		if zone.Disabled {
+			continue
+		}
+		lighting := c.lighting(zone, date)
+		transition := zone.Transition
+		if zone.Smoother != nil {
+			var ok bool
+			lighting, transition, ok = zone.Smoother.Next(lighting, toDegrees(elevation(date, c.latitude, c.longitude)), date)
+			if !ok {
+				continue
+			}
+		}
+		setpoints = append(setpoints, Setpoint{Zone: zone.Name, Lighting: lighting, Transition: transition})
+	}
+	return setpoints
+}
+
+// next returns when the setpoints are next emitted after the given date: after
+// the interval, or at the next solar event if it comes first. Solar events are
+// computed again from the wall clock each time, which follows midnight and
+// daylight saving time changes.
+func (c *Controller) next(date time.Time) time.Time {
+	latitude, longitude := c.Location()
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	next := date.Add(interval)
+	if event := nextSolarEvent(date, latitude, longitude); !event.IsZero() && event.Before(next) {
+		next = event
+	}
+	return next
+}
+
+// Run emits the setpoints on the channel until the context is done, and
+// returns the context error.
+func (c *Controller) Run(ctx context.Context, setpoints chan<- Setpoint) error {
+	for {
+		now := c.Clock.Now()
+		for _, setpoint := range c.Setpoints(now) {
+			select {
+			case setpoints <- setpoint:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		timer := c.Clock.NewTimer(c.next(now).Sub(now))
+		select {
+		case <-timer.C():
+		case <-c.update:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestControllerSetpoints(t *testing.T) {
+
+	// Paris UTC
+	latitude := 48.87
+	longitude := 2.67
+	office := Profile{Name: "office", BrightnessCurve: Curve{{-6, 10}, {0, 80}}}
+	controller := NewController(latitude, longitude, time.Minute,
+		Zone{Name: "living room", Profile: DefaultProfile, Transition: time.Second},
+		Zone{Name: "office", Profile: office},
+		Zone{Name: "kitchen", Profile: DefaultProfile},
+	)
+	controller.Overrides = &OverrideManager{Hold: time.Hour}
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	manual := Lighting{ColorTemp: 2200, Brightness: 30}
+	controller.Overrides.Set("kitchen", manual, date)
+
+	expected := []Setpoint{
+		{Zone: "living room", Lighting: DefaultProfile.Lighting(date, latitude, longitude), Transition: time.Second},
+		{Zone: "office", Lighting: office.Lighting(date, latitude, longitude)},
+		{Zone: "kitchen", Lighting: manual},
+	}
+	got := controller.Setpoints(date)
+	if len(got) != len(expected) {
+		t.Fatalf("controller.Setpoints(%v) = %+v, expected %+v", date, got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("controller.Setpoints(%v)[%d] = %+v, expected %+v", date, i, got[i], expected[i])
+		} else {
+			t.Logf("controller.Setpoints(%v)[%d] = %+v, expected %+v", date, i, got[i], expected[i])
+		}
+	}
+
+}
+
+func TestControllerSmoother(t *testing.T) {
+
+	// Paris UTC
+	controller := NewController(48.87, 2.67, time.Minute, Zone{Name: "office", Profile: DefaultProfile, Smoother: &Smoother{ColorTempThreshold: 100, BrightnessThreshold: 10}})
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	if got := controller.Setpoints(date); len(got) != 1 {
+		t.Errorf("controller.Setpoints(%v) = %+v, expected the first setpoint", date, got)
+	}
+	if got := controller.Setpoints(date.Add(time.Minute)); len(got) != 0 {
+		t.Errorf("controller.Setpoints(%v) = %+v, expected no change above the thresholds", date.Add(time.Minute), got)
+	}
+
+}
+
+func TestControllerNext(t *testing.T) {
+
+	// Paris UTC
+	latitude := 48.87
+	longitude := 2.67
+	controller := NewController(latitude, longitude, time.Hour)
+	dates := make(map[time.Time]time.Time)
+	dates[time.Date(2021, 6, 21, 8, 0, 0, 0, time.UTC)] = time.Date(2021, 6, 21, 9, 0, 0, 0, time.UTC)
+	dates[time.Date(2021, 6, 21, 11, 30, 0, 0, time.UTC)] = solarNoon(time.Date(2021, 6, 21, 11, 30, 0, 0, time.UTC), longitude)
+	dates[time.Date(2021, 6, 21, 23, 30, 0, 0, time.UTC)] = solarMidnight(time.Date(2021, 6, 22, 23, 30, 0, 0, time.UTC), longitude)
+
+	for k, v := range dates {
+		got := controller.next(k)
+		if !got.Equal(v) {
+			t.Errorf("controller.next(%v) = %v, expected %v", k, got, v)
+		} else {
+			t.Logf("controller.next(%v) = %v, expected %v", k, got, v)
+		}
+	}
+
+	// Moving to Tokyo changes the solar events
+	controller.SetLocation(35.68, 139.67)
+	date := time.Date(2021, 6, 21, 2, 30, 0, 0, time.UTC)
+	if got, expected := controller.next(date), solarNoon(date, 139.67); !got.Equal(expected) {
+		t.Errorf("controller.next(%v) in Tokyo = %v, expected %v", date, got, expected)
+	}
+
+	// An interval that is not positive would busy loop
+	date = time.Date(2021, 6, 21, 8, 0, 0, 0, time.UTC)
+	for _, c := range []*Controller{NewController(latitude, longitude, 0), {Interval: -time.Second, latitude: latitude, longitude: longitude}} {
+		if got, expected := c.next(date), date.Add(DefaultInterval); !got.Equal(expected) {
+			t.Errorf("controller.next(%v) with interval %v = %v, expected %v", date, c.Interval, got, expected)
+		}
+	}
+
+}
+
+func TestControllerRun(t *testing.T) {
+
+	controller := NewController(48.87, 2.67, 10*time.Millisecond, Zone{Name: "office", Profile: DefaultProfile}, Zone{Name: "kitchen", Profile: DefaultProfile})
+	ctx, cancel := context.WithCancel(context.Background())
+	setpoints := make(chan Setpoint)
+	done := make(chan error)
+	go func() {
+		done <- controller.Run(ctx, setpoints)
+	}()
+
+	for i := 0; i < 6; i++ {
+		select {
+		case setpoint := <-setpoints:
+			t.Logf("controller.Run() emitted %+v", setpoint)
+		case <-time.After(time.Second):
+			t.Fatalf("controller.Run() emitted %d setpoints in 1s, expected 6", i)
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("controller.Run() = %v, expected %v", err, context.Canceled)
+	}
+
+}
+
+func TestControllerRunSetLocation(t *testing.T) {
+
+	controller := NewController(48.87, 2.67, time.Hour, Zone{Name: "office", Profile: DefaultProfile})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setpoints := make(chan Setpoint)
+	go controller.Run(ctx, setpoints)
+
+	<-setpoints
+	controller.SetLocation(35.68, 139.67)
+	select {
+	case setpoint := <-setpoints:
+		t.Logf("controller.Run() emitted %+v after moving", setpoint)
+	case <-time.After(time.Second):
+		t.Errorf("controller.Run() emitted nothing after moving")
+	}
+
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NoEventError is returned when a solar event does not occur on a day, such
+// as the sunset during the midnight sun.
+type NoEventError struct {
+	Event    string
+	Date     time.Time
+	Latitude float64
+}
+
+func (e *NoEventError) Error() string {
+	return fmt.Sprintf("%s does not occur on %s at latitude %g", e.Event, e.Date.Format("2006-01-02"), e.Latitude)
+}
+
+// Zenith angles in degrees of the sun at twilight events.
+var twilightZeniths = map[string]float64{
+	"civil":        96,
+	"nautical":     102,
+	"astronomical": 108,
+}
+
+// twilight returns the time of dawn (or dusk) on the given day, when the sun
+// is at the given zenith angle in degrees.
+func twilight(date time.Time, latitude float64, longitude float64, zenith float64, dawn bool) (time.Time, bool) {
+	ha := toDegrees(math.Acos(math.Cos(toRadians(zenith))/(math.Cos(toRadians(latitude))*math.Cos(decl(date))) - (math.Tan(toRadians(latitude)) * math.Tan(decl(date)))))
+	if math.IsNaN(ha) {
+		return time.Time{}, false
+	}
+	if dawn {
+		ha = -ha
+	}
+	var _, offset = date.Zone()
+	minutes := 720 - 4*(longitude-ha) - eqTime(date) + math.Round(float64(offset)/60)
+	// The wall clock time is built as in sunrise, since adding the minutes to
+	// midnight would be off by the change of offset on DST change days.
+	iHour, fHour := math.Modf(minutes / 60)
+	iMinute, fMinute := math.Modf(fHour * 60)
+	iSecond, _ := math.Modf(fMinute * 60)
+	return time.Date(date.Year(), date.Month(), date.Day(), int(iHour), int(iMinute), int(iSecond), 0, date.Location()), true
+}
+
+type solarExpr interface {
+	at(day time.Time, latitude float64, longitude float64) (time.Time, error)
+}
+
+type eventExpr string
+
+type clockExpr struct {
+	hour   int
+	minute int
+}
+
+type offsetExpr struct {
+	expr   solarExpr
+	offset time.Duration
+}
+
+type funcExpr struct {
+	name string
+	args []solarExpr
+}
+
+var eventAliases = map[string]string{
+	"noon":     "solar_noon",
+	"midnight": "solar_midnight",
+	"dawn":     "civil_dawn",
+	"dusk":     "civil_dusk",
+}
+
+func validEvent(name string) bool {
+	switch name {
+	case "sunrise", "sunset", "solar_noon", "solar_midnight":
+		return true
+	}
+	i := strings.LastIndex(name, "_")
+	if i < 0 {
+		return false
+	}
+	_, ok := twilightZeniths[name[:i]]
+	return ok && (name[i+1:] == "dawn" || name[i+1:] == "dusk")
+}
+
+func (e eventExpr) at(day time.Time, latitude float64, longitude float64) (time.Time, error) {
+	noon := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, day.Location())
+	switch e {
+	case "sunrise":
+		if math.IsNaN(hASunrise(noon, latitude)) {
+			return time.Time{}, &NoEventError{Event: string(e), Date: noon, Latitude: latitude}
+		}
+		return sunrise(noon, latitude, longitude), nil
+	case "sunset":
+		if math.IsNaN(hASunset(noon, latitude)) {
+			return time.Time{}, &NoEventError{Event: string(e), Date: noon, Latitude: latitude}
+		}
+		return sunset(noon, latitude, longitude), nil
+	case "solar_noon":
+		return solarNoon(noon, longitude), nil
+	case "solar_midnight":
+		return solarMidnight(noon, longitude), nil
+	}
+	i := strings.LastIndex(string(e), "_")
+	date, ok := twilight(noon, latitude, longitude, twilightZeniths[string(e[:i])], e[i+1:] == "dawn")
+	if !ok {
+		return time.Time{}, &NoEventError{Event: string(e), Date: noon, Latitude: latitude}
+	}
+	return date, nil
+}
+
+func (e clockExpr) at(day time.Time, latitude float64, longitude float64) (time.Time, error) {
+	return time.Date(day.Year(), day.Month(), day.Day(), e.hour, e.minute, 0, 0, day.Location()), nil
+}
+
+func (e offsetExpr) at(day time.Time, latitude float64, longitude float64) (time.Time, error) {
+	date, err := e.expr.at(day, latitude, longitude)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return date.Add(e.offset), nil
+}
+
+func (e funcExpr) at(day time.Time, latitude float64, longitude float64) (time.Time, error) {
+	var result time.Time
+	for i, arg := range e.args {
+		date, err := arg.at(day, latitude, longitude)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if i == 0 || (e.name == "min" && date.Before(result)) || (e.name == "max" && date.After(result)) {
+			result = date
+		}
+	}
+	return result, nil
+}
+
+// Trigger is a parsed solar expression, such as "sunset-15m", "civil_dusk",
+// "max(sunset, 19:30)" or "weekdays at sunrise+10m".
+type Trigger struct {
+	source string
+	days   [7]bool
+	expr   solarExpr
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	switch s {
+	case "daily":
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	case "weekdays":
+		return [7]bool{false, true, true, true, true, true, false}, nil
+	case "weekends":
+		return [7]bool{true, false, false, false, false, false, true}, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		day, ok := weekdays[strings.TrimSpace(name)]
+		if !ok {
+			return days, fmt.Errorf("unknown day %q", strings.TrimSpace(name))
+		}
+		days[day] = true
+	}
+	return days, nil
+}
+
+// ParseTrigger parses a solar expression: an optional "daily", "weekdays",
+// "weekends" or comma separated list of days followed by "at", then an
+// expression. Expressions are solar events (sunrise, sunset, solar_noon,
+// solar_midnight and the civil, nautical and astronomical dawn and dusk),
+// times of day (19:30), min and max of expressions, and expressions plus or
+// minus a duration (15m, 1h30m).
+func ParseTrigger(s string) (*Trigger, error) {
+	t := &Trigger{source: s, days: [7]bool{true, true, true, true, true, true, true}}
+	expr := strings.ToLower(strings.TrimSpace(s))
+	if i := strings.Index(expr, " at "); i >= 0 {
+		days, err := parseDays(strings.TrimSpace(expr[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %q: %w", s, err)
+		}
+		t.days, expr = days, expr[i+4:]
+	}
+	p := &parser{s: expr}
+	e, err := p.parseExpr()
+	if err == nil && p.peek() != 0 {
+		err = fmt.Errorf("unexpected %q at position %d", p.s[p.i:], p.i)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", s, err)
+	}
+	t.expr = e
+	return t, nil
+}
+
+func (t *Trigger) String() string {
+	return t.source
+}
+
+// At returns the instant the trigger resolves to on the day of the given date,
+// in its location, and false when the trigger is not scheduled on that day.
+func (t *Trigger) At(date time.Time, latitude float64, longitude float64) (time.Time, bool, error) {
+	if !t.days[date.Weekday()] {
+		return time.Time{}, false, nil
+	}
+	at, err := t.expr.at(date, latitude, longitude)
+	return at, err == nil, err
+}
+
+// Next returns the first instant after the given date the trigger resolves to,
+// skipping the days it does not occur on. An error is returned when it does
+// not occur within a year.
+func (t *Trigger) Next(date time.Time, latitude float64, longitude float64) (time.Time, error) {
+	var err error
+	for i := -1; i <= 366; i++ {
+		day := time.Date(date.Year(), date.Month(), date.Day()+i, 12, 0, 0, 0, date.Location())
+		at, ok, e := t.At(day, latitude, longitude)
+		if e != nil {
+			err = e
+		} else if ok && at.After(date) {
+			return at, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("%q is never scheduled", t.source)
+	}
+	return time.Time{}, err
+}
+
+type parser struct {
+	s string
+	i int
+}
+
+func (p *parser) skip() {
+	for p.i < len(p.s) && p.s[p.i] == ' ' {
+		p.i++
+	}
+}
+
+func (p *parser) peek() byte {
+	p.skip()
+	if p.i < len(p.s) {
+		return p.s[p.i]
+	}
+	return 0
+}
+
+func (p *parser) span(valid func(byte) bool) string {
+	start := p.i
+	for p.i < len(p.s) && valid(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *parser) parseExpr() (solarExpr, error) {
+	e, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.peek(); c == '+' || c == '-'; c = p.peek() {
+		p.i++
+		p.skip()
+		start := p.i
+		d, err := time.ParseDuration(p.span(func(c byte) bool { return isDigit(c) || isLetter(c) || c == '.' }))
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration at position %d", start)
+		}
+		if c == '-' {
+			d = -d
+		}
+		e = offsetExpr{expr: e, offset: d}
+	}
+	return e, nil
+}
+
+func (p *parser) parseTerm() (solarExpr, error) {
+	c := p.peek()
+	start := p.i
+	if isDigit(c) {
+		clock := p.span(func(c byte) bool { return isDigit(c) || c == ':' })
+		parts := strings.Split(clock, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid time %q at position %d", clock, start)
+		}
+		hour, errHour := strconv.Atoi(parts[0])
+		minute, errMinute := strconv.Atoi(parts[1])
+		if errHour != nil || errMinute != nil || hour > 23 || minute > 59 {
+			return nil, fmt.Errorf("invalid time %q at position %d", clock, start)
+		}
+		return clockExpr{hour: hour, minute: minute}, nil
+	}
+	if !isLetter(c) {
+		if c == 0 {
+			return nil, fmt.Errorf("missing expression at position %d", start)
+		}
+		return nil, fmt.Errorf("unexpected %q at position %d", c, start)
+	}
+	name := p.span(isLetter)
+	if p.peek() == '(' {
+		if name != "min" && name != "max" {
+			return nil, fmt.Errorf("unknown function %q at position %d", name, start)
+		}
+		p.i++
+		f := funcExpr{name: name}
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			f.args = append(f.args, arg)
+			if c := p.peek(); c == ')' {
+				p.i++
+				return f, nil
+			} else if c != ',' {
+				return nil, fmt.Errorf("expected ',' or ')' at position %d", p.i)
+			}
+			p.i++
+		}
+	}
+	if alias, ok := eventAliases[name]; ok {
+		name = alias
+	}
+	if !validEvent(name) {
+		return nil, fmt.Errorf("unknown event %q at position %d", name, start)
+	}
+	return eventExpr(name), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseTrigger(t *testing.T) {
+
+	// Paris, 2021-06-21 is a Monday
+	paris, _ := time.LoadLocation("Europe/Paris")
+	latitude := 48.87
+	longitude := 2.67
+	summer := time.Date(2021, 6, 21, 12, 0, 0, 0, paris)
+	winter := time.Date(2021, 12, 21, 12, 0, 0, 0, paris)
+
+	triggers := []struct {
+		expr     string
+		date     time.Time
+		expected time.Time
+	}{
+		{"sunset", summer, sunset(summer, latitude, longitude)},
+		{"sunset-15m", summer, sunset(summer, latitude, longitude).Add(-15 * time.Minute)},
+		{"Sunrise + 1h30m", summer, sunrise(summer, latitude, longitude).Add(90 * time.Minute)},
+		{"noon", summer, solarNoon(summer, longitude)},
+		{"solar_midnight", summer, solarMidnight(summer, longitude)},
+		{"max(sunset, 19:30)", summer, sunset(summer, latitude, longitude)},
+		{"max(sunset, 19:30)", winter, time.Date(2021, 12, 21, 19, 30, 0, 0, paris)},
+		{"min(sunset - 1h, 19:30, max(sunrise, 6:00))+5m", winter, sunrise(winter, latitude, longitude).Add(5 * time.Minute)},
+		{"weekdays at sunrise+10m", summer, sunrise(summer, latitude, longitude).Add(10 * time.Minute)},
+		{"mon, tue at 7:00", summer, time.Date(2021, 6, 21, 7, 0, 0, 0, paris)},
+	}
+
+	for _, tr := range triggers {
+		trigger, err := ParseTrigger(tr.expr)
+		if err != nil {
+			t.Errorf("ParseTrigger(%q) returned %v", tr.expr, err)
+			continue
+		}
+		got, ok, err := trigger.At(tr.date, latitude, longitude)
+		if err != nil || !ok || !got.Equal(tr.expected) {
+			t.Errorf("%q.At(%v) = %v, %t, %v, expected %v", tr.expr, tr.date, got, ok, err, tr.expected)
+		} else {
+			t.Logf("%q.At(%v) = %v, %t, %v, expected %v", tr.expr, tr.date, got, ok, err, tr.expected)
+		}
+	}
+
+}
+
+func TestTwilightTriggers(t *testing.T) {
+
+	// Paris UTC
+	latitude := 48.87
+	longitude := 2.67
+	date := time.Date(2021, 3, 20, 12, 0, 0, 0, time.UTC)
+	events := make(map[string]float64)
+	events["civil_dawn"] = -6
+	events["dusk"] = -6
+	events["nautical_dawn"] = -12
+	events["nautical_dusk"] = -12
+	events["astronomical_dawn"] = -18
+	events["astronomical_dusk"] = -18
+
+	for k, v := range events {
+		trigger, err := ParseTrigger(k)
+		if err != nil {
+			t.Fatalf("ParseTrigger(%q) returned %v", k, err)
+		}
+		at, _, err := trigger.At(date, latitude, longitude)
+		got := toDegrees(elevation(at, latitude, longitude))
+		if err != nil || math.Abs(got-v) > 0.2 {
+			t.Errorf("elevation at %q (%v) = %f, %v, expected %f", k, at, got, err, v)
+		} else {
+			t.Logf("elevation at %q (%v) = %f, %v, expected %f", k, at, got, err, v)
+		}
+	}
+
+}
+
+func TestTwilightDST(t *testing.T) {
+
+	// Paris on the days daylight saving time starts and ends
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	latitude := 48.87
+	longitude := 2.67
+	for _, day := range []time.Time{time.Date(2021, 3, 28, 0, 0, 0, 0, paris), time.Date(2021, 10, 31, 0, 0, 0, 0, paris)} {
+		var events []time.Time
+		for _, name := range []eventExpr{"civil_dawn", "sunrise", "sunset", "civil_dusk"} {
+			at, err := name.at(day, latitude, longitude)
+			if err != nil {
+				t.Fatalf("%s on %s = %v", name, day.Format("2006-01-02"), err)
+			}
+			events = append(events, at)
+		}
+		for i := 1; i < len(events); i++ {
+			if !events[i-1].Before(events[i]) {
+				t.Errorf("events on %s = %v, expected dawn < sunrise < sunset < dusk", day.Format("2006-01-02"), events)
+			}
+		}
+		for _, at := range []time.Time{events[0], events[3]} {
+			if got := toDegrees(elevation(at, latitude, longitude)); math.Abs(got+6) > 0.2 {
+				t.Errorf("elevation at %v = %f, expected -6", at, got)
+			} else {
+				t.Logf("elevation at %v = %f, expected -6", at, got)
+			}
+		}
+	}
+
+}
+
+func TestTriggerDays(t *testing.T) {
+
+	// Paris, 2021-06-19 is a Saturday
+	paris, _ := time.LoadLocation("Europe/Paris")
+	latitude := 48.87
+	longitude := 2.67
+	saturday := time.Date(2021, 6, 19, 12, 0, 0, 0, paris)
+	monday := time.Date(2021, 6, 21, 12, 0, 0, 0, paris)
+	trigger, _ := ParseTrigger("weekdays at sunrise+10m")
+
+	if _, ok, err := trigger.At(saturday, latitude, longitude); ok || err != nil {
+		t.Errorf("%q.At(%v) = %t, %v, expected not scheduled", trigger, saturday, ok, err)
+	}
+	if got, err := trigger.Next(saturday, latitude, longitude); err != nil || !got.Equal(sunrise(monday, latitude, longitude).Add(10*time.Minute)) {
+		t.Errorf("%q.Next(%v) = %v, %v, expected %v", trigger, saturday, got, err, sunrise(monday, latitude, longitude).Add(10*time.Minute))
+	}
+
+	daily, _ := ParseTrigger("daily at 23:30")
+	late := time.Date(2021, 6, 19, 23, 45, 0, 0, paris)
+	if got, err := daily.Next(late, latitude, longitude); err != nil || !got.Equal(time.Date(2021, 6, 20, 23, 30, 0, 0, paris)) {
+		t.Errorf("%q.Next(%v) = %v, %v, expected the next day", daily, late, got, err)
+	}
+
+}
+
+func TestTriggerPolar(t *testing.T) {
+
+	// Longyearbyen UTC, midnight sun until late August
+	latitude := 78.22
+	longitude := 15.65
+	date := time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC)
+	trigger, _ := ParseTrigger("max(sunset, 19:30)")
+
+	_, _, err := trigger.At(date, latitude, longitude)
+	var noEvent *NoEventError
+	if !errors.As(err, &noEvent) || noEvent.Event != "sunset" {
+		t.Errorf("%q.At(%v) = %v, expected sunset not to occur", trigger, date, err)
+	} else {
+		t.Logf("%q.At(%v) = %v", trigger, date, err)
+	}
+
+	got, err := trigger.Next(date, latitude, longitude)
+	if err != nil || got.Month() != time.August {
+		t.Errorf("%q.Next(%v) = %v, %v, expected a date in August", trigger, date, got, err)
+	}
+
+}
+
+func TestParseTriggerErrors(t *testing.T) {
+
+	for _, expr := range []string{"", "sunsett", "sunset-15x", "sunset+", "max(sunset", "max(sunset 19:30)", "foo(sunset)", "25:00", "7", "funday at sunset", "sunset sunrise", "civil_noon", "*"} {
+		trigger, err := ParseTrigger(expr)
+		if err == nil {
+			t.Errorf("ParseTrigger(%q) = %v, expected an error", expr, trigger)
+		} else {
+			t.Logf("ParseTrigger(%q) returned %v", expr, err)
+		}
+	}
+
+}
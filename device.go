@@ -0,0 +1,163 @@
+package main
+
+import (
+	"math"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+// Capabilities describes what a device is able to reproduce. Zero values mean
+// unbounded ranges, continuous linear brightness and no color support.
+type Capabilities struct {
+	MinColorTemp    int64
+	MaxColorTemp    int64
+	MinMired        int64
+	MaxMired        int64
+	MinBrightness   int64
+	MaxBrightness   int64
+	BrightnessSteps int64
+	Dimming         DimmingCurve
+	Gamut           [3]color.XY
+}
+
+// Light is a light or group of lights found by a driver, which addresses it
+// by its ID.
+type Light struct {
+	ID           string
+	Name         string
+	Capabilities Capabilities
+}
+
+// intersect returns the color temperature range all the lights support.
+func intersect(lights []Light) Capabilities {
+	var c Capabilities
+	for _, light := range lights {
+		m := light.Capabilities
+		if m.MaxMired == 0 {
+			continue
+		}
+		if m.MinMired > c.MinMired {
+			c.MinMired = m.MinMired
+		}
+		if c.MaxMired == 0 || m.MaxMired < c.MaxMired {
+			c.MaxMired = m.MaxMired
+		}
+	}
+	return c
+}
+
+// Clipping reports which requested values were out of a device capabilities.
+type Clipping struct {
+	ColorTemp    bool
+	Brightness   bool
+	Chromaticity bool
+}
+
+func (c Clipping) Clipped() bool {
+	return c.ColorTemp || c.Brightness || c.Chromaticity
+}
+
+// Color gamuts of sRGB displays and strips, and of Philips Hue color bulbs.
+var (
+	GamutSRGB = [3]color.XY{{X: 0.64, Y: 0.33}, {X: 0.30, Y: 0.60}, {X: 0.15, Y: 0.06}}
+	GamutHueC = [3]color.XY{{X: 0.6915, Y: 0.3083}, {X: 0.17, Y: 0.7}, {X: 0.1532, Y: 0.0475}}
+)
+
+// colorTempRange returns the color temperature range in Kelvin allowed by
+// both the Kelvin and the mired ranges.
+func (c Capabilities) colorTempRange() (int64, int64) {
+	min, max := c.MinColorTemp, c.MaxColorTemp
+	if c.MaxMired > 0 {
+		min = int64(math.Max(float64(min), math.Ceil(color.Kelvin(float64(c.MaxMired)))))
+	}
+	if c.MinMired > 0 {
+		kelvin := int64(math.Floor(color.Kelvin(float64(c.MinMired))))
+		if max == 0 || kelvin < max {
+			max = kelvin
+		}
+	}
+	return min, max
+}
+
+// Level returns the device brightness level, between 0 and BrightnessSteps (or
+// 100 with continuous brightness), to drive the device at so that it looks as
+// bright as the brightness percentage. Any non zero brightness is at least
+// level 1.
+func (c Capabilities) Level(brightness int64) int64 {
+	level := float64(brightness) / 100
+	if c.Dimming != nil {
+		level = c.Dimming.Level(level)
+	}
+	steps := c.BrightnessSteps
+	if steps == 0 {
+		steps = 100
+	}
+	l := int64(math.Round(level * float64(steps)))
+	if l == 0 && brightness > 0 {
+		l = 1
+	}
+	return l
+}
+
+// Map clamps the lighting to the device color temperature and brightness
+// ranges and maps its chromaticity, when set, into the device gamut, on the
+// closest point of the gamut triangle.
+func (c Capabilities) Map(lighting Lighting) (Lighting, Clipping) {
+	var clipping Clipping
+	min, max := c.colorTempRange()
+	if lighting.ColorTemp < min {
+		lighting.ColorTemp, clipping.ColorTemp = min, true
+	} else if max > 0 && lighting.ColorTemp > max {
+		lighting.ColorTemp, clipping.ColorTemp = max, true
+	}
+	if clipping.ColorTemp {
+		lighting.Chromaticity = color.CCTToXY(float64(lighting.ColorTemp), lighting.duv())
+	}
+
+	maxBrightness := c.MaxBrightness
+	if maxBrightness == 0 {
+		maxBrightness = 100
+	}
+	if lighting.Brightness < c.MinBrightness {
+		lighting.Brightness, clipping.Brightness = c.MinBrightness, true
+	} else if lighting.Brightness > maxBrightness {
+		lighting.Brightness, clipping.Brightness = maxBrightness, true
+	}
+
+	if c.Gamut != [3]color.XY{} && lighting.Chromaticity != (color.XY{}) && !inTriangle(lighting.Chromaticity, c.Gamut) {
+		lighting.Chromaticity, clipping.Chromaticity = closestInTriangle(lighting.Chromaticity, c.Gamut), true
+	}
+	return lighting, clipping
+}
+
+func cross(o color.XY, a color.XY, b color.XY) float64 {
+	return (a.X-o.X)*(b.Y-o.Y) - (a.Y-o.Y)*(b.X-o.X)
+}
+
+func inTriangle(p color.XY, t [3]color.XY) bool {
+	d1 := cross(t[0], t[1], p)
+	d2 := cross(t[1], t[2], p)
+	d3 := cross(t[2], t[0], p)
+	negative := d1 < 0 || d2 < 0 || d3 < 0
+	positive := d1 > 0 || d2 > 0 || d3 > 0
+	return !(negative && positive)
+}
+
+func closestOnSegment(p color.XY, a color.XY, b color.XY) color.XY {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	k := ((p.X-a.X)*dx + (p.Y-a.Y)*dy) / (dx*dx + dy*dy)
+	k = math.Max(0, math.Min(1, k))
+	return color.XY{X: a.X + k*dx, Y: a.Y + k*dy}
+}
+
+func closestInTriangle(p color.XY, t [3]color.XY) color.XY {
+	var closest color.XY
+	distance := math.Inf(1)
+	for i := 0; i < 3; i++ {
+		q := closestOnSegment(p, t[i], t[(i+1)%3])
+		if d := math.Hypot(p.X-q.X, p.Y-q.Y); d < distance {
+			closest, distance = q, d
+		}
+	}
+	return closest
+}
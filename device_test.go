@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+func TestCapabilitiesMapColorTemp(t *testing.T) {
+
+	ikea := Capabilities{MinColorTemp: 2200, MaxColorTemp: 4000}
+	hue := Capabilities{MinMired: 153, MaxMired: 500}
+	temps := make(map[int64][2]int64)
+	temps[2000] = [2]int64{2200, 2000}
+	temps[3000] = [2]int64{3000, 3000}
+	temps[5500] = [2]int64{4000, 5500}
+	temps[7000] = [2]int64{4000, 6535}
+
+	for k, v := range temps {
+		for i, c := range []Capabilities{ikea, hue} {
+			got, clipping := c.Map(Lighting{ColorTemp: k, Brightness: 50, Chromaticity: color.CCTToXY(float64(k), 0)})
+			if got.ColorTemp != v[i] || clipping.ColorTemp != (k != v[i]) || clipping.Brightness || clipping.Chromaticity {
+				t.Errorf("%v.Map(%d) = %d, %v, expected %d", c, k, got.ColorTemp, clipping, v[i])
+			} else {
+				t.Logf("%v.Map(%d) = %d, %v, expected %d", c, k, got.ColorTemp, clipping, v[i])
+			}
+			if cct, _ := color.XYToCCT(got.Chromaticity); math.Abs(cct-float64(v[i])) > 5 {
+				t.Errorf("%v.Map(%d) chromaticity has CCT %f, expected %d", c, k, cct, v[i])
+			}
+		}
+	}
+
+	// Lighting without chromaticity is clamped onto the Planckian locus
+	got, _ := hue.Map(Lighting{ColorTemp: 7000, Brightness: 50})
+	if cct, duv := color.XYToCCT(got.Chromaticity); math.Abs(cct-6535) > 5 || math.Abs(duv) > 0.0001 {
+		t.Errorf("%v.Map(7000) without chromaticity has CCT %f and Duv %f, expected 6535 and 0", hue, cct, duv)
+	}
+
+}
+
+func TestCapabilitiesMapBrightness(t *testing.T) {
+
+	dimmer := Capabilities{MinBrightness: 10, MaxBrightness: 90}
+	brightnesses := make(map[int64]int64)
+	brightnesses[0] = 10
+	brightnesses[50] = 50
+	brightnesses[100] = 90
+
+	for k, v := range brightnesses {
+		got, clipping := dimmer.Map(Lighting{ColorTemp: 3000, Brightness: k})
+		if got.Brightness != v || clipping.Brightness != (k != v) {
+			t.Errorf("dimmer.Map(%d) = %d, %v, expected %d", k, got.Brightness, clipping, v)
+		} else {
+			t.Logf("dimmer.Map(%d) = %d, %v, expected %d", k, got.Brightness, clipping, v)
+		}
+	}
+
+}
+
+func TestCapabilitiesLevel(t *testing.T) {
+
+	zigbee := Capabilities{BrightnessSteps: 254}
+	brightnesses := make(map[int64]int64)
+	brightnesses[0] = 0
+	brightnesses[1] = 3
+	brightnesses[50] = 127
+	brightnesses[100] = 254
+
+	for k, v := range brightnesses {
+		got := zigbee.Level(k)
+		if got != v {
+			t.Errorf("zigbee.Level(%d) = %d, expected %d", k, got, v)
+		} else {
+			t.Logf("zigbee.Level(%d) = %d, expected %d", k, got, v)
+		}
+	}
+
+	if got := (Capabilities{BrightnessSteps: 1000}).Level(0); got != 0 {
+		t.Errorf("Level(0) = %d, expected 0", got)
+	}
+	if got := (Capabilities{BrightnessSteps: 10}).Level(1); got != 1 {
+		t.Errorf("Level(1) = %d, expected 1", got)
+	}
+
+}
+
+func TestCapabilitiesMapGamut(t *testing.T) {
+
+	strip := Capabilities{Gamut: GamutSRGB}
+	points := make(map[color.XY]color.XY)
+	points[color.XY{X: 0.3127, Y: 0.329}] = color.XY{X: 0.3127, Y: 0.329}
+	points[color.XY{X: 0.7, Y: 0.3}] = color.XY{X: 0.64, Y: 0.33}
+	points[color.XY{X: 0.1, Y: 0.3}] = color.XY{X: 0.2083, Y: 0.2699}
+	points[color.XY{X: 0.45, Y: 0.55}] = color.XY{X: 0.4163, Y: 0.5076}
+	points[color.XY{}] = color.XY{}
+
+	for k, v := range points {
+		got, clipping := strip.Map(Lighting{Chromaticity: k})
+		diff := math.Hypot(got.Chromaticity.X-v.X, got.Chromaticity.Y-v.Y)
+		if diff > 0.0005 || clipping.Chromaticity != (k != v) || clipping.Clipped() != (k != v) {
+			t.Errorf("strip.Map(%v) = %v, %v, expected %v, diff %f", k, got.Chromaticity, clipping, v, diff)
+		} else {
+			t.Logf("strip.Map(%v) = %v, %v, expected %v, diff %f", k, got.Chromaticity, clipping, v, diff)
+		}
+	}
+
+}
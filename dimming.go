@@ -0,0 +1,72 @@
+package main
+
+import "math"
+
+// DimmingCurve maps a perceived brightness between 0 and 1 to the level,
+// between 0 and 1, a device must be driven at to look that bright.
+type DimmingCurve interface {
+	Level(perceived float64) float64
+}
+
+// LinearCurve drives the device proportionally to the perceived brightness.
+type LinearCurve struct{}
+
+// GammaCurve drives the device at the perceived brightness raised to Gamma,
+// as most LED drivers expect with a Gamma around 2.2. A Gamma that is not
+// positive, as in the zero GammaCurve, is 1.
+type GammaCurve struct {
+	Gamma float64
+}
+
+// LightnessCurve drives a device linear in light output so that the perceived
+// brightness is the CIE 1931 lightness L*.
+type LightnessCurve struct{}
+
+// DALICurve drives a DALI ballast, whose 254 arc power levels follow the
+// standard logarithmic curve from 0.1% to 100%, so that the perceived
+// brightness is the CIE 1931 lightness L*.
+type DALICurve struct{}
+
+// TableCurve is a custom lookup table of perceived brightness and device level
+// pairs, sorted by perceived brightness and linear between them. An empty
+// table is linear.
+type TableCurve [][2]float64
+
+func (LinearCurve) Level(perceived float64) float64 {
+	return perceived
+}
+
+func (c GammaCurve) Level(perceived float64) float64 {
+	if !(c.Gamma > 0) {
+		return perceived
+	}
+	return math.Pow(perceived, c.Gamma)
+}
+
+// luminance returns the relative luminance of a CIE 1931 lightness.
+func luminance(lightness float64) float64 {
+	l := lightness * 100
+	if l > 8 {
+		return math.Pow((l+16)/116, 3)
+	}
+	return l / 903.3
+}
+
+func (LightnessCurve) Level(perceived float64) float64 {
+	return luminance(perceived)
+}
+
+func (DALICurve) Level(perceived float64) float64 {
+	if perceived <= 0 {
+		return 0
+	}
+	arc := 1 + (253.0/3)*(math.Log10(luminance(perceived)*100)+1)
+	return math.Max(1, math.Min(254, arc)) / 254
+}
+
+func (c TableCurve) Level(perceived float64) float64 {
+	if len(c) == 0 {
+		return perceived
+	}
+	return interpolate(c, perceived)
+}
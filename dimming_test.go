@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDimmingCurves(t *testing.T) {
+
+	type point struct {
+		curve     DimmingCurve
+		perceived float64
+	}
+	table := TableCurve{{0, 0}, {0.5, 0.1}, {1, 1}}
+	var empty TableCurve
+	points := make(map[point]float64)
+	points[point{LinearCurve{}, 0.5}] = 0.5
+	points[point{GammaCurve{2.2}, 0}] = 0
+	points[point{GammaCurve{2.2}, 0.5}] = 0.2176
+	points[point{GammaCurve{2.2}, 1}] = 1
+	points[point{LightnessCurve{}, 0}] = 0
+	points[point{LightnessCurve{}, 0.01}] = 0.0011
+	points[point{LightnessCurve{}, 0.5}] = 0.1842
+	points[point{LightnessCurve{}, 1}] = 1
+	points[point{DALICurve{}, 0}] = 0
+	points[point{DALICurve{}, 0.01}] = 0.0186
+	points[point{DALICurve{}, 0.5}] = 0.7561
+	points[point{DALICurve{}, 1}] = 1
+	points[point{&table, 0.25}] = 0.05
+	points[point{&table, 0.75}] = 0.55
+	points[point{GammaCurve{}, 0}] = 0
+	points[point{GammaCurve{}, 0.5}] = 0.5
+	points[point{GammaCurve{-2}, 0.5}] = 0.5
+	points[point{&empty, 0.5}] = 0.5
+
+	for k, v := range points {
+		got := k.curve.Level(k.perceived)
+		if math.Abs(got-v) > 0.0001 {
+			t.Errorf("%T.Level(%f) = %f, expected %f, diff %f", k.curve, k.perceived, got, v, math.Abs(got-v))
+		} else {
+			t.Logf("%T.Level(%f) = %f, expected %f, diff %f", k.curve, k.perceived, got, v, math.Abs(got-v))
+		}
+	}
+
+}
+
+func TestCapabilitiesLevelDimming(t *testing.T) {
+
+	dali := Capabilities{BrightnessSteps: 254, Dimming: DALICurve{}}
+	brightnesses := make(map[int64]int64)
+	brightnesses[0] = 0
+	brightnesses[1] = 5
+	brightnesses[50] = 192
+	brightnesses[100] = 254
+
+	for k, v := range brightnesses {
+		got := dali.Level(k)
+		if got != v {
+			t.Errorf("dali.Level(%d) = %d, expected %d", k, got, v)
+		} else {
+			t.Logf("dali.Level(%d) = %d, expected %d", k, got, v)
+		}
+	}
+
+	if got := (Capabilities{Dimming: GammaCurve{2}}).Level(50); got != 25 {
+		t.Errorf("Level(50) with gamma 2 = %d, expected 25", got)
+	}
+
+}
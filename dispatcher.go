@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Dispatcher fans the setpoints of a controller out to many drivers. Each
+// driver is set by its own goroutine, so that a slow or failing driver does not
+// hold the others back, and only the latest setpoint of a zone is applied when
+// a driver falls behind. A driver first discovers its lights, again after a
+// delay doubling from MinBackoff to MaxBackoff, 1s and 1min when 0, until it
+// succeeds, setpoints being applied meanwhile. A failed setpoint is retried up
+// to Retries times, 3 when 0, after the same delays, unless a newer setpoint
+// of its zone supersedes it. Each call to a driver is bounded by Timeout, 30s
+// when 0. Report, when set, is called with the errors of the drivers. Zones a
+// driver has no lights in are not errors.
+type Dispatcher struct {
+	Drivers    map[string]Driver
+	Retries    int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Timeout    time.Duration
+	Clock      Clock
+	Report     func(driver string, err error)
+}
+
+// worker queues the setpoints of a driver.
+type worker struct {
+	name    string
+	driver  Driver
+	mu      sync.Mutex
+	pending map[string]Setpoint
+	wake    chan struct{}
+}
+
+func (w *worker) queue(setpoint Setpoint) {
+	w.mu.Lock()
+	w.pending[setpoint.Zone] = setpoint
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *worker) take() map[string]Setpoint {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pending := w.pending
+	w.pending = make(map[string]Setpoint)
+	return pending
+}
+
+func (d *Dispatcher) clock() Clock {
+	if d.Clock == nil {
+		return RealClock{}
+	}
+	return d.Clock
+}
+
+// backoff returns the delay before retrying after failures in a row.
+func (d *Dispatcher) backoff(failures int) time.Duration {
+	min, max := d.MinBackoff, d.MaxBackoff
+	if min == 0 {
+		min = time.Second
+	}
+	if max == 0 {
+		max = time.Minute
+	}
+	delay := min
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (d *Dispatcher) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return d.Timeout
+}
+
+func (d *Dispatcher) report(driver string, err error) {
+	if d.Report != nil {
+		d.Report(driver, err)
+	}
+}
+
+// call calls a driver within the timeout, recovering from a panic.
+func (d *Dispatcher) call(ctx context.Context, f func(ctx context.Context) error) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f(ctx)
+}
+
+// apply applies a setpoint with the driver of a worker.
+func (d *Dispatcher) apply(ctx context.Context, w *worker, setpoint Setpoint) error {
+	return d.call(ctx, func(ctx context.Context) error {
+		return w.driver.Apply(ctx, setpoint)
+	})
+}
+
+// discover discovers the lights of the driver of a worker.
+func (d *Dispatcher) discover(ctx context.Context, w *worker) error {
+	return d.call(ctx, func(ctx context.Context) error {
+		_, err := w.driver.Discover(ctx)
+		return err
+	})
+}
+
+func (d *Dispatcher) work(ctx context.Context, w *worker) {
+	retries := d.Retries
+	if retries == 0 {
+		retries = 3
+	}
+	failed := make(map[string]Setpoint)
+	attempts := make(map[string]int)
+	failures := 0
+	var timer, discoveryTimer Timer
+	var retry, rediscover <-chan time.Time
+	discoveryFailures := 0
+	discover := func() {
+		err := d.discover(ctx, w)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		discoveryFailures++
+		d.report(w.name, fmt.Errorf("discover: %w", err))
+		discoveryTimer = d.clock().NewTimer(d.backoff(discoveryFailures))
+		rediscover = discoveryTimer.C()
+	}
+	discover()
+	for {
+		var setpoints map[string]Setpoint
+		select {
+		case <-w.wake:
+			setpoints = w.take()
+			for zone := range setpoints {
+				delete(failed, zone)
+				delete(attempts, zone)
+			}
+		case <-retry:
+			setpoints, failed, retry = failed, make(map[string]Setpoint), nil
+		case <-rediscover:
+			rediscover = nil
+			discover()
+			continue
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			if discoveryTimer != nil {
+				discoveryTimer.Stop()
+			}
+			return
+		}
+
+		ok := true
+		for zone, setpoint := range setpoints {
+			err := d.apply(ctx, w, setpoint)
+			if err == nil || errors.Is(err, ErrUnknownZone) {
+				delete(attempts, zone)
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			ok = false
+			attempts[zone]++
+			if attempts[zone] > retries {
+				d.report(w.name, fmt.Errorf("%s: giving up after %d attempts: %w", zone, attempts[zone], err))
+				delete(attempts, zone)
+				continue
+			}
+			d.report(w.name, fmt.Errorf("%s: %w", zone, err))
+			failed[zone] = setpoint
+		}
+		if ok {
+			failures = 0
+		} else {
+			failures++
+		}
+		if len(failed) > 0 && retry == nil {
+			timer = d.clock().NewTimer(d.backoff(failures))
+			retry = timer.C()
+		}
+	}
+}
+
+// Run applies the setpoints it receives with the drivers until the context is
+// done or the channel is closed.
+func (d *Dispatcher) Run(ctx context.Context, setpoints <-chan Setpoint) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	var workers []*worker
+	for name, driver := range d.Drivers {
+		w := &worker{name: name, driver: driver, pending: make(map[string]Setpoint), wake: make(chan struct{}, 1)}
+		workers = append(workers, w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work(ctx, w)
+		}()
+	}
+	for {
+		select {
+		case setpoint, ok := <-setpoints:
+			if !ok {
+				return nil
+			}
+			for _, w := range workers {
+				w.queue(setpoint)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close closes the drivers, returning the first error.
+func (d *Dispatcher) Close() error {
+	var first error
+	for name, driver := range d.Drivers {
+		if err := driver.Close(); err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return first
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDriver records the setpoints applied, failing with the errors of fail
+// first, and its discoveries, failing with the errors of discoverFail first.
+// It has lights in all zones when zones is nil, and blocks applies until
+// their context is done when blocks is set.
+type fakeDriver struct {
+	mu           sync.Mutex
+	zones        map[string]bool
+	fail         []error
+	discoverFail []error
+	discovers    int
+	panics       bool
+	blocks       bool
+	applied      chan Setpoint
+	closed       bool
+}
+
+func (f *fakeDriver) Discover(ctx context.Context) ([]Light, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.discovers++
+	if len(f.discoverFail) > 0 {
+		err := f.discoverFail[0]
+		f.discoverFail = f.discoverFail[1:]
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (f *fakeDriver) discovered() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.discovers
+}
+
+func (f *fakeDriver) Capabilities(light string) (Capabilities, bool) {
+	return Capabilities{}, false
+}
+
+func (f *fakeDriver) Apply(ctx context.Context, setpoint Setpoint) error {
+	if f.panics {
+		panic("broken driver")
+	}
+	if f.blocks {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if f.zones != nil && !f.zones[setpoint.Zone] {
+		return ErrUnknownZone
+	}
+	f.mu.Lock()
+	var err error
+	if len(f.fail) > 0 {
+		err, f.fail = f.fail[0], f.fail[1:]
+	}
+	f.mu.Unlock()
+	if err == nil && f.applied != nil {
+		f.applied <- setpoint
+	}
+	return err
+}
+
+func (f *fakeDriver) State(ctx context.Context, light string) (Lighting, error) {
+	return Lighting{}, nil
+}
+
+func (f *fakeDriver) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestDispatcherIsolation(t *testing.T) {
+
+	ok := &fakeDriver{applied: make(chan Setpoint, 1)}
+	failing := &fakeDriver{fail: []error{errors.New("unreachable"), errors.New("unreachable")}}
+	reports := make(chan error, 10)
+	dispatcher := &Dispatcher{
+		Drivers: map[string]Driver{"ok": ok, "failing": failing, "panicking": &fakeDriver{panics: true}},
+		Retries: 1,
+		Clock:   NewFakeClock(time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)),
+		Report:  func(driver string, err error) { reports <- err },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	setpoints := make(chan Setpoint)
+	done := make(chan error)
+	go func() {
+		done <- dispatcher.Run(ctx, setpoints)
+	}()
+
+	setpoint := Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 4000, Brightness: 80}}
+	setpoints <- setpoint
+	if got := <-ok.applied; got != setpoint {
+		t.Errorf("dispatcher applied %+v, expected %+v", got, setpoint)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-reports:
+			t.Logf("dispatcher reported %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("dispatcher reported %d errors in 1s, expected 2", i)
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("dispatcher.Run() = %v, expected %v", err, context.Canceled)
+	}
+
+}
+
+func TestDispatcherRetries(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC))
+	unreachable := errors.New("unreachable")
+	driver := &fakeDriver{fail: []error{unreachable, unreachable}, applied: make(chan Setpoint, 1)}
+	reports := make(chan error, 10)
+	dispatcher := &Dispatcher{
+		Drivers:    map[string]Driver{"lights": driver},
+		MinBackoff: time.Second,
+		Clock:      clock,
+		Report:     func(driver string, err error) { reports <- err },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setpoints := make(chan Setpoint)
+	go dispatcher.Run(ctx, setpoints)
+
+	setpoint := Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 4000, Brightness: 80}}
+	setpoints <- setpoint
+	start := clock.Now()
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second} {
+		if err := <-reports; !errors.Is(err, unreachable) {
+			t.Errorf("dispatcher reported %v, expected %v", err, unreachable)
+		}
+		clock.WaitTimers(1)
+		clock.Advance(backoff - time.Millisecond)
+		select {
+		case <-driver.applied:
+			t.Fatalf("dispatcher retried before %v", backoff)
+		default:
+		}
+		clock.Advance(time.Millisecond)
+	}
+	select {
+	case got := <-driver.applied:
+		if elapsed := clock.Now().Sub(start); got != setpoint || elapsed != 3*time.Second {
+			t.Errorf("dispatcher applied %+v after %v, expected %+v after 3s", got, elapsed, setpoint)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("dispatcher did not retry")
+	}
+
+}
+
+func TestDispatcherSupersede(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC))
+	driver := &fakeDriver{zones: map[string]bool{"office": true}, fail: []error{errors.New("unreachable")}, applied: make(chan Setpoint, 2)}
+	reports := make(chan error, 10)
+	dispatcher := &Dispatcher{
+		Drivers: map[string]Driver{"lights": driver},
+		Clock:   clock,
+		Report:  func(driver string, err error) { reports <- err },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setpoints := make(chan Setpoint)
+	go dispatcher.Run(ctx, setpoints)
+
+	// The retry of the first setpoint is superseded by the second one, and the
+	// unknown zone of the third one is ignored.
+	setpoints <- Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 4000, Brightness: 80}}
+	<-reports
+	clock.WaitTimers(1)
+	setpoints <- Setpoint{Zone: "kitchen", Lighting: Lighting{ColorTemp: 2700, Brightness: 40}}
+	latest := Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 4200, Brightness: 90}}
+	setpoints <- latest
+	if got := <-driver.applied; got != latest {
+		t.Errorf("dispatcher applied %+v, expected %+v", got, latest)
+	}
+	clock.Step()
+	select {
+	case got := <-driver.applied:
+		t.Errorf("dispatcher applied %+v, expected the retry superseded", got)
+	case err := <-reports:
+		t.Errorf("dispatcher reported %v, expected no error", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
+
+func TestDispatcherDiscover(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC))
+	unreachable := errors.New("unreachable")
+	driver := &fakeDriver{discoverFail: []error{unreachable, unreachable}, applied: make(chan Setpoint, 1)}
+	reports := make(chan error, 10)
+	dispatcher := &Dispatcher{
+		Drivers:    map[string]Driver{"lights": driver},
+		MinBackoff: time.Second,
+		Clock:      clock,
+		Report:     func(driver string, err error) { reports <- err },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setpoints := make(chan Setpoint)
+	go dispatcher.Run(ctx, setpoints)
+
+	// Setpoints are applied while the discovery is retried.
+	if err := <-reports; !errors.Is(err, unreachable) {
+		t.Errorf("dispatcher reported %v, expected %v", err, unreachable)
+	}
+	clock.WaitTimers(1)
+	setpoint := Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 4000, Brightness: 80}}
+	setpoints <- setpoint
+	if got := <-driver.applied; got != setpoint {
+		t.Errorf("dispatcher applied %+v, expected %+v", got, setpoint)
+	}
+	clock.Advance(time.Second)
+	if err := <-reports; !errors.Is(err, unreachable) {
+		t.Errorf("dispatcher reported %v, expected %v", err, unreachable)
+	}
+	clock.WaitTimers(1)
+	clock.Advance(2*time.Second - time.Millisecond)
+	if got := driver.discovered(); got != 2 {
+		t.Errorf("dispatcher discovered %d times before 2s, expected 2", got)
+	}
+	clock.Advance(time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for driver.discovered() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := driver.discovered(); got != 3 {
+		t.Errorf("dispatcher discovered %d times after 3s, expected 3", got)
+	}
+	select {
+	case err := <-reports:
+		t.Errorf("dispatcher reported %v, expected the discovery to succeed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
+
+func TestDispatcherTimeout(t *testing.T) {
+
+	reports := make(chan error, 10)
+	dispatcher := &Dispatcher{
+		Drivers: map[string]Driver{"stuck": &fakeDriver{blocks: true}},
+		Retries: -1,
+		Timeout: 10 * time.Millisecond,
+		Clock:   NewFakeClock(time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)),
+		Report:  func(driver string, err error) { reports <- err },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setpoints := make(chan Setpoint)
+	go dispatcher.Run(ctx, setpoints)
+
+	setpoints <- Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 4000, Brightness: 80}}
+	select {
+	case err := <-reports:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("dispatcher reported %v, expected %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("dispatcher did not time the driver out")
+	}
+
+}
+
+func TestDispatcherHue(t *testing.T) {
+
+	bridge, hue := newFakeHueBridge(t)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bridge.certificate.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options, _ := json.Marshal(map[string]string{"address": hue.Address, "key": hue.Key, "ca": ca})
+	overrides := &OverrideManager{Hold: time.Hour}
+	drivers, err := NewDrivers([]DriverConfig{{Name: "hue", Type: "hue", Zones: map[string][]string{"kitchen": {"Kitchen"}}, Options: options, Overrides: overrides}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := &Dispatcher{Drivers: drivers, Report: func(driver string, err error) { t.Errorf("dispatcher reported %s: %v", driver, err) }}
+	defer dispatcher.Close()
+	select {
+	case <-bridge.watching:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the hue driver does not watch the bridge")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setpoints := make(chan Setpoint)
+	go dispatcher.Run(ctx, setpoints)
+
+	// The room is found by its name once discovered.
+	setpoints <- Setpoint{Zone: "kitchen", Lighting: Lighting{ColorTemp: 6500, Brightness: 80}, Transition: 2 * time.Second}
+	expected := []string{"grouped_light/group-1 brightness 80 mirek 200 duration 2000"}
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); len(got) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		got = bridge.sentUpdates()
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("dispatcher applied %v, expected %v", got, expected)
+	}
+
+	bridge.manual("pendant", hueResource{Dimming: &hueDimming{Brightness: 20}})
+	var ok bool
+	for deadline := time.Now().Add(5 * time.Second); !ok && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		_, ok = overrides.Override("light/pendant", time.Now())
+	}
+	if !ok {
+		t.Errorf("manual change of the pendant not recorded in the overrides of the driver")
+	}
+
+}
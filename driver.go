@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/mqtt"
+)
+
+// Driver sets the lights of a technology or a brand. Discover returns the
+// lights it can reach, with an error for those it cannot, Capabilities what a discovered light supports, Apply
+// sets the lights of the zone of a setpoint, State returns the current
+// lighting of a light and Close releases its connections.
+type Driver interface {
+	Discover(ctx context.Context) ([]Light, error)
+	Capabilities(light string) (Capabilities, bool)
+	Apply(ctx context.Context, setpoint Setpoint) error
+	State(ctx context.Context, light string) (Lighting, error)
+	Close() error
+}
+
+var (
+	_ Driver = (*Zigbee2MQTT)(nil)
+	_ Driver = (*Hue)(nil)
+	_ Driver = (*LIFX)(nil)
+	_ Driver = (*WLED)(nil)
+	_ Driver = (*ESPHome)(nil)
+	_ Driver = (*Yeelight)(nil)
+	_ Driver = (*Tasmota)(nil)
+)
+
+// ErrUnknownZone is returned when applying a setpoint to a driver without
+// lights in its zone.
+var ErrUnknownZone = errors.New("unknown zone")
+
+// DriverConfig is the configuration of a driver: the type it is registered
+// with, the lights of each zone, and options specific to its type. Clock and
+// Overrides are not part of the JSON configuration: Clock is the clock drivers
+// tell the time with, the real clock when nil, and Overrides records the
+// manual settings of the drivers following them, when set.
+type DriverConfig struct {
+	Name      string              `json:"name"`
+	Type      string              `json:"type"`
+	Zones     map[string][]string `json:"zones"`
+	Options   json.RawMessage     `json:"options"`
+	Clock     Clock               `json:"-"`
+	Overrides *OverrideManager    `json:"-"`
+}
+
+// DriverFactory creates a driver from its configuration.
+type DriverFactory func(config DriverConfig) (Driver, error)
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]DriverFactory{
+		"zigbee2mqtt": newZigbee2MQTT,
+		"hue":         newHue,
+		"lifx":        newLIFX,
+		"wled":        newWLED,
+		"esphome":     newESPHome,
+		"yeelight":    newYeelight,
+		"tasmota":     newTasmota,
+	}
+)
+
+// RegisterDriver makes a driver type available to NewDriver.
+func RegisterDriver(kind string, factory DriverFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[kind] = factory
+}
+
+// DriverTypes returns the registered driver types.
+func DriverTypes() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	var types []string
+	for kind := range registry {
+		types = append(types, kind)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewDriver creates a driver from its configuration.
+func NewDriver(config DriverConfig) (Driver, error) {
+	registryMu.Lock()
+	factory, ok := registry[config.Type]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("driver %s: unknown type %q", config.Name, config.Type)
+	}
+	driver, err := factory(config)
+	if err != nil {
+		return nil, fmt.Errorf("driver %s: %w", config.Name, err)
+	}
+	return driver, nil
+}
+
+// NewDrivers creates drivers from their configurations, by name.
+func NewDrivers(configs []DriverConfig) (map[string]Driver, error) {
+	drivers := make(map[string]Driver)
+	for _, config := range configs {
+		if _, ok := drivers[config.Name]; ok || config.Name == "" {
+			closeDrivers(drivers)
+			return nil, fmt.Errorf("driver %q: missing or duplicate name", config.Name)
+		}
+		driver, err := NewDriver(config)
+		if err != nil {
+			closeDrivers(drivers)
+			return nil, err
+		}
+		drivers[config.Name] = driver
+	}
+	return drivers, nil
+}
+
+func closeDrivers(drivers map[string]Driver) {
+	for _, driver := range drivers {
+		driver.Close()
+	}
+}
+
+// options decodes the options of a driver, if any.
+func (c DriverConfig) options(options interface{}) error {
+	if len(c.Options) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(c.Options, options); err != nil {
+		return fmt.Errorf("options: %w", err)
+	}
+	return nil
+}
+
+// parseDuration parses a duration option, 0 when empty.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// mqttConfig is the connection of a driver to an MQTT broker.
+type mqttConfig struct {
+	Address  string `json:"address"`
+	ClientID string `json:"clientId"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	TLS      bool   `json:"tls"`
+}
+
+func (c mqttConfig) connect() (*mqtt.Client, error) {
+	opts := mqtt.Options{Address: c.Address, ClientID: c.ClientID, Username: c.Username, Password: c.Password, KeepAlive: time.Minute, Reconnect: true}
+	if c.TLS {
+		opts.TLS = &tls.Config{}
+	}
+	return mqtt.Connect(opts)
+}
+
+func newZigbee2MQTT(config DriverConfig) (Driver, error) {
+	var options struct {
+		MQTT      mqttConfig `json:"mqtt"`
+		BaseTopic string     `json:"baseTopic"`
+		QoS       byte       `json:"qos"`
+	}
+	if err := config.options(&options); err != nil {
+		return nil, err
+	}
+	client, err := options.MQTT.connect()
+	if err != nil {
+		return nil, err
+	}
+	return &Zigbee2MQTT{Client: client, BaseTopic: options.BaseTopic, QoS: options.QoS, Zones: config.Zones, ownsClient: true}, nil
+}
+
+// newHue creates a Hue driver which, with Overrides, watches the bridge until
+// it is closed.
+func newHue(config DriverConfig) (Driver, error) {
+	var options struct {
+		Address  string `json:"address"`
+		Key      string `json:"key"`
+		CA       string `json:"ca"`
+		Insecure bool   `json:"insecure"`
+	}
+	if err := config.options(&options); err != nil {
+		return nil, err
+	}
+	hue := &Hue{Address: options.Address, Key: options.Key, Zones: config.Zones, Overrides: config.Overrides, Clock: config.Clock}
+	// Bridges serve HTTPS with a certificate signed by Philips, trusted with
+	// the PEM certificates of the ca file.
+	switch {
+	case options.CA != "":
+		pem, err := ioutil.ReadFile(options.CA)
+		if err != nil {
+			return nil, fmt.Errorf("ca: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca: no certificate in %s", options.CA)
+		}
+		hue.Client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	case options.Insecure:
+		hue.Client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+	if hue.Overrides != nil {
+		var ctx context.Context
+		ctx, hue.stop = context.WithCancel(context.Background())
+		hue.stopped = make(chan struct{})
+		go hue.watch(ctx)
+	}
+	return hue, nil
+}
+
+func newLIFX(config DriverConfig) (Driver, error) {
+	var options struct {
+		Addresses []string `json:"addresses"`
+		Timeout   string   `json:"timeout"`
+		Retries   int      `json:"retries"`
+	}
+	if err := config.options(&options); err != nil {
+		return nil, err
+	}
+	timeout, err := parseDuration(options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &LIFX{Addresses: options.Addresses, Timeout: timeout, Retries: options.Retries, Zones: config.Zones}, nil
+}
+
+func newWLED(config DriverConfig) (Driver, error) {
+	return &WLED{Zones: config.Zones}, nil
+}
+
+func newESPHome(config DriverConfig) (Driver, error) {
+	return &ESPHome{Zones: config.Zones}, nil
+}
+
+func newYeelight(config DriverConfig) (Driver, error) {
+	var options struct {
+		Music   bool   `json:"music"`
+		Timeout string `json:"timeout"`
+	}
+	if err := config.options(&options); err != nil {
+		return nil, err
+	}
+	timeout, err := parseDuration(options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Yeelight{Music: options.Music, Timeout: timeout, Zones: config.Zones}, nil
+}
+
+func newTasmota(config DriverConfig) (Driver, error) {
+	var options struct {
+		Username string      `json:"username"`
+		Password string      `json:"password"`
+		MQTT     *mqttConfig `json:"mqtt"`
+		QoS      byte        `json:"qos"`
+		Timeout  string      `json:"timeout"`
+	}
+	if err := config.options(&options); err != nil {
+		return nil, err
+	}
+	timeout, err := parseDuration(options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	tasmota := &Tasmota{Username: options.Username, Password: options.Password, QoS: options.QoS, Timeout: timeout, Zones: config.Zones}
+	if options.MQTT != nil {
+		if tasmota.MQTT, err = options.MQTT.connect(); err != nil {
+			return nil, err
+		}
+		tasmota.ownsMQTT = true
+	}
+	return tasmota, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNewDriver(t *testing.T) {
+
+	zones := map[string][]string{"office": {"192.168.1.20"}}
+	configs := map[string]DriverConfig{
+		`{"name": "wled", "type": "wled"}`:         {Name: "wled", Type: "wled", Zones: zones},
+		`{"name": "lifx", "type": "lifx"}`:         {Name: "lifx", Type: "lifx", Zones: zones, Options: json.RawMessage(`{"addresses": ["192.168.1.20:56700"], "timeout": "200ms", "retries": 2}`)},
+		`{"name": "yeelight", "type": "yeelight"}`: {Name: "yeelight", Type: "yeelight", Zones: zones, Options: json.RawMessage(`{"music": true}`)},
+	}
+	for k, config := range configs {
+		driver, err := NewDriver(config)
+		if err != nil {
+			t.Errorf("NewDriver(%s) = %v", k, err)
+			continue
+		}
+		t.Logf("NewDriver(%s) = %T", k, driver)
+	}
+
+	driver, err := NewDriver(configs[`{"name": "lifx", "type": "lifx"}`])
+	if lifx, ok := driver.(*LIFX); err != nil || !ok || lifx.Timeout != 200*time.Millisecond || lifx.Retries != 2 || len(lifx.Zones["office"]) != 1 {
+		t.Errorf("NewDriver(lifx) = %+v, %v, expected the options and zones set", driver, err)
+	}
+
+	clock := NewFakeClock(time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC))
+	driver, err = NewDriver(DriverConfig{Name: "hue", Type: "hue", Clock: clock})
+	if hue, ok := driver.(*Hue); err != nil || !ok || !hue.now().Equal(clock.Now()) {
+		t.Errorf("NewDriver(hue) = %+v, %v, expected the clock set", driver, err)
+	}
+
+	invalid := map[string]DriverConfig{
+		"unknown type":     {Name: "x", Type: "x10"},
+		"invalid options":  {Name: "lifx", Type: "lifx", Options: json.RawMessage(`{"retries": "many"}`)},
+		"invalid duration": {Name: "yeelight", Type: "yeelight", Options: json.RawMessage(`{"timeout": "soon"}`)},
+		"missing ca":       {Name: "hue", Type: "hue", Options: json.RawMessage(`{"ca": "missing.pem"}`)},
+	}
+	for k, config := range invalid {
+		if _, err := NewDriver(config); err == nil {
+			t.Errorf("NewDriver() with %s = nil, expected an error", k)
+		}
+	}
+
+}
+
+func TestRegisterDriver(t *testing.T) {
+
+	RegisterDriver("test", func(config DriverConfig) (Driver, error) {
+		return &fakeDriver{}, nil
+	})
+	drivers, err := NewDrivers([]DriverConfig{{Name: "a", Type: "test"}, {Name: "b", Type: "test"}})
+	if err != nil || len(drivers) != 2 {
+		t.Errorf("NewDrivers() = %v, %v, expected 2 drivers", drivers, err)
+	}
+
+	closed := &fakeDriver{}
+	RegisterDriver("closed", func(config DriverConfig) (Driver, error) {
+		return closed, nil
+	})
+	if _, err := NewDrivers([]DriverConfig{{Name: "a", Type: "closed"}, {Name: "a", Type: "test"}}); err == nil {
+		t.Errorf("NewDrivers() with a duplicate name = nil, expected an error")
+	}
+	if !closed.closed {
+		t.Errorf("NewDrivers() failing left the drivers created open")
+	}
+
+}
+
+func TestDriverCloseMQTT(t *testing.T) {
+
+	broker, _, _ := newTestBroker(t)
+	// connections waits for the broker to have n connections.
+	connections := func(n int) int {
+		deadline := time.Now().Add(5 * time.Second)
+		for broker.Connections() != n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return broker.Connections()
+	}
+	options := json.RawMessage(`{"mqtt": {"address": "` + broker.Addr() + `"}}`)
+	drivers, err := NewDrivers([]DriverConfig{{Name: "zigbee", Type: "zigbee2mqtt", Options: options}, {Name: "tasmota", Type: "tasmota", Options: options}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := connections(4); got != 4 {
+		t.Errorf("broker.Connections() = %d, expected 4", got)
+	}
+	closeDrivers(drivers)
+	if got := connections(2); got != 2 {
+		t.Errorf("broker.Connections() after closing the drivers = %d, expected 2", got)
+	}
+
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+// ESPHome drives lights of ESPHome devices through the REST API of their web
+// server. Zones maps the zones to light entities as "<host>/<object id>".
+// Lights with color temperature support are set in mireds, and RGB lights with
+// the sRGB color of the color temperature. A nil Client is
+// http.DefaultClient.
+type ESPHome struct {
+	Client *http.Client
+	Zones  map[string][]string
+
+	mu     sync.Mutex
+	lights map[string]Light
+}
+
+type esphomeLight struct {
+	Name       string   `json:"name"`
+	State      string   `json:"state"`
+	Brightness *float64 `json:"brightness"`
+	ColorMode  string   `json:"color_mode"`
+	Color      *struct {
+		R float64 `json:"r"`
+		G float64 `json:"g"`
+		B float64 `json:"b"`
+	} `json:"color"`
+	ColorTemp float64 `json:"color_temp"`
+	MinMireds float64 `json:"min_mireds"`
+	MaxMireds float64 `json:"max_mireds"`
+}
+
+func esphomeURL(light string) (string, error) {
+	i := strings.LastIndex(light, "/")
+	if i < 0 {
+		return "", fmt.Errorf("esphome: invalid light %q", light)
+	}
+	return "http://" + light[:i] + "/light/" + url.PathEscape(light[i+1:]), nil
+}
+
+func (e *ESPHome) get(ctx context.Context, light string) (esphomeLight, error) {
+	u, err := esphomeURL(light)
+	if err != nil {
+		return esphomeLight{}, err
+	}
+	var state esphomeLight
+	if err := requestJSON(ctx, e.Client, http.MethodGet, u+"?detail=all", nil, &state); err != nil {
+		return esphomeLight{}, fmt.Errorf("esphome: %w", err)
+	}
+	return state, nil
+}
+
+// Discover returns the lights of the zones.
+func (e *ESPHome) Discover(ctx context.Context) ([]Light, error) {
+	lights := make(map[string]Light)
+	var discovered []Light
+	for _, zone := range e.Zones {
+		for _, id := range zone {
+			if _, ok := lights[id]; ok {
+				continue
+			}
+			state, err := e.get(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			light := Light{ID: id, Name: state.Name, Capabilities: Capabilities{BrightnessSteps: 255}}
+			if state.MaxMireds > 0 {
+				light.Capabilities.MinMired, light.Capabilities.MaxMired = int64(math.Ceil(state.MinMireds)), int64(math.Floor(state.MaxMireds))
+			} else if state.Color != nil {
+				light.Capabilities.Gamut = GamutSRGB
+			}
+			lights[id] = light
+			discovered = append(discovered, light)
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lights = lights
+	return discovered, nil
+}
+
+// Capabilities returns what a discovered light supports.
+func (e *ESPHome) Capabilities(light string) (Capabilities, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l, ok := e.lights[light]
+	return l.Capabilities, ok
+}
+
+// Apply turns on the lights of the zone of the setpoint at its color
+// temperature and brightness, with its transition. Lights not discovered yet
+// are set in mireds.
+func (e *ESPHome) Apply(ctx context.Context, setpoint Setpoint) error {
+	lights, ok := e.Zones[setpoint.Zone]
+	if !ok {
+		return fmt.Errorf("esphome: %w %q", ErrUnknownZone, setpoint.Zone)
+	}
+	for _, light := range lights {
+		u, err := esphomeURL(light)
+		if err != nil {
+			return err
+		}
+		c, ok := e.Capabilities(light)
+		if !ok {
+			c = Capabilities{MinMired: 153, MaxMired: 500, BrightnessSteps: 255}
+		}
+		lighting, _ := c.Map(setpoint.Lighting)
+		query := url.Values{}
+		query.Set("brightness", strconv.FormatInt(c.Level(lighting.Brightness), 10))
+		query.Set("transition", strconv.FormatFloat(setpoint.Transition.Seconds(), 'f', -1, 64))
+		if c.MaxMired > 0 {
+			query.Set("color_temp", strconv.FormatInt(int64(math.Round(color.Mired(float64(lighting.ColorTemp)))), 10))
+		} else if c.Gamut != ([3]color.XY{}) {
+			rgb := rgb255(lighting)
+			query.Set("r", strconv.FormatInt(rgb[0], 10))
+			query.Set("g", strconv.FormatInt(rgb[1], 10))
+			query.Set("b", strconv.FormatInt(rgb[2], 10))
+		}
+		if err := requestJSON(ctx, e.Client, http.MethodPost, u+"/turn_on?"+query.Encode(), nil, nil); err != nil {
+			return fmt.Errorf("esphome: %w", err)
+		}
+	}
+	return nil
+}
+
+// State returns the current lighting of a light.
+func (e *ESPHome) State(ctx context.Context, light string) (Lighting, error) {
+	state, err := e.get(ctx, light)
+	if err != nil {
+		return Lighting{}, err
+	}
+	var lighting Lighting
+	if state.ColorTemp > 0 && state.ColorMode != "rgb" {
+		lighting.ColorTemp = int64(math.Round(color.Kelvin(state.ColorTemp)))
+	} else if state.Color != nil {
+		cct, _ := color.RGBToCCT(color.RGB{R: state.Color.R / 255, G: state.Color.G / 255, B: state.Color.B / 255})
+		lighting.ColorTemp = int64(math.Round(cct))
+	}
+	if state.Brightness != nil {
+		lighting.Brightness = int64(math.Round(*state.Brightness * 100 / 255))
+	}
+	if state.State == "OFF" {
+		lighting.Brightness = 0
+	}
+	return lighting, nil
+}
+
+// Close closes the idle connections to the devices.
+func (e *ESPHome) Close() error {
+	if e.Client != nil {
+		e.Client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeESPHome is a stand-in of an ESPHome web server with a color temperature
+// light and an RGB light, recording the commands it receives.
+type fakeESPHome struct {
+	mu       sync.Mutex
+	lights   map[string]map[string]interface{}
+	commands []string
+}
+
+func newFakeESPHome(t *testing.T) (*fakeESPHome, string) {
+	device := &fakeESPHome{lights: map[string]map[string]interface{}{
+		"desk":  {"id": "light-desk", "name": "Desk", "state": "ON", "brightness": 255, "color_mode": "color_temperature", "color_temp": 370, "min_mireds": 153, "max_mireds": 370},
+		"strip": {"id": "light-strip", "name": "Strip", "state": "OFF", "brightness": 128, "color_mode": "rgb", "color": map[string]int{"r": 255, "g": 173, "b": 88}},
+	}}
+	server := httptest.NewServer(device)
+	t.Cleanup(server.Close)
+	return device, strings.TrimPrefix(server.URL, "http://")
+}
+
+func (d *fakeESPHome) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/light/"), "/")
+	light, ok := d.lights[path[0]]
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet && len(path) == 1:
+		json.NewEncoder(w).Encode(light)
+	case r.Method == http.MethodPost && len(path) == 2 && path[1] == "turn_on":
+		d.commands = append(d.commands, path[0]+"?"+r.URL.RawQuery)
+		light["state"] = "ON"
+		light["brightness"], _ = strconv.Atoi(r.URL.Query().Get("brightness"))
+		if mireds := r.URL.Query().Get("color_temp"); mireds != "" {
+			light["color_temp"], _ = strconv.Atoi(mireds)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *fakeESPHome) sent() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	commands := d.commands
+	d.commands = nil
+	return commands
+}
+
+func TestESPHome(t *testing.T) {
+
+	device, host := newFakeESPHome(t)
+	esphome := &ESPHome{Zones: map[string][]string{"office": {host + "/desk", host + "/strip"}}}
+	defer esphome.Close()
+	ctx := context.Background()
+
+	lights, err := esphome.Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]Light)
+	expected[host+"/desk"] = Light{ID: host + "/desk", Name: "Desk", Capabilities: Capabilities{MinMired: 153, MaxMired: 370, BrightnessSteps: 255}}
+	expected[host+"/strip"] = Light{ID: host + "/strip", Name: "Strip", Capabilities: Capabilities{BrightnessSteps: 255, Gamut: GamutSRGB}}
+	if len(lights) != len(expected) {
+		t.Errorf("esphome.Discover() = %+v, expected %+v", lights, expected)
+	}
+	for _, light := range lights {
+		if light != expected[light.ID] {
+			t.Errorf("esphome.Discover(): %+v, expected %+v", light, expected[light.ID])
+		}
+	}
+
+	setpoints := []struct {
+		setpoint Setpoint
+		expected []string
+	}{
+		{
+			Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 2700, Brightness: 50}, Transition: 2 * time.Second},
+			[]string{"desk?brightness=128&color_temp=370&transition=2", "strip?b=88&brightness=128&g=173&r=255&transition=2"},
+		},
+		{
+			Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 2000, Brightness: 100}, Transition: 1500 * time.Millisecond},
+			[]string{"desk?brightness=255&color_temp=370&transition=1.5", "strip?b=22&brightness=255&g=139&r=255&transition=1.5"},
+		},
+	}
+	for _, s := range setpoints {
+		if err := esphome.Apply(ctx, s.setpoint); err != nil {
+			t.Fatal(err)
+		}
+		if got := device.sent(); strings.Join(got, " ") != strings.Join(s.expected, " ") {
+			t.Errorf("esphome.Apply(%+v) = %v, expected %v", s.setpoint, got, s.expected)
+		}
+	}
+
+	states := make(map[string]Lighting)
+	states[host+"/desk"] = Lighting{ColorTemp: 2703, Brightness: 100}
+	states[host+"/strip"] = Lighting{ColorTemp: 2706, Brightness: 100}
+	for k, v := range states {
+		if got, err := esphome.State(ctx, k); err != nil || got != v {
+			t.Errorf("esphome.State(%s) = %+v, %v, expected %+v", k, got, err, v)
+		}
+	}
+	if err := esphome.Apply(ctx, Setpoint{Zone: "garage"}); err == nil {
+		t.Errorf("esphome.Apply() succeeded on an unknown zone")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/grpc"
+)
+
+// GRPCService serves the Circadian service of api/circadian.proto for a
+// controller, with the server of Server. Run follows the setpoints of the
+// controller, which WatchSetpoints sends to its callers when the color
+// temperature or brightness of a zone changes.
+type GRPCService struct {
+	Controller *Controller
+
+	mu        sync.Mutex
+	setpoints map[string]grpcSetpoint
+	// changed is closed and replaced when a setpoint is received.
+	changed chan struct{}
+}
+
+// grpcSetpoint is a setpoint and the time it was received at.
+type grpcSetpoint struct {
+	Setpoint
+	time time.Time
+}
+
+// Server returns the gRPC server of the service.
+func (s *GRPCService) Server() grpc.Server {
+	return grpc.Server{
+		"/circadian.v1.Circadian/GetSunPosition": s.sunPosition,
+		"/circadian.v1.Circadian/GetSolarEvents": s.solarEvents,
+		"/circadian.v1.Circadian/GetLighting":    s.lighting,
+		"/circadian.v1.Circadian/WatchSetpoints": s.watchSetpoints,
+	}
+}
+
+// fields decodes a request.
+func fields(request []byte) ([]grpc.Field, error) {
+	fields, err := grpc.Fields(request)
+	if err != nil {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "%v", err)
+	}
+	return fields, nil
+}
+
+// location decodes a Location, the location of the controller when missing.
+func (s *GRPCService) location(f *grpc.Field) (float64, float64, error) {
+	if f == nil {
+		latitude, longitude := s.Controller.Location()
+		return latitude, longitude, nil
+	}
+	fields, err := fields(f.Bytes)
+	if err != nil {
+		return 0, 0, err
+	}
+	var latitude, longitude float64
+	for _, field := range fields {
+		switch field.Number {
+		case 1:
+			latitude = field.Double()
+		case 2:
+			longitude = field.Double()
+		}
+	}
+	if !validCoordinates(latitude, longitude) {
+		return 0, 0, grpc.Errorf(grpc.InvalidArgument, "invalid location %v, %v, expected degrees within ±90 and ±180", latitude, longitude)
+	}
+	return latitude, longitude, nil
+}
+
+// time decodes a Timestamp, now on the clock of the controller when missing.
+func (s *GRPCService) time(f *grpc.Field) (time.Time, error) {
+	if f == nil {
+		return s.Controller.Clock.Now(), nil
+	}
+	t, err := f.Timestamp()
+	if err != nil {
+		return time.Time{}, grpc.Errorf(grpc.InvalidArgument, "invalid time: %v", err)
+	}
+	return t, nil
+}
+
+func (s *GRPCService) sunPosition(ctx context.Context, request []byte, send func([]byte) error) error {
+	fields, err := fields(request)
+	if err != nil {
+		return err
+	}
+	var location, t *grpc.Field
+	for i := range fields {
+		switch fields[i].Number {
+		case 1:
+			location = &fields[i]
+		case 2:
+			t = &fields[i]
+		}
+	}
+	latitude, longitude, err := s.location(location)
+	if err != nil {
+		return err
+	}
+	date, err := s.time(t)
+	if err != nil {
+		return err
+	}
+	response := grpc.AppendTimestamp(nil, 1, date)
+	response = grpc.AppendDouble(response, 2, toDegrees(elevation(date, latitude, longitude)))
+	response = grpc.AppendDouble(response, 3, toDegrees(azimuth(date, latitude, longitude)))
+	return send(response)
+}
+
+func (s *GRPCService) solarEvents(ctx context.Context, request []byte, send func([]byte) error) error {
+	fields, err := fields(request)
+	if err != nil {
+		return err
+	}
+	var location *grpc.Field
+	var day, tz string
+	for i := range fields {
+		switch fields[i].Number {
+		case 1:
+			location = &fields[i]
+		case 2:
+			day = fields[i].String()
+		case 3:
+			tz = fields[i].String()
+		}
+	}
+	latitude, longitude, err := s.location(location)
+	if err != nil {
+		return err
+	}
+	timeZone := time.UTC
+	if tz != "" {
+		if timeZone, err = time.LoadLocation(tz); err != nil {
+			return grpc.Errorf(grpc.InvalidArgument, "invalid time zone %q", tz)
+		}
+	}
+	var date time.Time
+	if day != "" {
+		if date, err = time.ParseInLocation("2006-01-02", day, timeZone); err != nil {
+			return grpc.Errorf(grpc.InvalidArgument, "invalid date %q, expected YYYY-MM-DD", day)
+		}
+	} else {
+		now := s.Controller.Clock.Now().In(timeZone)
+		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, timeZone)
+	}
+	response := grpc.AppendTimestamp(nil, 1, solarMidnight(date, longitude))
+	if !math.IsNaN(hASunrise(date, latitude)) {
+		response = grpc.AppendTimestamp(response, 2, sunrise(date, latitude, longitude))
+	}
+	response = grpc.AppendTimestamp(response, 3, solarNoon(date, longitude))
+	if !math.IsNaN(hASunset(date, latitude)) {
+		response = grpc.AppendTimestamp(response, 4, sunset(date, latitude, longitude))
+	}
+	return send(response)
+}
+
+func lightingMessage(l Lighting) []byte {
+	m := grpc.AppendInt64(nil, 1, l.ColorTemp)
+	m = grpc.AppendInt64(m, 2, l.Brightness)
+	m = grpc.AppendDouble(m, 3, l.Chromaticity.X)
+	return grpc.AppendDouble(m, 4, l.Chromaticity.Y)
+}
+
+func (s *GRPCService) lighting(ctx context.Context, request []byte, send func([]byte) error) error {
+	fields, err := fields(request)
+	if err != nil {
+		return err
+	}
+	var zone string
+	var location, t *grpc.Field
+	for i := range fields {
+		switch fields[i].Number {
+		case 1:
+			zone = fields[i].String()
+		case 2:
+			location = &fields[i]
+		case 3:
+			t = &fields[i]
+		}
+	}
+	date, err := s.time(t)
+	if err != nil {
+		return err
+	}
+	if zone != "" {
+		lighting, ok := s.Controller.Lighting(zone, date)
+		if !ok {
+			return grpc.Errorf(grpc.NotFound, "%v %q", ErrUnknownZone, zone)
+		}
+		return send(lightingMessage(lighting))
+	}
+	latitude, longitude, err := s.location(location)
+	if err != nil {
+		return err
+	}
+	return send(lightingMessage(DefaultProfile.Lighting(date, latitude, longitude)))
+}
+
+func (s *GRPCService) watchSetpoints(ctx context.Context, request []byte, send func([]byte) error) error {
+	fields, err := fields(request)
+	if err != nil {
+		return err
+	}
+	var zones map[string]bool
+	for _, field := range fields {
+		if field.Number != 1 {
+			continue
+		}
+		zone := field.String()
+		if _, ok := s.Controller.Lighting(zone, s.Controller.Clock.Now()); !ok {
+			return grpc.Errorf(grpc.NotFound, "%v %q", ErrUnknownZone, zone)
+		}
+		if zones == nil {
+			zones = make(map[string]bool)
+		}
+		zones[zone] = true
+	}
+
+	sent := make(map[string]Lighting)
+	for {
+		s.mu.Lock()
+		s.init()
+		var changes []grpcSetpoint
+		for zone, setpoint := range s.setpoints {
+			last, ok := sent[zone]
+			if (zones == nil || zones[zone]) && (!ok || last.ColorTemp != setpoint.ColorTemp || last.Brightness != setpoint.Brightness) {
+				changes = append(changes, setpoint)
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		sort.Slice(changes, func(i, j int) bool {
+			return changes[i].Zone < changes[j].Zone
+		})
+		for _, setpoint := range changes {
+			m := grpc.AppendString(nil, 1, setpoint.Zone)
+			m = grpc.AppendMessage(m, 2, lightingMessage(setpoint.Lighting))
+			m = grpc.AppendDuration(m, 3, setpoint.Transition)
+			m = grpc.AppendTimestamp(m, 4, setpoint.time)
+			if err := send(m); err != nil {
+				return err
+			}
+			sent[setpoint.Zone] = setpoint.Lighting
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// init initializes the setpoints, with s.mu held.
+func (s *GRPCService) init() {
+	if s.changed == nil {
+		s.setpoints = make(map[string]grpcSetpoint)
+		s.changed = make(chan struct{})
+	}
+}
+
+// Run records the setpoints it receives for WatchSetpoints until the context
+// is done.
+func (s *GRPCService) Run(ctx context.Context, setpoints <-chan Setpoint) error {
+	for {
+		select {
+		case setpoint := <-setpoints:
+			s.mu.Lock()
+			s.init()
+			s.setpoints[setpoint.Zone] = grpcSetpoint{Setpoint: setpoint, time: s.Controller.Clock.Now()}
+			close(s.changed)
+			s.changed = make(chan struct{})
+			s.mu.Unlock()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Package grpc is a minimal gRPC server and client over the HTTP/2 support of
+// net/http, with the protobuf wire format and without compression. Messages
+// are encoded and decoded by hand with the Append functions and Fields.
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Code is a gRPC status code.
+type Code int
+
+const (
+	OK               Code = 0
+	Canceled         Code = 1
+	Unknown          Code = 2
+	InvalidArgument  Code = 3
+	DeadlineExceeded Code = 4
+	NotFound         Code = 5
+	Unimplemented    Code = 12
+	Internal         Code = 13
+	Unavailable      Code = 14
+)
+
+// Status is an error with a gRPC status code.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc: code %d: %s", s.Code, s.Message)
+}
+
+// Errorf returns a status error.
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// maxMessageSize bounds the messages received, as gRPC does by default.
+const maxMessageSize = 4 << 20
+
+// ReadMessage reads a length-prefixed message.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, Errorf(Unimplemented, "compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxMessageSize {
+		return nil, Errorf(Internal, "message of %d bytes too large", n)
+	}
+	m := make([]byte, n)
+	if _, err := io.ReadFull(r, m); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return m, nil
+}
+
+// WriteMessage writes a length-prefixed message.
+func WriteMessage(w io.Writer, m []byte) error {
+	b := make([]byte, 5, 5+len(m))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(m)))
+	_, err := w.Write(append(b, m...))
+	return err
+}
+
+// encodeMessage percent-encodes a status message for the grpc-message trailer.
+func encodeMessage(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func decodeMessage(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// timeoutUnits are the units of the grpc-timeout header.
+var timeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseTimeout parses a grpc-timeout header: at most 8 digits and a unit.
+func parseTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+	unit, ok := timeoutUnits[s[len(s)-1]]
+	n, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// encodeTimeout encodes a timeout as a grpc-timeout header, rounded up to
+// the millisecond.
+func encodeTimeout(d time.Duration) string {
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	if ms < 1 {
+		ms = 1
+	}
+	if ms > 99999999 {
+		return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10) + "S"
+	}
+	return strconv.FormatInt(int64(ms), 10) + "m"
+}
+
+// Handler handles a call with its request message, sending its response with
+// send, once for unary methods and any number of times for server streaming
+// ones. Errors other than status errors are answered with Unknown.
+type Handler func(ctx context.Context, request []byte, send func(response []byte) error) error
+
+// Server serves the handlers of its methods, by full method name such as
+// "/circadian.v1.Circadian/GetLighting". It must be served over HTTP/2. The
+// response headers are sent once the request is read, so that clients of
+// streaming methods know the call started before the first message, and the
+// context of a handler expires after the grpc-timeout of its call.
+type Server map[string]Handler
+
+func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	err := s.serve(w, r)
+	status := &Status{Code: OK}
+	if err != nil && !errors.As(err, &status) {
+		status = &Status{Code: Unknown, Message: err.Error()}
+		if errors.Is(err, context.DeadlineExceeded) {
+			status.Code = DeadlineExceeded
+		} else if r.Context().Err() != nil {
+			status.Code = Canceled
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(status.Code)))
+	if status.Message != "" {
+		w.Header().Set("Grpc-Message", encodeMessage(status.Message))
+	}
+}
+
+func (s Server) serve(w http.ResponseWriter, r *http.Request) error {
+	handler, ok := s[r.URL.Path]
+	if !ok {
+		return Errorf(Unimplemented, "unknown method %s", r.URL.Path)
+	}
+	request, err := ReadMessage(r.Body)
+	if err != nil {
+		if _, ok := err.(*Status); ok {
+			return err
+		}
+		return Errorf(Internal, "request: %v", err)
+	}
+	ctx := r.Context()
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" {
+		d, err := parseTimeout(timeout)
+		if err != nil {
+			return Errorf(Internal, "%v", err)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+	}
+	return handler(ctx, request, func(response []byte) error {
+		if err := WriteMessage(w, response); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+}
+
+// Call calls a method of the server at target, such as "https://host:port",
+// with an HTTP/2 client. It calls receive with each response message, until
+// the end of the call or an error of receive, and returns the status of the
+// call as an error unless OK. The deadline of the context, if any, is sent as
+// the grpc-timeout of the call.
+func Call(ctx context.Context, client *http.Client, target string, method string, request []byte, receive func(response []byte) error) error {
+	var body bytes.Buffer
+	WriteMessage(&body, request)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(target, "/")+method, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("Grpc-Timeout", encodeTimeout(time.Until(deadline)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		return fmt.Errorf("grpc: %s %s", resp.Proto, resp.Status)
+	}
+	for {
+		m, err := ReadMessage(resp.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := receive(m); err != nil {
+			return err
+		}
+	}
+	// A response without messages has its status in its headers.
+	code := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	c, err := strconv.Atoi(code)
+	if err != nil {
+		return fmt.Errorf("grpc: invalid status %q", code)
+	}
+	if Code(c) != OK {
+		return &Status{Code: Code(c), Message: decodeMessage(message)}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWire(t *testing.T) {
+
+	// Examples of the protobuf encoding documentation
+	messages := make(map[string][]byte)
+	messages["08 96 01"] = AppendInt64(nil, 1, 150)
+	messages["12 07 74 65 73 74 69 6e 67"] = AppendString(nil, 2, "testing")
+	messages["1a 03 08 96 01"] = AppendMessage(nil, 3, AppendInt64(nil, 1, 150))
+	messages["08 ff ff ff ff ff ff ff ff ff 01"] = AppendInt64(nil, 1, -1)
+	messages["11 00 00 00 00 00 00 f8 3f"] = AppendDouble(nil, 2, 1.5)
+	messages[""] = AppendString(AppendInt64(nil, 1, 0), 2, "")
+
+	for k, v := range messages {
+		var expected []byte
+		for _, s := range bytes.Fields([]byte(k)) {
+			var b byte
+			for _, c := range s {
+				b = b<<4 | byte(bytes.IndexByte([]byte("0123456789abcdef"), c))
+			}
+			expected = append(expected, b)
+		}
+		if !bytes.Equal(v, expected) {
+			t.Errorf("encoding = % x, expected %s", v, k)
+		} else {
+			t.Logf("encoding = % x, expected %s", v, k)
+		}
+	}
+
+	date := time.Date(2021, 6, 21, 10, 0, 0, 500, time.UTC)
+	m := AppendTimestamp(AppendDouble(AppendInt64(nil, 1, -42), 2, 48.87), 3, date)
+	m = AppendDuration(AppendString(m, 4, "office"), 5, 1500*time.Millisecond)
+	fields, err := Fields(m)
+	if err != nil || len(fields) != 5 {
+		t.Fatalf("Fields(% x) = %+v, %v, expected 5 fields", m, fields, err)
+	}
+	got, _ := fields[2].Timestamp()
+	d, _ := fields[4].Duration()
+	if fields[0].Int64() != -42 || fields[1].Double() != 48.87 || !got.Equal(date) || fields[3].String() != "office" || d != 1500*time.Millisecond {
+		t.Errorf("Fields(% x) = %+v, expected -42, 48.87, %v, office and 1.5s", m, fields, date)
+	}
+	for _, b := range [][]byte{{0x08}, {0x12, 0x07, 0x74}, {0x0b}, {0x00, 0x01}} {
+		if _, err := Fields(b); err == nil {
+			t.Errorf("Fields(% x) = nil, expected an error", b)
+		}
+	}
+
+}
+
+func TestCall(t *testing.T) {
+
+	server := httptest.NewUnstartedServer(Server{
+		"/test.Echo/Echo": func(ctx context.Context, request []byte, send func([]byte) error) error {
+			return send(request)
+		},
+		"/test.Echo/Count": func(ctx context.Context, request []byte, send func([]byte) error) error {
+			fields, err := Fields(request)
+			if err != nil || len(fields) != 1 {
+				return Errorf(InvalidArgument, "missing count")
+			}
+			for i := int64(1); i <= fields[0].Int64(); i++ {
+				if err := send(AppendInt64(nil, 1, i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		"/test.Echo/Fail": func(ctx context.Context, request []byte, send func([]byte) error) error {
+			return Errorf(NotFound, "no such zone: garage 100%% ☀")
+		},
+		"/test.Echo/Wait": func(ctx context.Context, request []byte, send func([]byte) error) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		"/test.Echo/Deadline": func(ctx context.Context, request []byte, send func([]byte) error) error {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				return Errorf(InvalidArgument, "no deadline")
+			}
+			return send(AppendDuration(nil, 1, time.Until(deadline)))
+		},
+	})
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	request := AppendString(nil, 1, "hello")
+	var responses [][]byte
+	receive := func(m []byte) error {
+		responses = append(responses, m)
+		return nil
+	}
+	if err := Call(ctx, client, server.URL, "/test.Echo/Echo", request, receive); err != nil || len(responses) != 1 || !bytes.Equal(responses[0], request) {
+		t.Errorf("Call(Echo) = %v with % x, expected % x", err, responses, request)
+	}
+
+	responses = nil
+	if err := Call(ctx, client, server.URL, "/test.Echo/Count", AppendInt64(nil, 1, 3), receive); err != nil || len(responses) != 3 {
+		t.Errorf("Call(Count) = %v with % x, expected 3 messages", err, responses)
+	}
+
+	errs := map[string]*Status{
+		"/test.Echo/Fail":    {Code: NotFound, Message: "no such zone: garage 100% ☀"},
+		"/test.Echo/Count":   {Code: InvalidArgument, Message: "missing count"},
+		"/test.Echo/Missing": {Code: Unimplemented, Message: "unknown method /test.Echo/Missing"},
+	}
+	for method, expected := range errs {
+		err := Call(ctx, client, server.URL, method, nil, receive)
+		var status *Status
+		if !errors.As(err, &status) || *status != *expected {
+			t.Errorf("Call(%s) = %v, expected %v", method, err, expected)
+		}
+	}
+
+	// The deadline of the context is sent as the grpc-timeout of the call.
+	responses = nil
+	deadline, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	if err := Call(deadline, client, server.URL, "/test.Echo/Deadline", nil, receive); err != nil || len(responses) != 1 {
+		t.Fatalf("Call(Deadline) = %v with % x, expected 1 message", err, responses)
+	}
+	fields, _ := Fields(responses[0])
+	if d, _ := fields[0].Duration(); d <= 50*time.Second || d > time.Minute {
+		t.Errorf("Call(Deadline) = %v, expected about 1m", d)
+	}
+
+	// Headers are sent before the first message, and the context of the
+	// handler expires after the grpc-timeout of the call.
+	post := func(ctx context.Context, timeout string) (*http.Response, error) {
+		var body bytes.Buffer
+		WriteMessage(&body, nil)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/test.Echo/Wait", &body)
+		req.Header.Set("Content-Type", "application/grpc")
+		if timeout != "" {
+			req.Header.Set("Grpc-Timeout", timeout)
+		}
+		return client.Do(req)
+	}
+	waiting, stop := context.WithCancel(ctx)
+	headers := make(chan error, 1)
+	go func() {
+		resp, err := post(waiting, "")
+		if err == nil {
+			resp.Body.Close()
+		}
+		headers <- err
+	}()
+	select {
+	case err := <-headers:
+		if err != nil {
+			t.Errorf("Call(Wait) = %v, expected the headers", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Call(Wait) sent no headers in 5s")
+	}
+	stop()
+	timeouts := map[string]string{"20m": "4", "20000u": "4", "1x": "13", "123456789S": "13"}
+	for timeout, expected := range timeouts {
+		resp, err := post(ctx, timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if got := resp.Trailer.Get("Grpc-Status"); got != expected {
+			t.Errorf("Call(Wait) with grpc-timeout %s = status %s, expected %s", timeout, got, expected)
+		}
+	}
+
+}
+
+func TestTimeout(t *testing.T) {
+
+	timeouts := map[string]time.Duration{
+		"1H":        time.Hour,
+		"2M":        2 * time.Minute,
+		"3S":        3 * time.Second,
+		"40m":       40 * time.Millisecond,
+		"500u":      500 * time.Microsecond,
+		"99999999n": 99999999 * time.Nanosecond,
+	}
+	for k, v := range timeouts {
+		if got, err := parseTimeout(k); err != nil || got != v {
+			t.Errorf("parseTimeout(%s) = %v, %v, expected %v", k, got, err, v)
+		} else {
+			t.Logf("parseTimeout(%s) = %v, expected %v", k, got, v)
+		}
+	}
+	for _, s := range []string{"", "S", "5", "-1S", "1s", "123456789m"} {
+		if _, err := parseTimeout(s); err == nil {
+			t.Errorf("parseTimeout(%q) = nil, expected an error", s)
+		}
+	}
+
+	encodings := map[time.Duration]string{
+		1500 * time.Microsecond: "2m",
+		0:                       "1m",
+		time.Minute:             "60000m",
+		1000 * time.Hour:        "3600000S",
+	}
+	for k, v := range encodings {
+		if got := encodeTimeout(k); got != v {
+			t.Errorf("encodeTimeout(%v) = %s, expected %s", k, got, v)
+		}
+	}
+
+}
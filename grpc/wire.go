@@ -0,0 +1,205 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// Wire types of the protobuf encoding.
+const (
+	Varint  = 0
+	Fixed64 = 1
+	Bytes   = 2
+	Fixed32 = 5
+)
+
+var errMalformed = errors.New("grpc: malformed protobuf message")
+
+// AppendVarint appends a base 128 varint.
+func AppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return AppendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// AppendInt64 appends an int64 field, omitted when 0 as in proto3.
+func AppendInt64(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return AppendVarint(appendTag(b, field, Varint), uint64(v))
+}
+
+// AppendBool appends a bool field, omitted when false.
+func AppendBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return AppendVarint(appendTag(b, field, Varint), 1)
+}
+
+// AppendDouble appends a double field, omitted when 0.
+func AppendDouble(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	var fixed [8]byte
+	binary.LittleEndian.PutUint64(fixed[:], math.Float64bits(v))
+	return append(appendTag(b, field, Fixed64), fixed[:]...)
+}
+
+// AppendString appends a string field, omitted when empty.
+func AppendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return append(AppendVarint(appendTag(b, field, Bytes), uint64(len(s))), s...)
+}
+
+// AppendMessage appends an embedded message field, which is present even when
+// empty.
+func AppendMessage(b []byte, field int, m []byte) []byte {
+	return append(AppendVarint(appendTag(b, field, Bytes), uint64(len(m))), m...)
+}
+
+// AppendTimestamp appends a google.protobuf.Timestamp field, omitted when the
+// time is zero.
+func AppendTimestamp(b []byte, field int, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	m := AppendInt64(nil, 1, t.Unix())
+	m = AppendInt64(m, 2, int64(t.Nanosecond()))
+	return AppendMessage(b, field, m)
+}
+
+// AppendDuration appends a google.protobuf.Duration field, omitted when 0.
+func AppendDuration(b []byte, field int, d time.Duration) []byte {
+	if d == 0 {
+		return b
+	}
+	m := AppendInt64(nil, 1, int64(d/time.Second))
+	m = AppendInt64(m, 2, int64(d%time.Second))
+	return AppendMessage(b, field, m)
+}
+
+// Field is a decoded field. Varint holds the value of varint and fixed size
+// fields, and Bytes the value of length-delimited ones.
+type Field struct {
+	Number int
+	Type   int
+	Varint uint64
+	Bytes  []byte
+}
+
+func varint(b []byte) (uint64, []byte, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i] < 0x80 {
+			return v, b[i+1:], nil
+		}
+	}
+	return 0, nil, errMalformed
+}
+
+// Fields decodes the fields of a message, in order.
+func Fields(b []byte) ([]Field, error) {
+	var fields []Field
+	for len(b) > 0 {
+		tag, rest, err := varint(b)
+		if err != nil {
+			return nil, err
+		}
+		f := Field{Number: int(tag >> 3), Type: int(tag & 7)}
+		if f.Number == 0 {
+			return nil, errMalformed
+		}
+		switch f.Type {
+		case Varint:
+			if f.Varint, rest, err = varint(rest); err != nil {
+				return nil, err
+			}
+		case Fixed64:
+			if len(rest) < 8 {
+				return nil, errMalformed
+			}
+			f.Varint, rest = binary.LittleEndian.Uint64(rest), rest[8:]
+		case Fixed32:
+			if len(rest) < 4 {
+				return nil, errMalformed
+			}
+			f.Varint, rest = uint64(binary.LittleEndian.Uint32(rest)), rest[4:]
+		case Bytes:
+			n, r, err := varint(rest)
+			if err != nil || uint64(len(r)) < n {
+				return nil, errMalformed
+			}
+			f.Bytes, rest = r[:n], r[n:]
+		default:
+			return nil, errMalformed
+		}
+		fields = append(fields, f)
+		b = rest
+	}
+	return fields, nil
+}
+
+// Int64 returns the value of an int64 field.
+func (f Field) Int64() int64 {
+	return int64(f.Varint)
+}
+
+// Double returns the value of a double field.
+func (f Field) Double() float64 {
+	return math.Float64frombits(f.Varint)
+}
+
+// String returns the value of a string field.
+func (f Field) String() string {
+	return string(f.Bytes)
+}
+
+// Timestamp returns the value of a google.protobuf.Timestamp field, in UTC.
+func (f Field) Timestamp() (time.Time, error) {
+	fields, err := Fields(f.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var seconds, nanos int64
+	for _, field := range fields {
+		switch field.Number {
+		case 1:
+			seconds = field.Int64()
+		case 2:
+			nanos = field.Int64()
+		}
+	}
+	return time.Unix(seconds, nanos).UTC(), nil
+}
+
+// Duration returns the value of a google.protobuf.Duration field.
+func (f Field) Duration() (time.Duration, error) {
+	fields, err := Fields(f.Bytes)
+	if err != nil {
+		return 0, err
+	}
+	var d time.Duration
+	for _, field := range fields {
+		switch field.Number {
+		case 1:
+			d += time.Duration(field.Int64()) * time.Second
+		case 2:
+			d += time.Duration(field.Int64())
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/grpc"
+)
+
+func newTestGRPCService(t *testing.T, controller *Controller) (*GRPCService, func(ctx context.Context, method string, request []byte, receive func([]grpc.Field)) error) {
+	service := &GRPCService{Controller: controller}
+	server := httptest.NewUnstartedServer(service.Server())
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	call := func(ctx context.Context, method string, request []byte, receive func([]grpc.Field)) error {
+		return grpc.Call(ctx, server.Client(), server.URL, "/circadian.v1.Circadian/"+method, request, func(m []byte) error {
+			fields, err := grpc.Fields(m)
+			if err != nil {
+				return err
+			}
+			receive(fields)
+			return nil
+		})
+	}
+	return service, call
+}
+
+func location(latitude float64, longitude float64) []byte {
+	return grpc.AppendDouble(grpc.AppendDouble(nil, 1, latitude), 2, longitude)
+}
+
+func TestGRPCSunPosition(t *testing.T) {
+
+	// Tokyo UTC, away from the controller in Paris
+	controller := NewController(48.87, 2.67, time.Minute)
+	_, call := newTestGRPCService(t, controller)
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	var got []grpc.Field
+	request := grpc.AppendTimestamp(grpc.AppendMessage(nil, 1, location(35.68, 139.67)), 2, date)
+	if err := call(context.Background(), "GetSunPosition", request, func(f []grpc.Field) { got = f }); err != nil {
+		t.Fatalf("GetSunPosition() = %v", err)
+	}
+	elevation, azimuth := toDegrees(elevation(date, 35.68, 139.67)), toDegrees(azimuth(date, 35.68, 139.67))
+	if len(got) != 3 || got[1].Double() != elevation || got[2].Double() != azimuth {
+		t.Errorf("GetSunPosition() = %+v, expected %v and %v", got, elevation, azimuth)
+	}
+
+	invalid := [][]byte{
+		grpc.AppendMessage(nil, 1, location(91, 0)),
+		grpc.AppendMessage(nil, 1, location(0, 180.5)),
+		{0x0a, 0x10},
+	}
+	for _, request := range invalid {
+		err := call(context.Background(), "GetSunPosition", request, func([]grpc.Field) {})
+		var status *grpc.Status
+		if !errors.As(err, &status) || status.Code != grpc.InvalidArgument {
+			t.Errorf("GetSunPosition(% x) = %v, expected code %d", request, err, grpc.InvalidArgument)
+		}
+	}
+
+}
+
+func TestGRPCSolarEvents(t *testing.T) {
+
+	// Paris UTC, and Tromsø in the midnight sun
+	controller := NewController(48.87, 2.67, time.Minute)
+	_, call := newTestGRPCService(t, controller)
+	date := time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC)
+	var got []grpc.Field
+	if err := call(context.Background(), "GetSolarEvents", grpc.AppendString(nil, 2, "2021-06-21"), func(f []grpc.Field) { got = f }); err != nil || len(got) != 4 {
+		t.Fatalf("GetSolarEvents() = %+v, %v, expected 4 events", got, err)
+	}
+	expected := []time.Time{solarMidnight(date, 2.67), sunrise(date, 48.87, 2.67), solarNoon(date, 2.67), sunset(date, 48.87, 2.67)}
+	for i := range expected {
+		if event, _ := got[i].Timestamp(); !event.Equal(expected[i]) {
+			t.Errorf("GetSolarEvents()[%d] = %v, expected %v", i, event, expected[i])
+		}
+	}
+
+	request := grpc.AppendString(grpc.AppendMessage(nil, 1, location(69.65, 18.96)), 2, "2021-06-21")
+	if err := call(context.Background(), "GetSolarEvents", request, func(f []grpc.Field) { got = f }); err != nil || len(got) != 2 || got[0].Number != 1 || got[1].Number != 3 {
+		t.Errorf("GetSolarEvents() in Tromsø = %+v, %v, expected no sunrise nor sunset", got, err)
+	}
+
+}
+
+func TestGRPCLighting(t *testing.T) {
+
+	// Paris UTC
+	office := Profile{Name: "office", BrightnessCurve: Curve{{-6, 10}, {0, 80}}}
+	controller := NewController(48.87, 2.67, time.Minute, Zone{Name: "office", Profile: office})
+	_, call := newTestGRPCService(t, controller)
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+
+	requests := map[string]Lighting{
+		"office": office.Lighting(date, 48.87, 2.67),
+		"Tokyo":  DefaultProfile.Lighting(date, 35.68, 139.67),
+	}
+	for k, expected := range requests {
+		request := grpc.AppendTimestamp(grpc.AppendString(nil, 1, "office"), 3, date)
+		if k == "Tokyo" {
+			request = grpc.AppendTimestamp(grpc.AppendMessage(nil, 2, location(35.68, 139.67)), 3, date)
+		}
+		var got []grpc.Field
+		if err := call(context.Background(), "GetLighting", request, func(f []grpc.Field) { got = f }); err != nil || len(got) != 4 {
+			t.Fatalf("GetLighting(%s) = %+v, %v", k, got, err)
+		}
+		if got[0].Int64() != expected.ColorTemp || got[1].Int64() != expected.Brightness || got[2].Double() != expected.Chromaticity.X || got[3].Double() != expected.Chromaticity.Y {
+			t.Errorf("GetLighting(%s) = %+v, expected %+v", k, got, expected)
+		}
+	}
+
+	err := call(context.Background(), "GetLighting", grpc.AppendString(nil, 1, "garage"), func([]grpc.Field) {})
+	var status *grpc.Status
+	if !errors.As(err, &status) || status.Code != grpc.NotFound {
+		t.Errorf("GetLighting(garage) = %v, expected code %d", err, grpc.NotFound)
+	}
+
+}
+
+func TestGRPCWatchSetpoints(t *testing.T) {
+
+	controller := NewController(48.87, 2.67, time.Minute, Zone{Name: "office", Profile: DefaultProfile}, Zone{Name: "kitchen", Profile: DefaultProfile})
+	controller.Clock = NewFakeClock(time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC))
+	service, call := newTestGRPCService(t, controller)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setpoints := make(chan Setpoint)
+	go service.Run(ctx, setpoints)
+
+	first := Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 4000, Brightness: 80}, Transition: time.Second}
+	setpoints <- first
+	received := make(chan []grpc.Field)
+	done := make(chan error)
+	go func() {
+		done <- call(ctx, "WatchSetpoints", grpc.AppendString(nil, 1, "office"), func(f []grpc.Field) { received <- f })
+	}()
+
+	// Setpoints of other zones, and without changes of color temperature or
+	// brightness, are not sent.
+	changed := Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 4200, Brightness: 80}}
+	for i, expected := range []Setpoint{first, changed} {
+		var got []grpc.Field
+		select {
+		case got = <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("WatchSetpoints() sent %d setpoints, expected 2", i)
+		}
+		fields, _ := grpc.Fields(got[1].Bytes)
+		if got[0].String() != expected.Zone || fields[0].Int64() != expected.ColorTemp || fields[1].Int64() != expected.Brightness {
+			t.Errorf("WatchSetpoints() sent %+v, expected %+v", got, expected)
+		}
+		if i == 0 {
+			setpoints <- Setpoint{Zone: "kitchen", Lighting: Lighting{ColorTemp: 2700, Brightness: 40}}
+			setpoints <- Setpoint{Zone: "office", Lighting: first.Lighting, Transition: time.Minute}
+			setpoints <- changed
+		}
+	}
+
+	cancel()
+	var status *grpc.Status
+	if err := <-done; err == nil || errors.As(err, &status) {
+		t.Errorf("WatchSetpoints() canceled = %v, expected the context error", err)
+	}
+
+	err := call(context.Background(), "WatchSetpoints", grpc.AppendString(nil, 1, "garage"), func([]grpc.Field) {})
+	if !errors.As(err, &status) || status.Code != grpc.NotFound {
+		t.Errorf("WatchSetpoints(garage) = %v, expected code %d", err, grpc.NotFound)
+	}
+
+}
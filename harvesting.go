@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+// SensorReading is the illuminance in lux measured in a room, and its color
+// temperature in Kelvin when the sensor measures it (0 otherwise).
+type SensorReading struct {
+	Illuminance float64
+	ColorTemp   float64
+}
+
+// LightSensor measures the light in a room, daylight and artificial together.
+type LightSensor interface {
+	Read() (SensorReading, error)
+}
+
+// DaylightHarvester tops up the daylight of a room with artificial light to
+// reach a target illuminance, Target lux at 100% circadian brightness. The
+// artificial light level moves towards the level needed by a fraction Gain
+// (0.5 when 0) of the difference at each update, which converges without
+// oscillating for gains up to 1.
+type DaylightHarvester struct {
+	Sensor    LightSensor
+	Fixture   Fixture
+	Target    float64
+	Gain      float64
+	level     float64
+	colorTemp float64
+}
+
+// Artificial color temperature range used to correct the color of daylight.
+const (
+	minHarvestingColorTemp = 2000
+	maxHarvestingColorTemp = 6500
+)
+
+// Update reads the sensor and returns the artificial lighting that, added to
+// the daylight, follows the circadian lighting. When the sensor measures the
+// color temperature, the artificial one is chosen so that the mix, weighted in
+// mireds by illuminance, is the circadian one, the daylight color temperature
+// being estimated from the measured mix and the last artificial one. A fixture
+// without a positive area and light output is an error.
+func (h *DaylightHarvester) Update(circadian Lighting) (Lighting, error) {
+	if err := h.Fixture.validate(); err != nil {
+		return Lighting{}, err
+	}
+	maxArtificial := h.Fixture.illuminance(100)
+	reading, err := h.Sensor.Read()
+	if err != nil {
+		return Lighting{}, err
+	}
+	artificial := h.level * maxArtificial
+	daylight := math.Max(0, reading.Illuminance-artificial)
+	artificialMired := color.Mired(float64(circadian.ColorTemp))
+	if h.colorTemp > 0 {
+		artificialMired = color.Mired(h.colorTemp)
+	}
+	var daylightMired float64
+	if reading.ColorTemp > 0 && daylight > 0 {
+		daylightMired = (color.Mired(reading.ColorTemp)*(daylight+artificial) - artificialMired*artificial) / daylight
+	}
+	target := h.Target * float64(circadian.Brightness) / 100
+	needed := math.Max(0, math.Min(1, (target-daylight)/maxArtificial))
+	gain := h.Gain
+	if gain == 0 {
+		gain = 0.5
+	}
+	h.level += gain * (needed - h.level)
+
+	lighting := circadian
+	lighting.Brightness = int64(math.Round(h.level * 100))
+	artificial = h.level * maxArtificial
+	if daylightMired > 0 && artificial > 0 {
+		mired := (color.Mired(float64(circadian.ColorTemp))*(daylight+artificial) - daylightMired*daylight) / artificial
+		mired = math.Max(color.Mired(maxHarvestingColorTemp), math.Min(color.Mired(minHarvestingColorTemp), mired))
+		lighting.ColorTemp = int64(math.Round(color.Kelvin(mired)))
+		lighting.Chromaticity = color.CCTToXY(float64(lighting.ColorTemp), circadian.duv())
+	}
+	h.colorTemp = float64(lighting.ColorTemp)
+	return lighting, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+// room adds the daylight to the light of its fixture, mixing their color
+// temperatures in mireds.
+type room struct {
+	daylight          float64
+	daylightColorTemp float64
+	fixture           Fixture
+	lighting          Lighting
+	err               error
+}
+
+func (r *room) Read() (SensorReading, error) {
+	artificial := r.fixture.illuminance(r.lighting.Brightness)
+	illuminance := r.daylight + artificial
+	var colorTemp float64
+	if r.daylightColorTemp > 0 && illuminance > 0 {
+		colorTemp = color.Kelvin((color.Mired(r.daylightColorTemp)*r.daylight + color.Mired(float64(r.lighting.ColorTemp))*artificial) / illuminance)
+	}
+	return SensorReading{Illuminance: illuminance, ColorTemp: colorTemp}, r.err
+}
+
+func TestDaylightHarvester(t *testing.T) {
+
+	// 5000 lm over 10 m² gives 500 lux at full brightness
+	fixture := Fixture{Lumens: 5000, Area: 10}
+	circadian := Lighting{ColorTemp: 4000, Brightness: 100}
+	daylights := make(map[float64]int64)
+	daylights[0] = 100
+	daylights[200] = 60
+	daylights[500] = 0
+	daylights[2000] = 0
+
+	for k, v := range daylights {
+		r := &room{daylight: k, fixture: fixture}
+		harvester := DaylightHarvester{Sensor: r, Fixture: fixture, Target: 500}
+		previous := int64(0)
+		for i := 0; i < 20; i++ {
+			lighting, err := harvester.Update(circadian)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lighting.Brightness < previous || lighting.Brightness > v {
+				t.Errorf("harvester.Update() with %f lux of daylight = %d at step %d, expected monotonic towards %d", k, lighting.Brightness, i, v)
+			}
+			previous = lighting.Brightness
+			r.lighting = lighting
+		}
+		if r.lighting.Brightness != v {
+			t.Errorf("harvester.Update() with %f lux of daylight = %d, expected %d", k, r.lighting.Brightness, v)
+		} else {
+			t.Logf("harvester.Update() with %f lux of daylight = %d, expected %d", k, r.lighting.Brightness, v)
+		}
+	}
+
+}
+
+func TestDaylightHarvesterColorTemp(t *testing.T) {
+
+	// Bluish daylight is compensated by warmer artificial light
+	fixture := Fixture{Lumens: 5000, Area: 10}
+	circadian := Lighting{ColorTemp: 4000, Brightness: 100, Chromaticity: color.CCTToXY(4000, 0)}
+	r := &room{daylight: 200, daylightColorTemp: 6500, fixture: fixture}
+	harvester := DaylightHarvester{Sensor: r, Fixture: fixture, Target: 500, Gain: 1}
+	for i := 0; i < 10; i++ {
+		lighting, err := harvester.Update(circadian)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.lighting = lighting
+	}
+	reading, _ := r.Read()
+	if math.Abs(reading.ColorTemp-4000) > 20 || r.lighting.ColorTemp >= 4000 {
+		t.Errorf("harvester.Update() mixes to %f K with %d K artificial light, expected 4000 K", reading.ColorTemp, r.lighting.ColorTemp)
+	} else {
+		t.Logf("harvester.Update() mixes to %f K with %d K artificial light, expected 4000 K", reading.ColorTemp, r.lighting.ColorTemp)
+	}
+	if cct, _ := color.XYToCCT(r.lighting.Chromaticity); math.Abs(cct-float64(r.lighting.ColorTemp)) > 5 {
+		t.Errorf("harvester.Update() chromaticity has CCT %f, expected %d", cct, r.lighting.ColorTemp)
+	}
+
+	r.err = errors.New("sensor unreachable")
+	if _, err := harvester.Update(circadian); err == nil {
+		t.Errorf("harvester.Update() with a failing sensor returned no error")
+	}
+
+	for _, f := range []Fixture{{}, {Area: 10}} {
+		harvester := DaylightHarvester{Sensor: &room{daylight: 200}, Fixture: f, Target: 500}
+		if lighting, err := harvester.Update(circadian); err == nil {
+			t.Errorf("harvester.Update() with fixture %+v = %v, expected an error", f, lighting)
+		}
+	}
+
+}
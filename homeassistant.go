@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/mqtt"
+)
+
+// HomeAssistant publishes the zones of a controller to Home Assistant with MQTT
+// discovery. Each zone appears as a device with sensors for its color
+// temperature and brightness, the sun elevation and azimuth and the next solar
+// event, and a switch enabling or disabling the zone. Topics start with NodeID,
+// "circadian" when empty, and discovery topics with DiscoveryPrefix,
+// "homeassistant" when empty. The entities are available while NodeID/status
+// is "online", which the will of the client should set to "offline". Zone names
+// must differ by more than case and punctuation, which their identifiers drop.
+type HomeAssistant struct {
+	Client          *mqtt.Client
+	Controller      *Controller
+	DiscoveryPrefix string
+	NodeID          string
+	QoS             byte
+}
+
+// HomeAssistantState is the state of a zone, which the entities of the zone
+// read their values from.
+type HomeAssistantState struct {
+	ColorTemp  int64     `json:"colorTemp"`
+	Brightness int64     `json:"brightness"`
+	Elevation  float64   `json:"elevation"`
+	Azimuth    float64   `json:"azimuth"`
+	NextEvent  time.Time `json:"nextEvent"`
+	Enabled    bool      `json:"enabled"`
+}
+
+type haDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	Model       string   `json:"model"`
+}
+
+type haConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	CommandTopic      string   `json:"command_topic,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	Device            haDevice `json:"device"`
+}
+
+// Sensors of each zone, keyed by the field of the state they read.
+var haSensors = []struct {
+	key         string
+	name        string
+	unit        string
+	deviceClass string
+	icon        string
+}{
+	{"colorTemp", "Color temperature", "K", "", "mdi:temperature-kelvin"},
+	{"brightness", "Brightness", "%", "", "mdi:brightness-percent"},
+	{"elevation", "Sun elevation", "°", "", "mdi:weather-sunset-up"},
+	{"azimuth", "Sun azimuth", "°", "", "mdi:compass-outline"},
+	{"nextEvent", "Next solar event", "", "timestamp", "mdi:sun-clock"},
+}
+
+// slug returns an identifier made of lowercase letters, digits and
+// underscores, usable in topics and entity identifiers.
+func slug(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, s)
+}
+
+func (h *HomeAssistant) nodeID() string {
+	if h.NodeID == "" {
+		return "circadian"
+	}
+	return h.NodeID
+}
+
+func (h *HomeAssistant) discoveryPrefix() string {
+	if h.DiscoveryPrefix == "" {
+		return "homeassistant"
+	}
+	return h.DiscoveryPrefix
+}
+
+func (h *HomeAssistant) statusTopic() string {
+	return h.nodeID() + "/status"
+}
+
+func (h *HomeAssistant) stateTopic(zone string) string {
+	return h.nodeID() + "/" + slug(zone) + "/state"
+}
+
+func (h *HomeAssistant) commandTopic(zone string) string {
+	return h.nodeID() + "/" + slug(zone) + "/enabled/set"
+}
+
+func (h *HomeAssistant) configs(zone string) map[string]haConfig {
+	id := h.nodeID() + "_" + slug(zone)
+	device := haDevice{Identifiers: []string{id}, Name: zone, Model: "Circadian lighting zone"}
+	configs := make(map[string]haConfig)
+	for _, sensor := range haSensors {
+		config := haConfig{
+			Name:              sensor.name,
+			UniqueID:          id + "_" + slug(sensor.key),
+			StateTopic:        h.stateTopic(zone),
+			ValueTemplate:     "{{ value_json." + sensor.key + " }}",
+			UnitOfMeasurement: sensor.unit,
+			DeviceClass:       sensor.deviceClass,
+			Icon:              sensor.icon,
+			AvailabilityTopic: h.statusTopic(),
+			Device:            device,
+		}
+		if sensor.deviceClass == "" {
+			config.StateClass = "measurement"
+		}
+		configs[h.discoveryPrefix()+"/sensor/"+h.nodeID()+"/"+config.UniqueID+"/config"] = config
+	}
+	enabled := haConfig{
+		Name:              "Circadian lighting",
+		UniqueID:          id + "_enabled",
+		StateTopic:        h.stateTopic(zone),
+		ValueTemplate:     "{{ 'ON' if value_json.enabled else 'OFF' }}",
+		CommandTopic:      h.commandTopic(zone),
+		Icon:              "mdi:theme-light-dark",
+		AvailabilityTopic: h.statusTopic(),
+		Device:            device,
+	}
+	configs[h.discoveryPrefix()+"/switch/"+h.nodeID()+"/"+enabled.UniqueID+"/config"] = enabled
+	return configs
+}
+
+// zones returns the names of the zones of the controller by slug, and an error
+// if two zones have the same slug, and so the same entities.
+func (h *HomeAssistant) zones() (map[string]string, error) {
+	zones := make(map[string]string)
+	for _, zone := range h.Controller.ZoneNames() {
+		id := slug(zone)
+		if other, ok := zones[id]; ok {
+			return nil, fmt.Errorf("zones %q and %q have the same identifier %q", other, zone, id)
+		}
+		zones[id] = zone
+	}
+	return zones, nil
+}
+
+// Discover publishes the retained discovery configuration of the zones, and
+// marks them available.
+func (h *HomeAssistant) Discover() error {
+	zones, err := h.zones()
+	if err != nil {
+		return err
+	}
+	for _, zone := range zones {
+		for topic, config := range h.configs(zone) {
+			payload, err := json.Marshal(config)
+			if err != nil {
+				return err
+			}
+			if err := h.Client.Publish(topic, payload, h.QoS, true); err != nil {
+				return err
+			}
+		}
+	}
+	return h.Client.Publish(h.statusTopic(), []byte("online"), h.QoS, true)
+}
+
+// State returns the state of a zone with the given lighting at the given date.
+func (h *HomeAssistant) State(zone string, lighting Lighting, date time.Time) HomeAssistantState {
+	latitude, longitude := h.Controller.Location()
+	return HomeAssistantState{
+		ColorTemp:  lighting.ColorTemp,
+		Brightness: lighting.Brightness,
+		Elevation:  math.Round(10*toDegrees(elevation(date, latitude, longitude))) / 10,
+		Azimuth:    math.Round(10*toDegrees(azimuth(date, latitude, longitude))) / 10,
+		NextEvent:  nextSolarEvent(date, latitude, longitude),
+		Enabled:    h.Controller.Enabled(zone),
+	}
+}
+
+// Publish publishes the retained state of a zone with the given lighting at
+// the given date.
+func (h *HomeAssistant) Publish(zone string, lighting Lighting, date time.Time) error {
+	payload, err := json.Marshal(h.State(zone, lighting, date))
+	if err != nil {
+		return err
+	}
+	return h.Client.Publish(h.stateTopic(zone), payload, h.QoS, true)
+}
+
+// Subscribe enables and disables the zones from their switch from then on.
+// Commands that cannot be applied are passed to report, when not nil.
+func (h *HomeAssistant) Subscribe(report func(error)) error {
+	zones, err := h.zones()
+	if err != nil {
+		return err
+	}
+	commands := make(map[string]string)
+	for _, zone := range zones {
+		commands[h.commandTopic(zone)] = zone
+	}
+	return h.Client.Subscribe(h.nodeID()+"/+/enabled/set", h.QoS, func(m mqtt.Message) {
+		err := h.command(commands[m.Topic], string(m.Payload))
+		if err != nil && report != nil {
+			report(fmt.Errorf("command on %s: %w", m.Topic, err))
+		}
+	})
+}
+
+func (h *HomeAssistant) command(zone string, payload string) error {
+	if payload != "ON" && payload != "OFF" {
+		return fmt.Errorf("invalid payload %q", payload)
+	}
+	if !h.Controller.SetEnabled(zone, payload == "ON") {
+		return fmt.Errorf("%w %q", ErrUnknownZone, zone)
+	}
+	// No setpoint is emitted for a disabled zone, so its state is published
+	// right away.
+	date := h.Controller.Clock.Now()
+	lighting, _ := h.Controller.Lighting(zone, date)
+	return h.Publish(zone, lighting, date)
+}
+
+// publishDisabled publishes the state of the disabled zones, which have no
+// setpoints.
+func (h *HomeAssistant) publishDisabled(date time.Time) error {
+	for _, zone := range h.Controller.ZoneNames() {
+		if h.Controller.Enabled(zone) {
+			continue
+		}
+		lighting, _ := h.Controller.Lighting(zone, date)
+		if err := h.Publish(zone, lighting, date); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run publishes the state of the zones with the setpoints received on the
+// channel, and that of the disabled zones when the controller would emit their
+// setpoints, until the channel is closed, the context is done or the connection
+// is closed. States are dropped while the client reconnects.
+func (h *HomeAssistant) Run(ctx context.Context, setpoints <-chan Setpoint) error {
+	now := h.Controller.Clock.Now()
+	timer := h.Controller.Clock.NewTimer(h.Controller.next(now).Sub(now))
+	defer func() { timer.Stop() }()
+	for {
+		var err error
+		select {
+		case setpoint, ok := <-setpoints:
+			if !ok {
+				return nil
+			}
+			err = h.Publish(setpoint.Zone, setpoint.Lighting, h.Controller.Clock.Now())
+		case <-timer.C():
+			now := h.Controller.Clock.Now()
+			timer = h.Controller.Clock.NewTimer(h.Controller.next(now).Sub(now))
+			err = h.publishDisabled(now)
+		case <-h.Client.Done():
+			return h.Client.Err()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err != nil && !errors.Is(err, mqtt.ErrConnectionLost) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSlug(t *testing.T) {
+
+	slugs := make(map[string]string)
+	slugs["kitchen"] = "kitchen"
+	slugs["Living room"] = "living_room"
+	slugs["Étage 2"] = "_tage_2"
+
+	for k, v := range slugs {
+		if got := slug(k); got != v {
+			t.Errorf("slug(%s) = %s, expected %s", k, got, v)
+		}
+	}
+}
+
+func TestHomeAssistantDiscover(t *testing.T) {
+
+	broker, client, _ := newTestBroker(t)
+	controller := NewController(48.87, 2.67, time.Minute, Zone{Name: "Living room", Profile: DefaultProfile})
+	homeAssistant := &HomeAssistant{Client: client, Controller: controller, QoS: 1}
+	if err := homeAssistant.Discover(); err != nil {
+		t.Fatal(err)
+	}
+
+	topics := make(map[string]string)
+	topics["homeassistant/sensor/circadian/circadian_living_room_colortemp/config"] = "{{ value_json.colorTemp }}"
+	topics["homeassistant/sensor/circadian/circadian_living_room_brightness/config"] = "{{ value_json.brightness }}"
+	topics["homeassistant/sensor/circadian/circadian_living_room_elevation/config"] = "{{ value_json.elevation }}"
+	topics["homeassistant/sensor/circadian/circadian_living_room_azimuth/config"] = "{{ value_json.azimuth }}"
+	topics["homeassistant/sensor/circadian/circadian_living_room_nextevent/config"] = "{{ value_json.nextEvent }}"
+	topics["homeassistant/switch/circadian/circadian_living_room_enabled/config"] = "{{ 'ON' if value_json.enabled else 'OFF' }}"
+
+	for k, v := range topics {
+		m, ok := broker.Retained(k)
+		var config haConfig
+		if !ok || json.Unmarshal(m.Payload, &config) != nil {
+			t.Errorf("%s = %q, %v", k, m.Payload, ok)
+			continue
+		}
+		if config.ValueTemplate != v || config.StateTopic != "circadian/living_room/state" || config.AvailabilityTopic != "circadian/status" || config.Device.Name != "Living room" {
+			t.Errorf("%s = %+v", k, config)
+		}
+	}
+	if m, ok := broker.Retained("circadian/status"); !ok || string(m.Payload) != "online" {
+		t.Errorf("circadian/status = %q, %v", m.Payload, ok)
+	}
+
+	// Zones with the same identifier would share their entities
+	controller = NewController(48.87, 2.67, time.Minute, Zone{Name: "Living room", Profile: DefaultProfile}, Zone{Name: "living-room", Profile: DefaultProfile})
+	homeAssistant = &HomeAssistant{Client: client, Controller: controller, QoS: 1}
+	if err := homeAssistant.Discover(); err == nil {
+		t.Errorf("homeAssistant.Discover() with colliding zones returned no error")
+	}
+	if err := homeAssistant.Subscribe(nil); err == nil {
+		t.Errorf("homeAssistant.Subscribe() with colliding zones returned no error")
+	}
+}
+
+func TestHomeAssistantSwitch(t *testing.T) {
+
+	// Paris UTC
+	latitude := 48.87
+	longitude := 2.67
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	broker, client, remote := newTestBroker(t)
+	controller := NewController(latitude, longitude, time.Minute, Zone{Name: "kitchen", Profile: DefaultProfile})
+	controller.Clock = FixedClock{date}
+	homeAssistant := &HomeAssistant{Client: client, Controller: controller, QoS: 1}
+	failures := make(chan error, 1)
+	if err := homeAssistant.Subscribe(func(err error) { failures <- err }); err != nil {
+		t.Fatal(err)
+	}
+
+	lighting := DefaultProfile.Lighting(date, latitude, longitude)
+	expected := HomeAssistantState{
+		ColorTemp:  lighting.ColorTemp,
+		Brightness: lighting.Brightness,
+		Elevation:  56.5,
+		Azimuth:    129.2,
+		NextEvent:  nextSolarEvent(date, latitude, longitude),
+	}
+	if err := remote.Publish("circadian/kitchen/enabled/set", []byte("OFF"), 1, false); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for controller.Enabled("kitchen") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if setpoints := controller.Setpoints(date); len(setpoints) != 0 {
+		t.Errorf("controller.Setpoints(%v) = %+v for a disabled zone", date, setpoints)
+	}
+	var got HomeAssistantState
+	for time.Now().Before(deadline) {
+		m, _ := broker.Retained("circadian/kitchen/state")
+		if json.Unmarshal(m.Payload, &got) == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !got.NextEvent.Equal(expected.NextEvent) {
+		t.Errorf("next event = %v, expected %v", got.NextEvent, expected.NextEvent)
+	}
+	got.NextEvent = expected.NextEvent
+	if got != expected {
+		t.Errorf("circadian/kitchen/state = %+v, expected %+v", got, expected)
+	}
+
+	remote.Publish("circadian/kitchen/enabled/set", []byte("toggle"), 1, false)
+	select {
+	case err := <-failures:
+		t.Logf("invalid command: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("invalid command accepted")
+	}
+}
+
+func TestHomeAssistantRunDisabled(t *testing.T) {
+
+	// Paris UTC
+	latitude := 48.87
+	longitude := 2.67
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	broker, client, _ := newTestBroker(t)
+	clock := NewFakeClock(date)
+	controller := NewController(latitude, longitude, time.Minute, Zone{Name: "kitchen", Profile: DefaultProfile, Disabled: true})
+	controller.Clock = clock
+	homeAssistant := &HomeAssistant{Client: client, Controller: controller, QoS: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setpoints := make(chan Setpoint)
+	done := make(chan error, 1)
+	go func() { done <- homeAssistant.Run(ctx, setpoints) }()
+
+	// The sensors of a disabled zone keep following the sun
+	clock.WaitTimers(1)
+	clock.Step()
+	expected := homeAssistant.State("kitchen", DefaultProfile.Lighting(clock.Now(), latitude, longitude), clock.Now())
+	var got HomeAssistantState
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		m, _ := broker.Retained("circadian/kitchen/state")
+		if json.Unmarshal(m.Payload, &got) == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !got.NextEvent.Equal(expected.NextEvent) || got.Elevation != expected.Elevation || got.Enabled {
+		t.Errorf("circadian/kitchen/state = %+v, expected %+v", got, expected)
+	}
+
+	close(setpoints)
+	if err := <-done; err != nil {
+		t.Errorf("homeAssistant.Run() with a closed channel = %v, expected nil", err)
+	}
+}
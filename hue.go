@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+// Hue drives the lights of a Philips Hue bridge through the CLIP v2 API, at
+// Address with the application Key. The bridge serves HTTPS with its own
+// certificate, which Client must trust. Zones maps the zones to the names or
+// IDs of Hue lights, rooms and zones. Rooms and zones are set at once through
+// their grouped light.
+//
+// While Watch runs, changes of a light that were not sent by the driver, such
+// as from the Hue app or a switch, are recorded as manual settings of the
+// light in Overrides, when set, and the light is left alone while they hold.
+type Hue struct {
+	Address   string
+	Key       string
+	Client    *http.Client
+	Zones     map[string][]string
+	Overrides *OverrideManager
+	Clock     Clock
+
+	mu      sync.Mutex
+	lights  map[string]Light
+	members map[string][]string
+	sent    map[string]Lighting
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+type hueReference struct {
+	RID   string `json:"rid"`
+	RType string `json:"rtype"`
+}
+
+type hueMetadata struct {
+	Name string `json:"name"`
+}
+
+type hueOn struct {
+	On bool `json:"on"`
+}
+
+type hueDimming struct {
+	Brightness float64 `json:"brightness"`
+}
+
+type hueMirekSchema struct {
+	Minimum int64 `json:"mirek_minimum"`
+	Maximum int64 `json:"mirek_maximum"`
+}
+
+type hueColorTemperature struct {
+	Mirek       int64           `json:"mirek,omitempty"`
+	MirekSchema *hueMirekSchema `json:"mirek_schema,omitempty"`
+}
+
+type hueDynamics struct {
+	Duration int64 `json:"duration"`
+}
+
+// hueResource is a light or grouped light as read, updated, and reported by
+// events. Rooms and zones list their devices or lights in Children, and their
+// grouped light in Services.
+type hueResource struct {
+	ID               string               `json:"id,omitempty"`
+	Type             string               `json:"type,omitempty"`
+	Metadata         *hueMetadata         `json:"metadata,omitempty"`
+	Owner            *hueReference        `json:"owner,omitempty"`
+	Children         []hueReference       `json:"children,omitempty"`
+	Services         []hueReference       `json:"services,omitempty"`
+	On               *hueOn               `json:"on,omitempty"`
+	Dimming          *hueDimming          `json:"dimming,omitempty"`
+	ColorTemperature *hueColorTemperature `json:"color_temperature,omitempty"`
+	Color            json.RawMessage      `json:"color,omitempty"`
+	Dynamics         *hueDynamics         `json:"dynamics,omitempty"`
+}
+
+type hueResponse struct {
+	Errors []struct {
+		Description string `json:"description"`
+	} `json:"errors"`
+	Data json.RawMessage `json:"data"`
+}
+
+type hueEvent struct {
+	Type string        `json:"type"`
+	Data []hueResource `json:"data"`
+}
+
+func (h *Hue) client() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
+
+func (h *Hue) now() time.Time {
+	if h.Clock == nil {
+		return RealClock{}.Now()
+	}
+	return h.Clock.Now()
+}
+
+func (h *Hue) request(ctx context.Context, method string, path string, body interface{}, data interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+h.Address+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("hue-application-key", h.Key)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("hue: %w", err)
+	}
+	defer resp.Body.Close()
+	var response hueResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("hue: %s %s: %s", method, path, resp.Status)
+	}
+	if len(response.Errors) > 0 {
+		return fmt.Errorf("hue: %s %s: %s", method, path, response.Errors[0].Description)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hue: %s %s: %s", method, path, resp.Status)
+	}
+	if data == nil {
+		return nil
+	}
+	if err := json.Unmarshal(response.Data, data); err != nil {
+		return fmt.Errorf("hue: %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// Discover returns the dimmable lights, rooms and zones of the bridge. The IDs
+// of lights are "light/<id>", and those of rooms and zones the
+// "grouped_light/<id>" of their grouped light.
+func (h *Hue) Discover(ctx context.Context) ([]Light, error) {
+	var resources, rooms, zones []hueResource
+	if err := h.request(ctx, http.MethodGet, "/clip/v2/resource/light", nil, &resources); err != nil {
+		return nil, err
+	}
+	if err := h.request(ctx, http.MethodGet, "/clip/v2/resource/room", nil, &rooms); err != nil {
+		return nil, err
+	}
+	if err := h.request(ctx, http.MethodGet, "/clip/v2/resource/zone", nil, &zones); err != nil {
+		return nil, err
+	}
+
+	lights := make(map[string]Light)
+	devices := make(map[string][]string)
+	var discovered []Light
+	for _, resource := range resources {
+		if resource.Dimming == nil {
+			continue
+		}
+		light := Light{ID: "light/" + resource.ID}
+		if resource.Metadata != nil {
+			light.Name = resource.Metadata.Name
+		}
+		if t := resource.ColorTemperature; t != nil && t.MirekSchema != nil {
+			light.Capabilities.MinMired, light.Capabilities.MaxMired = t.MirekSchema.Minimum, t.MirekSchema.Maximum
+		}
+		lights[light.ID] = light
+		discovered = append(discovered, light)
+		if resource.Owner != nil {
+			devices[resource.Owner.RID] = append(devices[resource.Owner.RID], light.ID)
+		}
+	}
+
+	members := make(map[string][]string)
+	for _, group := range append(rooms, zones...) {
+		var ids []string
+		for _, child := range group.Children {
+			switch child.RType {
+			case "device":
+				ids = append(ids, devices[child.RID]...)
+			case "light":
+				if _, ok := lights["light/"+child.RID]; ok {
+					ids = append(ids, "light/"+child.RID)
+				}
+			}
+		}
+		for _, service := range group.Services {
+			if service.RType != "grouped_light" || len(ids) == 0 {
+				continue
+			}
+			var groupLights []Light
+			for _, id := range ids {
+				groupLights = append(groupLights, lights[id])
+			}
+			light := Light{ID: "grouped_light/" + service.RID, Capabilities: intersect(groupLights)}
+			if group.Metadata != nil {
+				light.Name = group.Metadata.Name
+			}
+			lights[light.ID] = light
+			members[light.ID] = ids
+			discovered = append(discovered, light)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lights, h.members = lights, members
+	return discovered, nil
+}
+
+// resolve returns a discovered light, room or zone from its ID or name.
+func (h *Hue) resolve(light string) (Light, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if l, ok := h.lights[light]; ok {
+		return l, true
+	}
+	for _, l := range h.lights {
+		if l.Name == light {
+			return l, true
+		}
+	}
+	return Light{}, false
+}
+
+// Capabilities returns what a discovered light, room or zone supports.
+func (h *Hue) Capabilities(light string) (Capabilities, bool) {
+	l, ok := h.resolve(light)
+	return l.Capabilities, ok
+}
+
+// held reports whether a light is manually set, and returns its lighting.
+func (h *Hue) held(light string, lighting Lighting, date time.Time) (Lighting, bool) {
+	if h.Overrides == nil {
+		return lighting, false
+	}
+	override, ok := h.Overrides.Override(light, date)
+	if !ok {
+		return lighting, false
+	}
+	if date.Before(override.Until) {
+		return lighting, true
+	}
+	return h.Overrides.Apply(light, lighting, date), false
+}
+
+func (h *Hue) set(ctx context.Context, light Light, lighting Lighting, transition time.Duration) error {
+	c := light.Capabilities
+	lighting, _ = c.Map(lighting)
+	update := hueResource{
+		Dimming:  &hueDimming{Brightness: float64(c.Level(lighting.Brightness))},
+		Dynamics: &hueDynamics{Duration: transition.Milliseconds()},
+	}
+	if c.MaxMired > 0 {
+		update.ColorTemperature = &hueColorTemperature{Mirek: int64(math.Round(color.Mired(float64(lighting.ColorTemp))))}
+	}
+	sent := Lighting{ColorTemp: lighting.ColorTemp, Brightness: int64(update.Dimming.Brightness)}
+	h.mu.Lock()
+	if h.sent == nil {
+		h.sent = make(map[string]Lighting)
+	}
+	ids := h.members[light.ID]
+	if ids == nil {
+		ids = []string{light.ID}
+	}
+	for _, id := range ids {
+		h.sent[id] = sent
+	}
+	h.mu.Unlock()
+	return h.request(ctx, http.MethodPut, "/clip/v2/resource/"+light.ID, update, nil)
+}
+
+// Apply sets the lights of the zone of the setpoint, with its transition.
+// Lights manually set are left alone, and rooms and zones containing some are
+// set light by light.
+func (h *Hue) Apply(ctx context.Context, setpoint Setpoint) error {
+	names, ok := h.Zones[setpoint.Zone]
+	if !ok {
+		return fmt.Errorf("hue: %w %q", ErrUnknownZone, setpoint.Zone)
+	}
+	date := h.now()
+	for _, name := range names {
+		light, ok := h.resolve(name)
+		if !ok {
+			return fmt.Errorf("hue: unknown light %q", name)
+		}
+		h.mu.Lock()
+		ids := h.members[light.ID]
+		h.mu.Unlock()
+		manual := false
+		for _, id := range ids {
+			if h.Overrides != nil {
+				if _, ok := h.Overrides.Override(id, date); ok {
+					manual = true
+				}
+			}
+		}
+		if ids == nil || manual {
+			if ids == nil {
+				ids = []string{light.ID}
+			}
+			for _, id := range ids {
+				lighting, held := h.held(id, setpoint.Lighting, date)
+				if held {
+					continue
+				}
+				l, _ := h.resolve(id)
+				if err := h.set(ctx, l, lighting, setpoint.Transition); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := h.set(ctx, light, setpoint.Lighting, setpoint.Transition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// State returns the current lighting of a light, room or zone.
+func (h *Hue) State(ctx context.Context, light string) (Lighting, error) {
+	l, ok := h.resolve(light)
+	if !ok {
+		return Lighting{}, fmt.Errorf("hue: unknown light %q", light)
+	}
+	var resources []hueResource
+	if err := h.request(ctx, http.MethodGet, "/clip/v2/resource/"+l.ID, nil, &resources); err != nil {
+		return Lighting{}, err
+	}
+	if len(resources) == 0 {
+		return Lighting{}, fmt.Errorf("hue: %s not found", l.ID)
+	}
+	var lighting Lighting
+	resource := resources[0]
+	if t := resource.ColorTemperature; t != nil && t.Mirek > 0 {
+		lighting.ColorTemp = int64(math.Round(color.Kelvin(float64(t.Mirek))))
+	}
+	if resource.Dimming != nil {
+		lighting.Brightness = int64(math.Round(resource.Dimming.Brightness))
+	}
+	if resource.On != nil && !resource.On.On {
+		lighting.Brightness = 0
+	}
+	return lighting, nil
+}
+
+// update records a change of a light reported by the bridge as a manual
+// setting when it differs from what the driver sent, lights the driver has not
+// set having nothing to differ from. The values the event leaves out are read
+// from the state of the light.
+func (h *Hue) update(ctx context.Context, resource hueResource) {
+	if resource.Type != "light" || (resource.On == nil && resource.Dimming == nil && resource.ColorTemperature == nil && resource.Color == nil) {
+		return
+	}
+	id := "light/" + resource.ID
+	h.mu.Lock()
+	sent, ok := h.sent[id]
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	var lighting Lighting
+	hasBrightness, hasColorTemp := false, false
+	manual := resource.Color != nil
+	if resource.Dimming != nil {
+		lighting.Brightness, hasBrightness = int64(math.Round(resource.Dimming.Brightness)), true
+	}
+	if resource.On != nil && !resource.On.On {
+		lighting.Brightness, hasBrightness = 0, true
+	}
+	if t := resource.ColorTemperature; t != nil && t.Mirek > 0 {
+		mired := int64(math.Round(color.Mired(float64(sent.ColorTemp))))
+		manual = manual || t.Mirek < mired-2 || t.Mirek > mired+2
+		lighting.ColorTemp, hasColorTemp = int64(math.Round(color.Kelvin(float64(t.Mirek)))), true
+	}
+	if hasBrightness {
+		manual = manual || lighting.Brightness < sent.Brightness-1 || lighting.Brightness > sent.Brightness+1
+	}
+	// A light turned on without a brightness is at the brightness it had.
+	if !manual && (hasBrightness || resource.On == nil) {
+		return
+	}
+	if !hasBrightness || !hasColorTemp {
+		state, err := h.State(ctx, id)
+		if err != nil {
+			state = sent
+		}
+		if !hasBrightness {
+			lighting.Brightness = state.Brightness
+			manual = manual || lighting.Brightness < sent.Brightness-1 || lighting.Brightness > sent.Brightness+1
+		}
+		if !hasColorTemp {
+			lighting.ColorTemp = state.ColorTemp
+			if lighting.ColorTemp == 0 {
+				lighting.ColorTemp = sent.ColorTemp
+			}
+		}
+	}
+	if manual && h.Overrides != nil {
+		h.Overrides.Set(id, lighting, h.now())
+	}
+}
+
+// Watch follows the event stream of the bridge until the context is done or
+// the stream is closed, recording manual changes of the lights.
+func (h *Hue) Watch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+h.Address+"/eventstream/clip/v2", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("hue-application-key", h.Key)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := h.client().Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("hue: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hue: event stream: %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+		var events []hueEvent
+		if err := json.Unmarshal([]byte(data.String()), &events); err == nil {
+			for _, event := range events {
+				if event.Type != "update" {
+					continue
+				}
+				for _, resource := range event.Data {
+					h.update(ctx, resource)
+				}
+			}
+		}
+		data.Reset()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("hue: event stream: %w", err)
+	}
+	return errors.New("hue: event stream closed")
+}
+
+// watch runs Watch again when the event stream fails or closes, after a delay
+// doubling from 1s to 1min, until the context is done.
+func (h *Hue) watch(ctx context.Context) {
+	defer close(h.stopped)
+	clock := h.Clock
+	if clock == nil {
+		clock = RealClock{}
+	}
+	delay := time.Second
+	for {
+		start := h.now()
+		h.Watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if h.now().Sub(start) > time.Minute {
+			delay = time.Second
+		}
+		timer := clock.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		if delay *= 2; delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+}
+
+// Close stops watching the bridge, when created by NewDriver with Overrides,
+// and closes the idle connections to the bridge.
+func (h *Hue) Close() error {
+	h.mu.Lock()
+	stop, stopped := h.stop, h.stopped
+	h.stop = nil
+	h.mu.Unlock()
+	if stop != nil {
+		stop()
+		<-stopped
+	}
+	h.client().CloseIdleConnections()
+	return nil
+}
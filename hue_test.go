@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHueBridge is a stand-in of a Hue bridge serving the parts of the CLIP v2
+// API the driver uses, reporting every change on its event stream.
+type fakeHueBridge struct {
+	key         string
+	certificate *x509.Certificate
+	mu          sync.Mutex
+	lights      map[string]*hueResource
+	rooms       []hueResource
+	zones       []hueResource
+	groups      map[string][]string
+	updates     []string
+	streams     []chan []hueResource
+	watching    chan struct{}
+}
+
+func newFakeHueBridge(t *testing.T) (*fakeHueBridge, *Hue) {
+	bridge := &fakeHueBridge{
+		key:      "key",
+		lights:   make(map[string]*hueResource),
+		groups:   make(map[string][]string),
+		watching: make(chan struct{}, 1),
+	}
+	ambiance := &hueMirekSchema{Minimum: 153, Maximum: 454}
+	bridge.addLight("ceiling", "Ceiling", "device-1", ambiance)
+	bridge.addLight("pendant", "Pendant", "device-2", &hueMirekSchema{Minimum: 200, Maximum: 500})
+	bridge.addLight("lamp", "Lamp", "device-3", ambiance)
+	bridge.addLight("spot", "Spot", "device-4", nil)
+	bridge.lights["plug"] = &hueResource{ID: "plug", Type: "light", Metadata: &hueMetadata{Name: "Plug"}, On: &hueOn{On: true}}
+	bridge.rooms = []hueResource{{
+		ID: "room-1", Type: "room", Metadata: &hueMetadata{Name: "Kitchen"},
+		Children: []hueReference{{RID: "device-1", RType: "device"}, {RID: "device-2", RType: "device"}},
+		Services: []hueReference{{RID: "group-1", RType: "grouped_light"}},
+	}}
+	bridge.zones = []hueResource{{
+		ID: "zone-1", Type: "zone", Metadata: &hueMetadata{Name: "Reading"},
+		Children: []hueReference{{RID: "lamp", RType: "light"}, {RID: "spot", RType: "light"}},
+		Services: []hueReference{{RID: "group-2", RType: "grouped_light"}},
+	}}
+	bridge.groups["group-1"] = []string{"ceiling", "pendant"}
+	bridge.groups["group-2"] = []string{"lamp", "spot"}
+
+	server := httptest.NewTLSServer(bridge)
+	t.Cleanup(server.Close)
+	bridge.certificate = server.Certificate()
+	hue := &Hue{
+		Address: strings.TrimPrefix(server.URL, "https://"),
+		Key:     bridge.key,
+		Client:  server.Client(),
+	}
+	return bridge, hue
+}
+
+func (b *fakeHueBridge) addLight(id string, name string, device string, schema *hueMirekSchema) {
+	light := &hueResource{
+		ID: id, Type: "light", Metadata: &hueMetadata{Name: name},
+		Owner:   &hueReference{RID: device, RType: "device"},
+		On:      &hueOn{On: true},
+		Dimming: &hueDimming{Brightness: 100},
+	}
+	if schema != nil {
+		light.ColorTemperature = &hueColorTemperature{Mirek: 366, MirekSchema: schema}
+	}
+	b.lights[id] = light
+}
+
+func (b *fakeHueBridge) respond(w http.ResponseWriter, status int, data interface{}, errors ...string) {
+	response := map[string]interface{}{"data": data, "errors": []interface{}{}}
+	var descriptions []map[string]string
+	for _, e := range errors {
+		descriptions = append(descriptions, map[string]string{"description": e})
+	}
+	if descriptions != nil {
+		response["errors"] = descriptions
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// change applies an update to a light and reports it on the event streams.
+func (b *fakeHueBridge) change(id string, update hueResource) {
+	light := b.lights[id]
+	event := hueResource{ID: id, Type: "light"}
+	if update.On != nil {
+		light.On = &hueOn{On: update.On.On}
+		event.On = light.On
+	}
+	if update.Dimming != nil {
+		light.Dimming = &hueDimming{Brightness: update.Dimming.Brightness}
+		event.Dimming = light.Dimming
+	}
+	if update.ColorTemperature != nil && light.ColorTemperature != nil {
+		light.ColorTemperature.Mirek = update.ColorTemperature.Mirek
+		event.ColorTemperature = &hueColorTemperature{Mirek: update.ColorTemperature.Mirek}
+	}
+	for _, stream := range b.streams {
+		stream <- []hueResource{event}
+	}
+}
+
+// manual changes a light as the Hue app would.
+func (b *fakeHueBridge) manual(id string, update hueResource) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.change(id, update)
+}
+
+func (b *fakeHueBridge) sentUpdates() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	updates := b.updates
+	b.updates = nil
+	sort.Strings(updates)
+	return updates
+}
+
+func (b *fakeHueBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("hue-application-key") != b.key {
+		b.respond(w, http.StatusForbidden, []interface{}{}, "unauthorized user")
+		return
+	}
+	if r.URL.Path == "/eventstream/clip/v2" {
+		b.stream(w, r)
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/clip/v2/resource/"), "/")
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && len(path) == 1 && path[0] == "light":
+		var lights []*hueResource
+		for _, light := range b.lights {
+			lights = append(lights, light)
+		}
+		b.respond(w, http.StatusOK, lights)
+	case r.Method == http.MethodGet && len(path) == 1 && path[0] == "room":
+		b.respond(w, http.StatusOK, b.rooms)
+	case r.Method == http.MethodGet && len(path) == 1 && path[0] == "zone":
+		b.respond(w, http.StatusOK, b.zones)
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "light" && b.lights[path[1]] != nil:
+		b.respond(w, http.StatusOK, []*hueResource{b.lights[path[1]]})
+	case r.Method == http.MethodPut && len(path) == 2 && (path[0] == "light" && b.lights[path[1]] != nil || path[0] == "grouped_light" && b.groups[path[1]] != nil):
+		var update hueResource
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			b.respond(w, http.StatusBadRequest, []interface{}{}, err.Error())
+			return
+		}
+		ids := b.groups[path[1]]
+		if path[0] == "light" {
+			ids = []string{path[1]}
+		}
+		for _, id := range ids {
+			b.change(id, update)
+		}
+		description := fmt.Sprintf("%s/%s brightness %g", path[0], path[1], update.Dimming.Brightness)
+		if update.ColorTemperature != nil {
+			description += fmt.Sprintf(" mirek %d", update.ColorTemperature.Mirek)
+		}
+		b.updates = append(b.updates, description+fmt.Sprintf(" duration %d", update.Dynamics.Duration))
+		b.respond(w, http.StatusOK, []hueReference{{RID: path[1], RType: path[0]}})
+	default:
+		b.respond(w, http.StatusNotFound, []interface{}{}, "resource not found")
+	}
+}
+
+func (b *fakeHueBridge) stream(w http.ResponseWriter, r *http.Request) {
+	events := make(chan []hueResource, 64)
+	b.mu.Lock()
+	b.streams = append(b.streams, events)
+	b.mu.Unlock()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	b.watching <- struct{}{}
+	for id := 1; ; id++ {
+		select {
+		case data := <-events:
+			payload, _ := json.Marshal([]hueEvent{{Type: "update", Data: data}})
+			fmt.Fprintf(w, "id: %d:0\ndata: %s\n\n", id, payload)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func TestHueDiscover(t *testing.T) {
+
+	_, hue := newFakeHueBridge(t)
+	ctx := context.Background()
+	lights, err := hue.Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]Light)
+	expected["Ceiling"] = Light{ID: "light/ceiling", Name: "Ceiling", Capabilities: Capabilities{MinMired: 153, MaxMired: 454}}
+	expected["Pendant"] = Light{ID: "light/pendant", Name: "Pendant", Capabilities: Capabilities{MinMired: 200, MaxMired: 500}}
+	expected["Lamp"] = Light{ID: "light/lamp", Name: "Lamp", Capabilities: Capabilities{MinMired: 153, MaxMired: 454}}
+	expected["Spot"] = Light{ID: "light/spot", Name: "Spot"}
+	expected["Kitchen"] = Light{ID: "grouped_light/group-1", Name: "Kitchen", Capabilities: Capabilities{MinMired: 200, MaxMired: 454}}
+	expected["Reading"] = Light{ID: "grouped_light/group-2", Name: "Reading", Capabilities: Capabilities{MinMired: 153, MaxMired: 454}}
+
+	if len(lights) != len(expected) {
+		t.Errorf("hue.Discover() = %+v, expected %d lights", lights, len(expected))
+	}
+	for _, light := range lights {
+		if light != expected[light.Name] {
+			t.Errorf("hue.Discover(): %+v, expected %+v", light, expected[light.Name])
+		}
+	}
+
+	hue.Key = "wrong"
+	if _, err := hue.Discover(ctx); err == nil || !strings.Contains(err.Error(), "unauthorized user") {
+		t.Errorf("hue.Discover() with a wrong key = %v", err)
+	}
+}
+
+func TestHueApply(t *testing.T) {
+
+	// Paris UTC
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(date)
+	bridge, hue := newFakeHueBridge(t)
+	hue.Zones = map[string][]string{"kitchen": {"Kitchen"}, "living room": {"light/lamp", "Spot"}}
+	hue.Overrides = &OverrideManager{Hold: time.Hour, Latitude: 48.87, Longitude: 2.67}
+	hue.Clock = clock
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := hue.Discover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	watched := make(chan error, 1)
+	go func() { watched <- hue.Watch(ctx) }()
+	<-bridge.watching
+
+	kitchen := Setpoint{Zone: "kitchen", Lighting: Lighting{ColorTemp: 6500, Brightness: 80}, Transition: 2 * time.Second}
+	living := Setpoint{Zone: "living room", Lighting: Lighting{ColorTemp: 2700, Brightness: 50}}
+	steps := []struct {
+		setpoint Setpoint
+		expected []string
+	}{
+		{kitchen, []string{"grouped_light/group-1 brightness 80 mirek 200 duration 2000"}},
+		{living, []string{"light/lamp brightness 50 mirek 370 duration 0", "light/spot brightness 50 duration 0"}},
+	}
+	for _, step := range steps {
+		if err := hue.Apply(ctx, step.setpoint); err != nil {
+			t.Fatal(err)
+		}
+		if got := bridge.sentUpdates(); fmt.Sprint(got) != fmt.Sprint(step.expected) {
+			t.Errorf("hue.Apply(%+v) = %v, expected %v", step.setpoint, got, step.expected)
+		}
+	}
+
+	// Changes sent by the driver are not manual.
+	time.Sleep(50 * time.Millisecond)
+	for _, id := range []string{"light/ceiling", "light/pendant", "light/lamp", "light/spot"} {
+		if _, ok := hue.Overrides.Override(id, date); ok {
+			t.Errorf("%s recorded as manually set", id)
+		}
+	}
+
+	bridge.manual("pendant", hueResource{Dimming: &hueDimming{Brightness: 20}})
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := hue.Overrides.Override("light/pendant", date); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if override, ok := hue.Overrides.Override("light/pendant", date); !ok || override.Lighting.Brightness != 20 || override.Lighting.ColorTemp != 5000 {
+		t.Fatalf("manual change of the pendant: %+v, %v", override, ok)
+	}
+	if err := hue.Apply(ctx, kitchen); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"light/ceiling brightness 80 mirek 154 duration 2000"}
+	if got := bridge.sentUpdates(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("hue.Apply(%+v) with the pendant manually set = %v, expected %v", kitchen, got, expected)
+	}
+
+	clock.Advance(time.Hour)
+	if err := hue.Apply(ctx, kitchen); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"grouped_light/group-1 brightness 80 mirek 200 duration 2000"}
+	if got := bridge.sentUpdates(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("hue.Apply(%+v) once the pendant is released = %v, expected %v", kitchen, got, expected)
+	}
+
+	if err := hue.Apply(ctx, Setpoint{Zone: "garage"}); err == nil {
+		t.Errorf("hue.Apply() succeeded on an unknown zone")
+	}
+	cancel()
+	if err := <-watched; err != context.Canceled {
+		t.Errorf("hue.Watch() = %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestHueUpdate(t *testing.T) {
+
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	bridge, hue := newFakeHueBridge(t)
+	hue.Zones = map[string][]string{"living room": {"light/lamp", "Spot"}}
+	hue.Overrides = &OverrideManager{Hold: time.Hour}
+	hue.Clock = FixedClock{date}
+	ctx := context.Background()
+	if _, err := hue.Discover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := hue.Apply(ctx, Setpoint{Zone: "living room", Lighting: Lighting{ColorTemp: 2700, Brightness: 50}}); err != nil {
+		t.Fatal(err)
+	}
+	bridge.sentUpdates()
+
+	steps := []struct {
+		resource hueResource
+		light    string
+		expected *Lighting
+	}{
+		// Lights the driver has not set are left alone
+		{hueResource{ID: "plug", Type: "light", On: &hueOn{On: false}}, "light/plug", nil},
+		// Events repeating what was sent are not manual
+		{hueResource{ID: "lamp", Type: "light", On: &hueOn{On: true}}, "light/lamp", nil},
+		{hueResource{ID: "lamp", Type: "light", Dimming: &hueDimming{Brightness: 50}}, "light/lamp", nil},
+		// Values left out are read from the state of the light
+		{hueResource{ID: "lamp", Type: "light", On: &hueOn{On: false}}, "light/lamp", &Lighting{ColorTemp: 2703, Brightness: 0}},
+		{hueResource{ID: "spot", Type: "light", Dimming: &hueDimming{Brightness: 10}}, "light/spot", &Lighting{ColorTemp: 2700, Brightness: 10}},
+	}
+	for _, step := range steps {
+		hue.update(ctx, step.resource)
+		override, ok := hue.Overrides.Override(step.light, date)
+		if step.expected == nil && ok {
+			t.Errorf("hue.update(%+v) recorded %+v as manual", step.resource, override.Lighting)
+		} else if step.expected != nil && (!ok || override.Lighting != *step.expected) {
+			t.Errorf("hue.update(%+v) = %+v, %v, expected %+v", step.resource, override.Lighting, ok, *step.expected)
+		}
+	}
+}
+
+func TestHueState(t *testing.T) {
+
+	bridge, hue := newFakeHueBridge(t)
+	ctx := context.Background()
+	if _, err := hue.Discover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bridge.manual("ceiling", hueResource{Dimming: &hueDimming{Brightness: 42.5}, ColorTemperature: &hueColorTemperature{Mirek: 400}})
+	states := make(map[string]Lighting)
+	states["Ceiling"] = Lighting{ColorTemp: 2500, Brightness: 43}
+	states["light/spot"] = Lighting{Brightness: 100}
+	for k, v := range states {
+		if got, err := hue.State(ctx, k); err != nil || got != v {
+			t.Errorf("hue.State(%s) = %+v, %v, expected %+v", k, got, err, v)
+		}
+	}
+	if _, err := hue.State(ctx, "Garage"); err == nil {
+		t.Errorf("hue.State(Garage) succeeded")
+	}
+}
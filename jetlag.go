@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+)
+
+// Observer is a place on Earth with its time zone.
+type Observer struct {
+	Latitude  float64
+	Longitude float64
+	Location  *time.Location
+}
+
+// Window is a period of time.
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// PlanDay is a day of a jet lag plan. The lights of the place the traveller is
+// at follow the circadian curve shifted by Shift, like a TimeShift Offset, so
+// that their sunrise and sunset are at Sunrise and Sunset. SeekLight and
+// AvoidLight are the periods of the day to seek and to avoid bright light.
+// Shift is exported to JSON as a duration string such as "-1h30m0s".
+type PlanDay struct {
+	Date       time.Time     `json:"date"`
+	Location   string        `json:"location"`
+	Latitude   float64       `json:"latitude"`
+	Longitude  float64       `json:"longitude"`
+	Shift      time.Duration `json:"-"`
+	Sunrise    time.Time     `json:"sunrise"`
+	Sunset     time.Time     `json:"sunset"`
+	SeekLight  []Window      `json:"seekLight"`
+	AvoidLight []Window      `json:"avoidLight"`
+}
+
+// Plan is a day by day jet lag adaptation plan.
+type Plan struct {
+	Days []PlanDay `json:"days"`
+}
+
+// Body clock shifts a traveller adapts to per day.
+const (
+	advancePerDay = time.Hour
+	delayPerDay   = 90 * time.Minute
+)
+
+// planDayJSON is a PlanDay without its methods, for encoding/json.
+type planDayJSON PlanDay
+
+func (d PlanDay) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		planDayJSON
+		Shift string `json:"shift"`
+	}{planDayJSON(d), d.Shift.String()})
+}
+
+func (d *PlanDay) UnmarshalJSON(b []byte) error {
+	var day struct {
+		planDayJSON
+		Shift string `json:"shift"`
+	}
+	if err := json.Unmarshal(b, &day); err != nil {
+		return err
+	}
+	shift, err := parseDuration(day.Shift)
+	if err != nil {
+		return err
+	}
+	*d = PlanDay(day.planDayJSON)
+	d.Shift = shift
+	return nil
+}
+
+func (d PlanDay) TimeShift() TimeShift {
+	return TimeShift{Offset: d.Shift}
+}
+
+// solarTimeDifference returns how far ahead the solar time of the destination
+// is from the home one, between -16h and 8h since delaying the body clock is
+// easier than advancing it.
+func solarTimeDifference(home Observer, destination Observer) time.Duration {
+	difference := math.Mod(destination.Longitude-home.Longitude+360, 360) / 15
+	if difference > 8 {
+		difference -= 24
+	}
+	return time.Duration(difference * float64(time.Hour))
+}
+
+// JetLagPlan returns a plan gradually shifting the lighting from the home solar
+// schedule to the destination one, starting preDays days before departure and
+// ending once the body clock is adapted to the destination. The traveller is
+// at home up to the day before arrival. Both observers need a time zone.
+func JetLagPlan(home Observer, destination Observer, departure time.Time, arrival time.Time, preDays int) (Plan, error) {
+	if home.Location == nil || destination.Location == nil {
+		return Plan{}, errors.New("observer without a time zone")
+	}
+	difference := solarTimeDifference(home, destination)
+	perDay := advancePerDay
+	if difference < 0 {
+		perDay = -delayPerDay
+	}
+	departure = departure.In(home.Location)
+	arrival = arrival.In(destination.Location)
+	arrivalDay := int(time.Date(arrival.Year(), arrival.Month(), arrival.Day(), 0, 0, 0, 0, time.UTC).Sub(time.Date(departure.Year(), departure.Month(), departure.Day(), 0, 0, 0, 0, time.UTC)).Hours() / 24)
+
+	var plan Plan
+	var adapted time.Duration
+	for i := -preDays; ; i++ {
+		adapted += perDay
+		if (difference >= 0 && adapted > difference) || (difference < 0 && adapted < difference) {
+			adapted = difference
+		}
+		observer, shift := home, -adapted
+		if i >= arrivalDay {
+			observer, shift = destination, difference-adapted
+		}
+		date := time.Date(departure.Year(), departure.Month(), departure.Day()+i, 0, 0, 0, 0, observer.Location)
+		plan.Days = append(plan.Days, planDay(observer, date, shift, difference))
+		if adapted == difference && observer == destination {
+			return plan, nil
+		}
+	}
+}
+
+func planDay(observer Observer, date time.Time, shift time.Duration, difference time.Duration) PlanDay {
+	noon := date.Add(12 * time.Hour)
+	day := PlanDay{
+		Date:      date,
+		Location:  observer.Location.String(),
+		Latitude:  observer.Latitude,
+		Longitude: observer.Longitude,
+		Shift:     shift,
+		Sunrise:   sunrise(noon, observer.Latitude, observer.Longitude).Add(shift),
+		Sunset:    sunset(noon, observer.Latitude, observer.Longitude).Add(shift),
+	}
+	if shift == 0 || math.IsNaN(hASunrise(noon, observer.Latitude)) {
+		return day
+	}
+	// The body clock is the most sensitive to light around the core body
+	// temperature minimum, about 2 hours before waking up: light after it
+	// advances the clock and light before it delays it.
+	minimum := day.Sunrise.Add(-2 * time.Hour)
+	before := Window{Start: minimum.Add(-3 * time.Hour), End: minimum}
+	after := Window{Start: minimum, End: minimum.Add(3 * time.Hour)}
+	if difference > 0 {
+		day.SeekLight, day.AvoidLight = []Window{after}, []Window{before}
+	} else {
+		day.SeekLight, day.AvoidLight = []Window{before}, []Window{after}
+	}
+	return day
+}
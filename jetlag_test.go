@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSolarTimeDifference(t *testing.T) {
+
+	paris := Observer{Latitude: 48.87, Longitude: 2.67}
+	destinations := make(map[Observer]time.Duration)
+	destinations[Observer{Latitude: 25.2, Longitude: 55.17}] = 3*time.Hour + 30*time.Minute
+	destinations[Observer{Latitude: 40.71, Longitude: -74.01}] = -(5*time.Hour + 6*time.Minute + 43*time.Second)
+	destinations[Observer{Latitude: 35.68, Longitude: 139.67}] = -(14*time.Hour + 52*time.Minute)
+
+	for k, v := range destinations {
+		got := solarTimeDifference(paris, k)
+		if (got - v).Round(time.Minute) != 0 {
+			t.Errorf("solarTimeDifference(%v) = %v, expected %v", k, got, v)
+		} else {
+			t.Logf("solarTimeDifference(%v) = %v, expected %v", k, got, v)
+		}
+	}
+
+}
+
+func TestJetLagPlan(t *testing.T) {
+
+	parisLocation, _ := time.LoadLocation("Europe/Paris")
+	newYorkLocation, _ := time.LoadLocation("America/New_York")
+	dubaiLocation, _ := time.LoadLocation("Asia/Dubai")
+	paris := Observer{Latitude: 48.87, Longitude: 2.67, Location: parisLocation}
+	newYork := Observer{Latitude: 40.71, Longitude: -74.01, Location: newYorkLocation}
+	dubai := Observer{Latitude: 25.2, Longitude: 55.17, Location: dubaiLocation}
+
+	trips := []struct {
+		home        Observer
+		destination Observer
+		days        int
+		perDay      time.Duration
+	}{
+		{paris, newYork, 4, delayPerDay},
+		{newYork, paris, 6, advancePerDay},
+		{paris, dubai, 4, advancePerDay},
+	}
+
+	for _, trip := range trips {
+		departure := time.Date(2021, 6, 21, 10, 0, 0, 0, trip.home.Location)
+		arrival := departure.Add(7 * time.Hour)
+		plan, err := JetLagPlan(trip.home, trip.destination, departure, arrival, 2)
+		if err != nil {
+			t.Fatalf("JetLagPlan(%s, %s) returned %v", trip.home.Location, trip.destination.Location, err)
+		}
+		if len(plan.Days) != trip.days {
+			t.Errorf("JetLagPlan(%s, %s) has %d days, expected %d", trip.home.Location, trip.destination.Location, len(plan.Days), trip.days)
+		}
+		for i, day := range plan.Days {
+			expected := trip.home.Location
+			if i >= 2 {
+				expected = trip.destination.Location
+			}
+			if day.Date.Location() != expected {
+				t.Errorf("JetLagPlan(%s, %s) day %d is at %s, expected %s", trip.home.Location, trip.destination.Location, i, day.Date.Location(), expected)
+			}
+			if i > 0 {
+				previous := plan.Days[i-1].Shift
+				if day.Location != plan.Days[i-1].Location {
+					previous += solarTimeDifference(trip.home, trip.destination)
+				}
+				if change := day.Shift - previous; change > trip.perDay || change < -trip.perDay {
+					t.Errorf("JetLagPlan(%s, %s) day %d shifts by %v, expected at most %v", trip.home.Location, trip.destination.Location, i, change, trip.perDay)
+				}
+			}
+			if day.Shift != 0 && (len(day.SeekLight) != 1 || len(day.AvoidLight) != 1) {
+				t.Errorf("JetLagPlan(%s, %s) day %d has no light windows", trip.home.Location, trip.destination.Location, i)
+			}
+			t.Logf("JetLagPlan(%s, %s) day %d: %+v", trip.home.Location, trip.destination.Location, i, day)
+		}
+		if last := plan.Days[len(plan.Days)-1]; last.Shift != 0 || last.SeekLight != nil {
+			t.Errorf("JetLagPlan(%s, %s) ends with shift %v, expected 0", trip.home.Location, trip.destination.Location, last.Shift)
+		}
+	}
+
+}
+
+func TestJetLagPlanWindows(t *testing.T) {
+
+	parisLocation, _ := time.LoadLocation("Europe/Paris")
+	dubaiLocation, _ := time.LoadLocation("Asia/Dubai")
+	paris := Observer{Latitude: 48.87, Longitude: 2.67, Location: parisLocation}
+	dubai := Observer{Latitude: 25.2, Longitude: 55.17, Location: dubaiLocation}
+	departure := time.Date(2021, 6, 21, 10, 0, 0, 0, parisLocation)
+
+	// Advancing the body clock needs morning light
+	plan, err := JetLagPlan(paris, dubai, departure, departure.Add(6*time.Hour), 1)
+	if err != nil {
+		t.Fatalf("JetLagPlan(paris, dubai) returned %v", err)
+	}
+	day := plan.Days[0]
+	if day.Shift != -time.Hour {
+		t.Errorf("first day shift = %v, expected -1h", day.Shift)
+	}
+	if expected := sunrise(day.Date.Add(12*time.Hour), paris.Latitude, paris.Longitude).Add(-time.Hour); !day.Sunrise.Equal(expected) {
+		t.Errorf("first day sunrise = %v, expected %v", day.Sunrise, expected)
+	}
+	if !day.SeekLight[0].Start.Equal(day.Sunrise.Add(-2*time.Hour)) || !day.AvoidLight[0].End.Equal(day.SeekLight[0].Start) {
+		t.Errorf("first day windows = seek %v, avoid %v, expected seek from %v", day.SeekLight, day.AvoidLight, day.Sunrise.Add(-2*time.Hour))
+	}
+	if day.TimeShift().Offset != day.Shift {
+		t.Errorf("first day time shift = %v, expected %v", day.TimeShift().Offset, day.Shift)
+	}
+
+	b, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatalf("json.Marshal(plan) returned %v", err)
+	}
+	if !strings.Contains(string(b), `"shift":"-1h0m0s"`) {
+		t.Errorf("json.Marshal(plan) = %s, expected a -1h0m0s shift", b)
+	}
+	plan = Plan{}
+	if err := json.Unmarshal(b, &plan); err != nil || len(plan.Days) != 4 || plan.Days[0].Location != "Europe/Paris" || plan.Days[0].Shift != -time.Hour {
+		t.Errorf("json.Unmarshal(%s) = %+v, %v", b, plan, err)
+	}
+
+	if _, err := JetLagPlan(Observer{Latitude: 48.87, Longitude: 2.67}, dubai, departure, departure.Add(6*time.Hour), 1); err == nil {
+		t.Errorf("JetLagPlan without a home time zone returned no error")
+	}
+
+}
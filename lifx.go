@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LIFX message types.
+const (
+	lifxGetService      = 2
+	lifxStateService    = 3
+	lifxAcknowledgement = 45
+	lifxGetColor        = 101
+	lifxSetColor        = 102
+	lifxLightState      = 107
+)
+
+const (
+	lifxHeaderSize = 36
+	lifxProtocol   = 1024
+	lifxPort       = 56700
+	// lifxServiceUDP is the service of bulbs in StateService messages.
+	lifxServiceUDP = 1
+)
+
+// lifxCapabilities are the color temperature range and brightness steps of
+// LIFX bulbs.
+var lifxCapabilities = Capabilities{MinColorTemp: 1500, MaxColorTemp: 9000, BrightnessSteps: 65535}
+
+// lifxPacket is a message of the LIFX LAN protocol. Target is the MAC address
+// of the bulb, zero to address all bulbs with tagged set.
+type lifxPacket struct {
+	tagged      bool
+	source      uint32
+	target      [8]byte
+	ackRequired bool
+	resRequired bool
+	sequence    uint8
+	kind        uint16
+	payload     []byte
+}
+
+func (p lifxPacket) encode() []byte {
+	b := make([]byte, lifxHeaderSize+len(p.payload))
+	binary.LittleEndian.PutUint16(b[0:], uint16(len(b)))
+	flags := uint16(lifxProtocol) | 1<<12
+	if p.tagged {
+		flags |= 1 << 13
+	}
+	binary.LittleEndian.PutUint16(b[2:], flags)
+	binary.LittleEndian.PutUint32(b[4:], p.source)
+	copy(b[8:16], p.target[:])
+	if p.resRequired {
+		b[22] |= 1
+	}
+	if p.ackRequired {
+		b[22] |= 2
+	}
+	b[23] = p.sequence
+	binary.LittleEndian.PutUint16(b[32:], p.kind)
+	copy(b[lifxHeaderSize:], p.payload)
+	return b
+}
+
+func decodeLIFX(b []byte) (lifxPacket, error) {
+	if len(b) < lifxHeaderSize || int(binary.LittleEndian.Uint16(b[0:])) != len(b) {
+		return lifxPacket{}, errors.New("lifx: malformed packet")
+	}
+	flags := binary.LittleEndian.Uint16(b[2:])
+	if flags&0xfff != lifxProtocol {
+		return lifxPacket{}, fmt.Errorf("lifx: unknown protocol %d", flags&0xfff)
+	}
+	p := lifxPacket{
+		tagged:      flags&(1<<13) != 0,
+		source:      binary.LittleEndian.Uint32(b[4:]),
+		resRequired: b[22]&1 != 0,
+		ackRequired: b[22]&2 != 0,
+		sequence:    b[23],
+		kind:        binary.LittleEndian.Uint16(b[32:]),
+		payload:     b[lifxHeaderSize:],
+	}
+	copy(p.target[:], b[8:16])
+	return p, nil
+}
+
+// lifxHSBK is a color as hue, saturation, brightness and Kelvin.
+type lifxHSBK struct {
+	hue        uint16
+	saturation uint16
+	brightness uint16
+	kelvin     uint16
+}
+
+func (c lifxHSBK) append(b []byte) []byte {
+	for _, v := range []uint16{c.hue, c.saturation, c.brightness, c.kelvin} {
+		b = append(b, byte(v), byte(v>>8))
+	}
+	return b
+}
+
+func decodeHSBK(b []byte) lifxHSBK {
+	return lifxHSBK{
+		hue:        binary.LittleEndian.Uint16(b[0:]),
+		saturation: binary.LittleEndian.Uint16(b[2:]),
+		brightness: binary.LittleEndian.Uint16(b[4:]),
+		kelvin:     binary.LittleEndian.Uint16(b[6:]),
+	}
+}
+
+// setColorPayload returns the payload of a SetColor message.
+func setColorPayload(color lifxHSBK, duration time.Duration) []byte {
+	b := color.append([]byte{0})
+	d := uint32(duration.Milliseconds())
+	return append(b, byte(d), byte(d>>8), byte(d>>16), byte(d>>24))
+}
+
+// lightState decodes the payload of a LightState message into its color, power
+// and label.
+func lightState(payload []byte) (lifxHSBK, bool, string, error) {
+	if len(payload) < 52 {
+		return lifxHSBK{}, false, "", errors.New("lifx: malformed light state")
+	}
+	label := strings.TrimRight(string(payload[12:44]), "\x00")
+	return decodeHSBK(payload), binary.LittleEndian.Uint16(payload[10:]) != 0, label, nil
+}
+
+// LIFX drives LIFX bulbs on the LAN with their UDP protocol. Discover sends
+// GetService to Addresses, the broadcast address 255.255.255.255:56700 when
+// empty, and Zones maps the zones to the MAC addresses of the bulbs they
+// contain. Commands are acknowledged by the bulbs, and sent again up to
+// Retries times (3 when 0) when no acknowledgement arrives within Timeout
+// (500ms when 0).
+type LIFX struct {
+	Addresses []string
+	Zones     map[string][]string
+	Timeout   time.Duration
+	Retries   int
+
+	mu       sync.Mutex
+	conn     *net.UDPConn
+	source   uint32
+	sequence uint8
+	bulbs    map[string]*net.UDPAddr
+	labels   map[string]string
+	pending  map[uint8]chan lifxResponse
+}
+
+type lifxResponse struct {
+	packet lifxPacket
+	addr   *net.UDPAddr
+}
+
+func (l *LIFX) timeout() time.Duration {
+	if l.Timeout == 0 {
+		return 500 * time.Millisecond
+	}
+	return l.Timeout
+}
+
+func (l *LIFX) retries() int {
+	if l.Retries == 0 {
+		return 3
+	}
+	return l.Retries
+}
+
+// listen opens the socket responses are received on, once.
+func (l *LIFX) listen() (*net.UDPConn, uint32, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		return l.conn, l.source, nil
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("lifx: %w", err)
+	}
+	l.conn = conn
+	l.source = 0
+	for l.source == 0 {
+		l.source = rand.Uint32()
+	}
+	l.pending = make(map[uint8]chan lifxResponse)
+	go l.read(conn, l.source)
+	return conn, l.source, nil
+}
+
+// read passes the responses to the messages sent from source to the channels
+// of their sequence number.
+func (l *LIFX) read(conn *net.UDPConn, source uint32) {
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		p, err := decodeLIFX(append([]byte(nil), buffer[:n]...))
+		if err != nil {
+			continue
+		}
+		l.mu.Lock()
+		ch, ok := l.pending[p.sequence]
+		l.mu.Unlock()
+		if ok && p.source == source {
+			select {
+			case ch <- lifxResponse{p, addr}:
+			default:
+			}
+		}
+	}
+}
+
+// register returns a new sequence number and the channel its responses are
+// received on.
+func (l *LIFX) register() (uint8, chan lifxResponse) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sequence++
+	ch := make(chan lifxResponse, 64)
+	l.pending[l.sequence] = ch
+	return l.sequence, ch
+}
+
+func (l *LIFX) unregister(sequence uint8) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pending, sequence)
+}
+
+// bulb returns the address and the MAC address of a discovered bulb.
+func (l *LIFX) bulb(id string) (*net.UDPAddr, [8]byte, error) {
+	var target [8]byte
+	mac, err := net.ParseMAC(id)
+	if err != nil || len(mac) != 6 {
+		return nil, target, fmt.Errorf("lifx: invalid bulb %q", id)
+	}
+	copy(target[:], mac)
+	l.mu.Lock()
+	addr, ok := l.bulbs[mac.String()]
+	l.mu.Unlock()
+	if !ok {
+		return nil, target, fmt.Errorf("lifx: unknown bulb %s", id)
+	}
+	return addr, target, nil
+}
+
+// send sends a message to a bulb until it responds with the expected type,
+// and returns the response.
+func (l *LIFX) send(ctx context.Context, id string, p lifxPacket, expected uint16) (lifxPacket, error) {
+	conn, source, err := l.listen()
+	if err != nil {
+		return lifxPacket{}, err
+	}
+	addr, target, err := l.bulb(id)
+	if err != nil {
+		return lifxPacket{}, err
+	}
+	sequence, ch := l.register()
+	defer l.unregister(sequence)
+	p.source, p.target, p.sequence = source, target, sequence
+	b := p.encode()
+	for attempt := 0; attempt <= l.retries(); attempt++ {
+		if _, err := conn.WriteToUDP(b, addr); err != nil {
+			return lifxPacket{}, fmt.Errorf("lifx: %s: %w", id, err)
+		}
+		timer := time.NewTimer(l.timeout())
+		for waiting := true; waiting; {
+			select {
+			case r := <-ch:
+				if r.packet.kind == expected {
+					timer.Stop()
+					return r.packet, nil
+				}
+			case <-timer.C:
+				waiting = false
+			case <-ctx.Done():
+				timer.Stop()
+				return lifxPacket{}, ctx.Err()
+			}
+		}
+	}
+	return lifxPacket{}, fmt.Errorf("lifx: %s: no response", id)
+}
+
+// Discover returns the bulbs answering GetService within the timeout, with
+// their label as name. Bulbs that then do not answer GetColor are skipped and
+// listed in the error returned with the others.
+func (l *LIFX) Discover(ctx context.Context) ([]Light, error) {
+	conn, source, err := l.listen()
+	if err != nil {
+		return nil, err
+	}
+	addresses := l.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{fmt.Sprintf("255.255.255.255:%d", lifxPort)}
+	}
+	sequence, ch := l.register()
+	defer l.unregister(sequence)
+	b := lifxPacket{tagged: true, source: source, sequence: sequence, kind: lifxGetService}.encode()
+	for _, address := range addresses {
+		addr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			return nil, fmt.Errorf("lifx: %w", err)
+		}
+		if _, err := conn.WriteToUDP(b, addr); err != nil {
+			return nil, fmt.Errorf("lifx: %w", err)
+		}
+	}
+
+	bulbs := make(map[string]*net.UDPAddr)
+	timer := time.NewTimer(l.timeout())
+	defer timer.Stop()
+	for waiting := true; waiting; {
+		select {
+		case r := <-ch:
+			p := r.packet
+			if p.kind != lifxStateService || len(p.payload) < 5 || p.payload[0] != lifxServiceUDP {
+				continue
+			}
+			port := binary.LittleEndian.Uint32(p.payload[1:])
+			mac := net.HardwareAddr(p.target[:6]).String()
+			bulbs[mac] = &net.UDPAddr{IP: r.addr.IP, Port: int(port)}
+		case <-timer.C:
+			waiting = false
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	l.mu.Lock()
+	l.bulbs = bulbs
+	l.mu.Unlock()
+
+	var lights []Light
+	var unreachable []string
+	for mac := range bulbs {
+		r, err := l.send(ctx, mac, lifxPacket{resRequired: true, kind: lifxGetColor}, lifxLightState)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var label string
+		if err == nil {
+			_, _, label, err = lightState(r.payload)
+		}
+		if err != nil {
+			unreachable = append(unreachable, mac)
+			continue
+		}
+		lights = append(lights, Light{ID: mac, Name: label, Capabilities: lifxCapabilities})
+	}
+	if len(unreachable) > 0 {
+		sort.Strings(unreachable)
+		return lights, fmt.Errorf("lifx: %s: no light state", strings.Join(unreachable, ", "))
+	}
+	return lights, nil
+}
+
+// Capabilities returns what a discovered bulb supports.
+func (l *LIFX) Capabilities(light string) (Capabilities, bool) {
+	if _, _, err := l.bulb(light); err != nil {
+		return Capabilities{}, false
+	}
+	return lifxCapabilities, true
+}
+
+// Apply sets the bulbs of the zone of the setpoint to its color temperature
+// and brightness, with its transition.
+func (l *LIFX) Apply(ctx context.Context, setpoint Setpoint) error {
+	ids, ok := l.Zones[setpoint.Zone]
+	if !ok {
+		return fmt.Errorf("lifx: %w %q", ErrUnknownZone, setpoint.Zone)
+	}
+	lighting, _ := lifxCapabilities.Map(setpoint.Lighting)
+	color := lifxHSBK{brightness: uint16(lifxCapabilities.Level(lighting.Brightness)), kelvin: uint16(lighting.ColorTemp)}
+	payload := setColorPayload(color, setpoint.Transition)
+	for _, id := range ids {
+		if _, err := l.send(ctx, id, lifxPacket{ackRequired: true, kind: lifxSetColor, payload: payload}, lifxAcknowledgement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// State returns the current lighting of a bulb.
+func (l *LIFX) State(ctx context.Context, light string) (Lighting, error) {
+	r, err := l.send(ctx, light, lifxPacket{resRequired: true, kind: lifxGetColor}, lifxLightState)
+	if err != nil {
+		return Lighting{}, err
+	}
+	color, power, _, err := lightState(r.payload)
+	if err != nil {
+		return Lighting{}, err
+	}
+	lighting := Lighting{ColorTemp: int64(color.kelvin)}
+	if power {
+		lighting.Brightness = int64(math.Round(float64(color.brightness) * 100 / 65535))
+	}
+	return lighting, nil
+}
+
+// Close closes the socket of the driver.
+func (l *LIFX) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLIFXBulb is a stand-in of a LIFX bulb answering on a UDP socket. It
+// ignores the first drop SetColor messages it receives, and GetColor while
+// mute.
+type fakeLIFXBulb struct {
+	conn  *net.UDPConn
+	mac   [8]byte
+	label string
+	mu    sync.Mutex
+	color lifxHSBK
+	power bool
+	drop  int
+	mute  bool
+	set   []string
+}
+
+func newFakeLIFXBulb(t *testing.T, mac string, label string) *fakeLIFXBulb {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	bulb := &fakeLIFXBulb{conn: conn, label: label, color: lifxHSBK{brightness: 65535, kelvin: 3500}, power: true}
+	hardware, _ := net.ParseMAC(mac)
+	copy(bulb.mac[:], hardware)
+	go bulb.serve()
+	return bulb
+}
+
+func (b *fakeLIFXBulb) address() string {
+	return b.conn.LocalAddr().String()
+}
+
+func (b *fakeLIFXBulb) serve() {
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := b.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		p, err := decodeLIFX(append([]byte(nil), buffer[:n]...))
+		if err != nil || (!p.tagged && p.target != b.mac) {
+			continue
+		}
+		reply := func(kind uint16, payload []byte) {
+			r := lifxPacket{source: p.source, target: b.mac, sequence: p.sequence, kind: kind, payload: payload}
+			b.conn.WriteToUDP(r.encode(), addr)
+		}
+		b.mu.Lock()
+		switch p.kind {
+		case lifxGetService:
+			port := uint32(b.conn.LocalAddr().(*net.UDPAddr).Port)
+			reply(lifxStateService, []byte{lifxServiceUDP, byte(port), byte(port >> 8), byte(port >> 16), byte(port >> 24)})
+		case lifxGetColor:
+			if b.mute {
+				break
+			}
+			payload := b.color.append(nil)
+			payload = append(payload, 0, 0, 0, 0)
+			if b.power {
+				binary.LittleEndian.PutUint16(payload[10:], 65535)
+			}
+			label := make([]byte, 32)
+			copy(label, b.label)
+			payload = append(append(payload, label...), make([]byte, 8)...)
+			reply(lifxLightState, payload)
+		case lifxSetColor:
+			if b.drop > 0 {
+				b.drop--
+				break
+			}
+			b.color = decodeHSBK(p.payload[1:])
+			duration := binary.LittleEndian.Uint32(p.payload[9:])
+			b.set = append(b.set, fmt.Sprintf("brightness %d kelvin %d duration %d", b.color.brightness, b.color.kelvin, duration))
+			if p.ackRequired {
+				reply(lifxAcknowledgement, nil)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *fakeLIFXBulb) dropping(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.drop = n
+}
+
+func (b *fakeLIFXBulb) sent() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	set := b.set
+	b.set = nil
+	return set
+}
+
+func TestLIFXPacket(t *testing.T) {
+
+	// Examples of the LIFX LAN protocol documentation
+	packets := []struct {
+		packet lifxPacket
+		bytes  []byte
+	}{
+		{
+			lifxPacket{tagged: true, kind: lifxGetService},
+			[]byte{0x24, 0x00, 0x00, 0x34, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00},
+		},
+		{
+			lifxPacket{tagged: true, kind: lifxSetColor, payload: setColorPayload(lifxHSBK{hue: 21845, saturation: 65535, brightness: 65535, kelvin: 3500}, 1024*time.Millisecond)},
+			[]byte{0x31, 0x00, 0x00, 0x34, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x66, 0x00, 0x00, 0x00, 0x00, 0x55, 0x55, 0xFF, 0xFF, 0xFF, 0xFF, 0xAC, 0x0D, 0x00, 0x04, 0x00, 0x00},
+		},
+		{
+			lifxPacket{source: 42, target: [8]byte{0xd0, 0x73, 0xd5, 1, 2, 3}, ackRequired: true, resRequired: true, sequence: 7, kind: lifxGetColor},
+			[]byte{0x24, 0x00, 0x00, 0x14, 0x2a, 0x00, 0x00, 0x00, 0xd0, 0x73, 0xd5, 0x01, 0x02, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x65, 0x00, 0x00, 0x00},
+		},
+	}
+
+	for _, p := range packets {
+		if got := p.packet.encode(); !bytes.Equal(got, p.bytes) {
+			t.Errorf("%+v.encode() = % x, expected % x", p.packet, got, p.bytes)
+		}
+		got, err := decodeLIFX(p.bytes)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(p.packet) {
+			t.Errorf("decodeLIFX(% x) = %+v, %v, expected %+v", p.bytes, got, err, p.packet)
+		}
+	}
+	if _, err := decodeLIFX(packets[0].bytes[:20]); err == nil {
+		t.Errorf("decodeLIFX() of a truncated packet succeeded")
+	}
+}
+
+func TestLIFX(t *testing.T) {
+
+	kitchen := newFakeLIFXBulb(t, "d0:73:d5:00:00:01", "Kitchen")
+	office := newFakeLIFXBulb(t, "d0:73:d5:00:00:02", "Office")
+	office.dropping(2)
+	lifx := &LIFX{
+		Addresses: []string{kitchen.address(), office.address()},
+		Zones:     map[string][]string{"kitchen": {"d0:73:d5:00:00:01"}, "office": {"d0:73:d5:00:00:02"}},
+		Timeout:   100 * time.Millisecond,
+	}
+	defer lifx.Close()
+	ctx := context.Background()
+
+	lights, err := lifx.Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]string)
+	for _, light := range lights {
+		names[light.ID] = light.Name
+	}
+	if len(lights) != 2 || names["d0:73:d5:00:00:01"] != "Kitchen" || names["d0:73:d5:00:00:02"] != "Office" {
+		t.Errorf("lifx.Discover() = %+v", lights)
+	}
+
+	setpoints := []struct {
+		setpoint Setpoint
+		bulb     *fakeLIFXBulb
+		expected string
+	}{
+		{Setpoint{Zone: "kitchen", Lighting: Lighting{ColorTemp: 2700, Brightness: 50}, Transition: 2 * time.Second}, kitchen, "brightness 32768 kelvin 2700 duration 2000"},
+		{Setpoint{Zone: "kitchen", Lighting: Lighting{ColorTemp: 1000, Brightness: 100}}, kitchen, "brightness 65535 kelvin 1500 duration 0"},
+		{Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 6500, Brightness: 1}, Transition: time.Second}, office, "brightness 655 kelvin 6500 duration 1000"},
+	}
+	for _, s := range setpoints {
+		if err := lifx.Apply(ctx, s.setpoint); err != nil {
+			t.Fatalf("lifx.Apply(%+v) = %v", s.setpoint, err)
+		}
+		if got := s.bulb.sent(); len(got) != 1 || got[0] != s.expected {
+			t.Errorf("lifx.Apply(%+v) = %v, expected %s", s.setpoint, got, s.expected)
+		}
+	}
+
+	state, err := lifx.State(ctx, "d0:73:d5:00:00:02")
+	expected := Lighting{ColorTemp: 6500, Brightness: 1}
+	if err != nil || state != expected {
+		t.Errorf("lifx.State(office) = %+v, %v, expected %+v", state, err, expected)
+	}
+
+	office.dropping(10)
+	if err := lifx.Apply(ctx, Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 2700, Brightness: 50}}); err == nil {
+		t.Errorf("lifx.Apply() succeeded without acknowledgement")
+	}
+	if err := lifx.Apply(ctx, Setpoint{Zone: "garage"}); err == nil {
+		t.Errorf("lifx.Apply() succeeded on an unknown zone")
+	}
+}
+
+func TestLIFXDiscoverUnreachable(t *testing.T) {
+	kitchen := newFakeLIFXBulb(t, "d0:73:d5:00:00:01", "Kitchen")
+	office := newFakeLIFXBulb(t, "d0:73:d5:00:00:02", "Office")
+	office.mu.Lock()
+	office.mute = true
+	office.mu.Unlock()
+	lifx := &LIFX{Addresses: []string{kitchen.address(), office.address()}, Timeout: 50 * time.Millisecond}
+	defer lifx.Close()
+
+	lights, err := lifx.Discover(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "d0:73:d5:00:00:02") {
+		t.Errorf("lifx.Discover() = %v, expected the office bulb unreachable", err)
+	}
+	if len(lights) != 1 || lights[0].ID != "d0:73:d5:00:00:01" || lights[0].Name != "Kitchen" {
+		t.Errorf("lifx.Discover() = %+v, expected the kitchen bulb", lights)
+	}
+}
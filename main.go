@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -191,8 +195,47 @@ func Brightness(date time.Time, latitude float64, longitude float64) int64 {
 	}
 }
 
+func solarEvents(date time.Time, latitude float64, longitude float64) []time.Time {
+	events := []time.Time{solarMidnight(date, longitude)}
+	if !math.IsNaN(hASunrise(date, latitude)) {
+		events = append(events, sunrise(date, latitude, longitude))
+	}
+	events = append(events, solarNoon(date, longitude))
+	if !math.IsNaN(hASunset(date, latitude)) {
+		events = append(events, sunset(date, latitude, longitude))
+	}
+	return events
+}
+
+func nextSolarEvent(date time.Time, latitude float64, longitude float64) time.Time {
+	var next time.Time
+	for _, day := range []time.Time{date, date.AddDate(0, 0, 1)} {
+		for _, event := range solarEvents(day, latitude, longitude) {
+			if event.After(date) && (next.IsZero() || event.Before(next)) {
+				next = event
+			}
+		}
+	}
+	return next
+}
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		ctx, cancel := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			cancel()
+		}()
+		if err := serve(ctx, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	date := time.Now()
 	latitude := 48.87
 	longitude := 2.67
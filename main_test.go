@@ -218,3 +218,31 @@ func TestAzimuthAucklandUTC(t *testing.T) {
 		}
 	}
 }
+
+func TestNextSolarEvent(t *testing.T) {
+
+	// Paris UTC
+	latitude := 48.87
+	longitude := 2.67
+	dates := make(map[time.Time]time.Time)
+	noon := solarNoon(time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC), longitude)
+	dates[time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)] = noon
+	dates[time.Date(2021, 6, 21, 2, 0, 0, 0, time.UTC)] = sunrise(time.Date(2021, 6, 21, 2, 0, 0, 0, time.UTC), latitude, longitude)
+	dates[time.Date(2021, 6, 21, 22, 0, 0, 0, time.UTC)] = solarMidnight(time.Date(2021, 6, 22, 22, 0, 0, 0, time.UTC), longitude)
+
+	for k, v := range dates {
+		got := nextSolarEvent(k, latitude, longitude)
+		if !got.Equal(v) {
+			t.Errorf("nextSolarEvent(%v) = %v, expected %v", k, got, v)
+		} else {
+			t.Logf("nextSolarEvent(%v) = %v, expected %v", k, got, v)
+		}
+	}
+
+	// No sunrise nor sunset during the polar night
+	events := solarEvents(time.Date(2021, 12, 21, 12, 0, 0, 0, time.UTC), 78.22, 15.65)
+	if len(events) != 2 {
+		t.Errorf("solarEvents() during the polar night = %v, expected solar midnight and noon", events)
+	}
+
+}
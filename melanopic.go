@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Spectrum describes the spectral family of a light source, which drives how
+// much melanopic stimulus it produces per lux at a given color temperature.
+type Spectrum int
+
+const (
+	Incandescent Spectrum = iota
+	LED
+	Fluorescent
+	Daylight
+)
+
+// Fixture describes a light source as seen from the observer's eye.
+// Lumens is the rated output at 100% brightness and Area the surface in m²
+// over which it is spread, so that Lumens/Area is the illuminance at the eye.
+type Fixture struct {
+	Lumens   float64
+	Area     float64
+	Spectrum Spectrum
+}
+
+// Melanopic daylight efficacy ratios (melanopic DER, CIE S 026) against
+// color temperature for each spectral family, D65 being 1 by definition.
+var melanopicDERTables = map[Spectrum][][2]float64{
+	Incandescent: {{1500, 0.14}, {2000, 0.26}, {2500, 0.38}, {2856, 0.45}, {3000, 0.48}, {3500, 0.57}, {4000, 0.65}, {5000, 0.78}, {6500, 0.91}, {10000, 1.08}},
+	LED:          {{1800, 0.24}, {2200, 0.33}, {2700, 0.42}, {3000, 0.47}, {3500, 0.55}, {4000, 0.63}, {5000, 0.76}, {5700, 0.82}, {6500, 0.88}},
+	Fluorescent:  {{2700, 0.40}, {3000, 0.43}, {3500, 0.48}, {4000, 0.53}, {5000, 0.73}, {6500, 0.92}},
+	Daylight:     {{4000, 0.71}, {5000, 0.84}, {5500, 0.90}, {6500, 1.0}, {7500, 1.07}, {10000, 1.18}},
+}
+
+// Melanopic DER of CIE standard illuminant A, used to scale circadian light.
+const melanopicDERIlluminantA = 0.45
+
+func interpolate(table [][2]float64, x float64) float64 {
+	if x <= table[0][0] {
+		return table[0][1]
+	}
+	for i := 1; i < len(table); i++ {
+		if x <= table[i][0] {
+			return table[i-1][1] + (x-table[i-1][0])*(table[i][1]-table[i-1][1])/(table[i][0]-table[i-1][0])
+		}
+	}
+	return table[len(table)-1][1]
+}
+
+func melanopicDERTable(spectrum Spectrum) ([][2]float64, error) {
+	table, ok := melanopicDERTables[spectrum]
+	if !ok {
+		return nil, fmt.Errorf("unknown spectrum %d", spectrum)
+	}
+	return table, nil
+}
+
+// validate checks that the fixture has a known spectrum, a positive area and a
+// positive light output.
+func (f Fixture) validate() error {
+	if _, err := melanopicDERTable(f.Spectrum); err != nil {
+		return err
+	}
+	if !(f.Area > 0) {
+		return fmt.Errorf("fixture area %v m², expected a positive area", f.Area)
+	}
+	if !(f.Lumens > 0) {
+		return fmt.Errorf("fixture of %v lm, expected a positive light output", f.Lumens)
+	}
+	return nil
+}
+
+func (f Fixture) illuminance(brightness int64) float64 {
+	return f.Lumens * float64(brightness) / 100 / f.Area
+}
+
+// MelanopicDER returns the melanopic DER of a source of the given spectral
+// family and color temperature.
+func MelanopicDER(colorTemp int64, spectrum Spectrum) (float64, error) {
+	table, err := melanopicDERTable(spectrum)
+	if err != nil {
+		return 0, err
+	}
+	return interpolate(table, float64(colorTemp)), nil
+}
+
+// MelanopicEDI returns the melanopic equivalent daylight (D65) illuminance in
+// lux produced by the fixture at the given color temperature and brightness.
+func MelanopicEDI(colorTemp int64, brightness int64, fixture Fixture) (float64, error) {
+	if err := fixture.validate(); err != nil {
+		return 0, err
+	}
+	der, _ := MelanopicDER(colorTemp, fixture.Spectrum)
+	return fixture.illuminance(brightness) * der, nil
+}
+
+// CircadianStimulus returns the LRC circadian stimulus (0 to 0.7). Circadian
+// light is approximated from the melanopic content, scaled so that CIE
+// illuminant A yields as much circadian light as it yields lux.
+func CircadianStimulus(colorTemp int64, brightness int64, fixture Fixture) (float64, error) {
+	edi, err := MelanopicEDI(colorTemp, brightness, fixture)
+	if err != nil {
+		return 0, err
+	}
+	cla := edi / melanopicDERIlluminantA
+	return 0.7 * (1 - 1/(1+math.Pow(cla/355.7, 1.1026))), nil
+}
+
+// MelanopicLighting returns the color temperature and brightness to drive the
+// fixture with so that it reaches the target melanopic EDI at the given date.
+// The circadian color temperature is kept whenever dimming alone reaches the
+// target, otherwise the color temperature is raised. The boolean is false when
+// the fixture cannot reach the target, in which case it is driven at its most
+// melanopic setting, the highest color temperature of its spectrum table.
+func MelanopicLighting(date time.Time, latitude float64, longitude float64, target float64, fixture Fixture) (int64, int64, bool, error) {
+	if err := fixture.validate(); err != nil {
+		return 0, 0, false, err
+	}
+	table, _ := melanopicDERTable(fixture.Spectrum)
+	maxColorTemp := int64(table[len(table)-1][0])
+	colorTemp := ColorTemp(date, latitude, longitude)
+	for {
+		if colorTemp > maxColorTemp {
+			colorTemp = maxColorTemp
+		}
+		edi, _ := MelanopicEDI(colorTemp, 100, fixture)
+		brightness := int64(math.Ceil(100 * target / edi))
+		if brightness <= 100 {
+			if brightness < 1 {
+				brightness = 1
+			}
+			return colorTemp, brightness, true, nil
+		}
+		if colorTemp == maxColorTemp {
+			return maxColorTemp, 100, false, nil
+		}
+		colorTemp += 100
+	}
+}
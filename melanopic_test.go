@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMelanopicDER(t *testing.T) {
+
+	type source struct {
+		colorTemp int64
+		spectrum  Spectrum
+	}
+	sources := make(map[source]float64)
+	sources[source{6500, Daylight}] = 1
+	sources[source{2856, Incandescent}] = 0.45
+	sources[source{1000, Incandescent}] = 0.14
+	sources[source{20000, Daylight}] = 1.18
+	sources[source{3250, LED}] = 0.51
+	sources[source{4500, Fluorescent}] = 0.63
+
+	for k, v := range sources {
+		got, err := MelanopicDER(k.colorTemp, k.spectrum)
+		if err != nil || math.Abs(got-v) > 0.001 {
+			t.Errorf("MelanopicDER(%d, %d) = %f, expected %f, diff %f", k.colorTemp, k.spectrum, got, v, math.Abs(got-v))
+		} else {
+			t.Logf("MelanopicDER(%d, %d) = %f, expected %f, diff %f", k.colorTemp, k.spectrum, got, v, math.Abs(got-v))
+		}
+	}
+
+	if got, err := MelanopicDER(4000, Spectrum(42)); err == nil {
+		t.Errorf("MelanopicDER(4000, 42) = %f, expected an error", got)
+	}
+
+}
+
+func TestMelanopicEDI(t *testing.T) {
+
+	// 1000 lm spread over 2 m² gives 500 lux at full brightness
+	fixture := Fixture{Lumens: 1000, Area: 2, Spectrum: Daylight}
+	brightnesses := make(map[int64]float64)
+	brightnesses[100] = 500
+	brightnesses[50] = 250
+	brightnesses[0] = 0
+
+	for k, v := range brightnesses {
+		got, err := MelanopicEDI(6500, k, fixture)
+		if err != nil || math.Abs(got-v) > 0.001 {
+			t.Errorf("MelanopicEDI(6500, %d) = %f, expected %f, diff %f", k, got, v, math.Abs(got-v))
+		} else {
+			t.Logf("MelanopicEDI(6500, %d) = %f, expected %f, diff %f", k, got, v, math.Abs(got-v))
+		}
+	}
+
+	invalid := []Fixture{{Lumens: 1000, Spectrum: Daylight}, {Lumens: 1000, Area: -1, Spectrum: Daylight}, {Lumens: 1000, Area: 2, Spectrum: Spectrum(42)}, {Area: 2, Spectrum: Daylight}, {Lumens: -1000, Area: 2, Spectrum: Daylight}}
+	for _, f := range invalid {
+		if got, err := MelanopicEDI(6500, 100, f); err == nil {
+			t.Errorf("MelanopicEDI(6500, 100) with %+v = %f, expected an error", f, got)
+		}
+	}
+
+}
+
+func TestCircadianStimulus(t *testing.T) {
+
+	// Illuminant A at the given illuminance, CS values from the LRC model
+	fixture := Fixture{Lumens: 1000, Area: 1, Spectrum: Incandescent}
+	brightnesses := make(map[int64]float64)
+	brightnesses[0] = 0
+	brightnesses[10] = 0.1386
+	brightnesses[35] = 0.3469
+	brightnesses[100] = 0.5303
+
+	for k, v := range brightnesses {
+		got, err := CircadianStimulus(2856, k, fixture)
+		if err != nil || math.Abs(got-v) > 0.001 {
+			t.Errorf("CircadianStimulus(2856, %d) = %f, expected %f, diff %f", k, got, v, math.Abs(got-v))
+		} else {
+			t.Logf("CircadianStimulus(2856, %d) = %f, expected %f, diff %f", k, got, v, math.Abs(got-v))
+		}
+	}
+
+}
+
+func TestMelanopicLighting(t *testing.T) {
+
+	// Paris UTC
+	latitude := 48.87
+	longitude := 2.67
+	fixture := Fixture{Lumens: 4000, Area: 10, Spectrum: LED}
+	noon := time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC)
+	night := time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC)
+
+	for _, target := range []float64{50, 150, 250} {
+		for _, date := range []time.Time{noon, night} {
+			colorTemp, brightness, ok, err := MelanopicLighting(date, latitude, longitude, target, fixture)
+			got, _ := MelanopicEDI(colorTemp, brightness, fixture)
+			if err != nil || !ok || got < target || colorTemp < ColorTemp(date, latitude, longitude) {
+				t.Errorf("MelanopicLighting(%v, %f) = %d, %d, %t, melanopic EDI %f", date, target, colorTemp, brightness, ok, got)
+			} else {
+				t.Logf("MelanopicLighting(%v, %f) = %d, %d, %t, melanopic EDI %f", date, target, colorTemp, brightness, ok, got)
+			}
+		}
+	}
+
+	colorTemp, brightness, ok, err := MelanopicLighting(night, latitude, longitude, 1000, fixture)
+	if err != nil || ok || colorTemp != 6500 || brightness != 100 {
+		t.Errorf("MelanopicLighting(%v, 1000) = %d, %d, %t, %v, expected 6500, 100, false", night, colorTemp, brightness, ok, err)
+	}
+
+	// From 5498K at noon, steps of 100K skip over 6500K, which only just
+	// reaches the target
+	colorTemp, brightness, ok, err = MelanopicLighting(noon, latitude, longitude, 351.97, fixture)
+	if err != nil || !ok || colorTemp != 6500 || brightness != 100 {
+		t.Errorf("MelanopicLighting(%v, 351.97) = %d, %d, %t, %v, expected 6500, 100, true", noon, colorTemp, brightness, ok, err)
+	}
+
+	if _, _, _, err := MelanopicLighting(noon, latitude, longitude, 50, Fixture{Lumens: 4000, Spectrum: LED}); err == nil {
+		t.Errorf("MelanopicLighting() without fixture area = nil, expected an error")
+	}
+	for _, lumens := range []float64{0, -4000} {
+		if colorTemp, brightness, ok, err := MelanopicLighting(noon, latitude, longitude, 50, Fixture{Lumens: lumens, Area: 10, Spectrum: LED}); err == nil {
+			t.Errorf("MelanopicLighting() with %v lm = %d, %d, %t, nil, expected an error", lumens, colorTemp, brightness, ok)
+		}
+	}
+
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/color"
+	"github.com/sundae-party/circadian-lighting/mqtt"
+)
+
+// PayloadFormat is the format of the setpoints published over MQTT.
+type PayloadFormat int
+
+const (
+	// JSONPayload publishes a JSON object on the topic of the zone.
+	JSONPayload PayloadFormat = iota
+	// PlainPayload publishes each value as text on a subtopic of the zone.
+	PlainPayload
+)
+
+// MQTTSetpoint is the JSON payload of a setpoint. The transition is in seconds.
+type MQTTSetpoint struct {
+	ColorTemp  int64   `json:"colorTemp"`
+	Brightness int64   `json:"brightness"`
+	Transition float64 `json:"transition"`
+}
+
+// MQTTCommand is the JSON payload of a command. A color temperature, positive,
+// or a brightness, between 0 and 100, is recorded as a manual setting of the
+// zone, the other value being kept, a profile replaces the profile of the zone and resume clears its
+// manual setting.
+type MQTTCommand struct {
+	ColorTemp  int64  `json:"colorTemp,omitempty"`
+	Brightness *int64 `json:"brightness,omitempty"`
+	Profile    string `json:"profile,omitempty"`
+	Resume     bool   `json:"resume,omitempty"`
+}
+
+// MQTTOutput publishes the setpoints of a controller over MQTT, and applies
+// the commands received for its zones. Topic and CommandTopic are templates in
+// which "{zone}" is replaced by the name of the zone, such as
+// "circadian/{zone}" and "circadian/{zone}/set". Profiles are the profiles a
+// command can switch a zone to.
+type MQTTOutput struct {
+	Client       *mqtt.Client
+	Controller   *Controller
+	Topic        string
+	CommandTopic string
+	Format       PayloadFormat
+	QoS          byte
+	Retain       bool
+	Profiles     map[string]Profile
+}
+
+func expandTopic(template string, zone string) string {
+	return strings.ReplaceAll(template, "{zone}", zone)
+}
+
+// topicZone returns the zone of a topic expanded from the template.
+func topicZone(template string, topic string) (string, bool) {
+	levels := strings.Split(template, "/")
+	topicLevels := strings.Split(topic, "/")
+	if len(levels) != len(topicLevels) {
+		return "", false
+	}
+	for i, level := range levels {
+		if level == "{zone}" {
+			return topicLevels[i], true
+		}
+	}
+	return "", false
+}
+
+// Publish publishes a setpoint.
+func (o *MQTTOutput) Publish(setpoint Setpoint) error {
+	topic := expandTopic(o.Topic, setpoint.Zone)
+	if o.Format == PlainPayload {
+		if err := o.Client.Publish(topic+"/colorTemp", []byte(strconv.FormatInt(setpoint.ColorTemp, 10)), o.QoS, o.Retain); err != nil {
+			return err
+		}
+		return o.Client.Publish(topic+"/brightness", []byte(strconv.FormatInt(setpoint.Brightness, 10)), o.QoS, o.Retain)
+	}
+	payload, err := json.Marshal(MQTTSetpoint{
+		ColorTemp:  setpoint.ColorTemp,
+		Brightness: setpoint.Brightness,
+		Transition: setpoint.Transition.Seconds(),
+	})
+	if err != nil {
+		return err
+	}
+	return o.Client.Publish(topic, payload, o.QoS, o.Retain)
+}
+
+// Command applies a command to a zone at the given date.
+func (o *MQTTOutput) Command(zone string, command MQTTCommand, date time.Time) error {
+	lighting, ok := o.Controller.Lighting(zone, date)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownZone, zone)
+	}
+	if command.ColorTemp < 0 {
+		return fmt.Errorf("invalid color temperature %dK, expected a positive value", command.ColorTemp)
+	}
+	if command.Brightness != nil && (*command.Brightness < 0 || *command.Brightness > 100) {
+		return fmt.Errorf("invalid brightness %d, expected between 0 and 100", *command.Brightness)
+	}
+	if command.Profile != "" {
+		profile, ok := o.Profiles[command.Profile]
+		if !ok {
+			return fmt.Errorf("unknown profile %q", command.Profile)
+		}
+		o.Controller.SetProfile(zone, profile)
+	}
+	if command.ColorTemp == 0 && command.Brightness == nil && !command.Resume {
+		return nil
+	}
+	if o.Controller.Overrides == nil {
+		return fmt.Errorf("zone %q: manual settings are disabled", zone)
+	}
+	if command.Resume {
+		o.Controller.Overrides.Clear(zone)
+	} else {
+		if command.ColorTemp != 0 {
+			lighting.ColorTemp = command.ColorTemp
+			lighting.Chromaticity = color.XY{}
+		}
+		if command.Brightness != nil {
+			lighting.Brightness = *command.Brightness
+		}
+		o.Controller.Overrides.Set(zone, lighting, date)
+	}
+	o.Controller.Refresh()
+	return nil
+}
+
+// Subscribe applies the commands received on the command topics of all zones
+// from then on. Commands that cannot be applied are passed to report, when
+// not nil.
+func (o *MQTTOutput) Subscribe(report func(error)) error {
+	return o.Client.Subscribe(expandTopic(o.CommandTopic, "+"), o.QoS, func(m mqtt.Message) {
+		zone, _ := topicZone(o.CommandTopic, m.Topic)
+		var command MQTTCommand
+		err := json.Unmarshal(m.Payload, &command)
+		if err == nil {
+			err = o.Command(zone, command, o.Controller.Clock.Now())
+		}
+		if err != nil && report != nil {
+			report(fmt.Errorf("command on %s: %w", m.Topic, err))
+		}
+	})
+}
+
+// Run publishes the setpoints received on the channel until the channel is
+// closed, the context is done or the connection is closed. Setpoints received
+// while the client reconnects are dropped, the controller emitting them again
+// at its next interval.
+func (o *MQTTOutput) Run(ctx context.Context, setpoints <-chan Setpoint) error {
+	for {
+		select {
+		case setpoint, ok := <-setpoints:
+			if !ok {
+				return nil
+			}
+			if err := o.Publish(setpoint); err != nil && !errors.Is(err, mqtt.ErrConnectionLost) {
+				return err
+			}
+		case <-o.Client.Done():
+			return o.Client.Err()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
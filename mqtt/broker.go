@@ -0,0 +1,261 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"sync"
+)
+
+// Broker is a minimal MQTT 3.1.1 broker. It accepts any client, routes
+// messages with QoS 0 and 1 (QoS 2 being delivered as QoS 1), keeps retained
+// messages and publishes the will of clients whose connection is lost.
+// Sessions are not persisted.
+type Broker struct {
+	listener net.Listener
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+	retained map[string]Message
+	wg       sync.WaitGroup
+}
+
+type session struct {
+	conn          net.Conn
+	writeMu       sync.Mutex
+	mu            sync.Mutex
+	nextID        uint16
+	subscriptions map[string]byte
+}
+
+// NewBroker serves MQTT on the listener until closed. A TLS listener serves
+// MQTT over TLS.
+func NewBroker(listener net.Listener) *Broker {
+	b := &Broker{
+		listener: listener,
+		sessions: make(map[*session]struct{}),
+		retained: make(map[string]Message),
+	}
+	b.wg.Add(1)
+	go b.serve()
+	return b
+}
+
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Close stops the broker and closes all its connections, without publishing
+// their wills.
+func (b *Broker) Close() error {
+	err := b.listener.Close()
+	b.mu.Lock()
+	for s := range b.sessions {
+		s.conn.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+// Connections returns the number of clients connected.
+func (b *Broker) Connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.sessions)
+}
+
+// Retained returns the message retained on a topic.
+func (b *Broker) Retained(topic string) (Message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.retained[topic]
+	return m, ok
+}
+
+// Publish routes a message to the subscribed clients, as if a client had
+// published it.
+func (b *Broker) Publish(m Message) {
+	b.mu.Lock()
+	if m.Retain {
+		if len(m.Payload) == 0 {
+			delete(b.retained, m.Topic)
+		} else {
+			b.retained[m.Topic] = m
+		}
+	}
+	var sessions []*session
+	for s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+	for _, s := range sessions {
+		s.deliver(m, false)
+	}
+}
+
+func (b *Broker) serve() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.wg.Add(1)
+		go b.handle(conn)
+	}
+}
+
+func (s *session) write(p packet) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(p.encode())
+	return err
+}
+
+// deliver sends the message if it matches a subscription of the session.
+func (s *session) deliver(m Message, retain bool) {
+	s.mu.Lock()
+	qos, matched := byte(0), false
+	for filter, q := range s.subscriptions {
+		if Match(filter, m.Topic) {
+			matched = true
+			if q > qos {
+				qos = q
+			}
+		}
+	}
+	if !matched {
+		s.mu.Unlock()
+		return
+	}
+	if m.QoS < qos {
+		qos = m.QoS
+	}
+	if qos > 1 {
+		qos = 1
+	}
+	s.nextID++
+	if s.nextID == 0 {
+		s.nextID++
+	}
+	id := s.nextID
+	s.mu.Unlock()
+	s.write(publishPacket(Message{Topic: m.Topic, Payload: m.Payload, QoS: qos, Retain: retain}, id))
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer b.wg.Done()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil || p.kind != connect {
+		return
+	}
+	will, ok := parseConnect(p)
+	if !ok {
+		conn.Write(packet{kind: connack, body: []byte{0, 1}}.encode())
+		return
+	}
+	s := &session{conn: conn, subscriptions: make(map[string]byte)}
+	if err := s.write(packet{kind: connack, body: []byte{0, 0}}); err != nil {
+		return
+	}
+	b.mu.Lock()
+	b.sessions[s] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.sessions, s)
+		b.mu.Unlock()
+	}()
+
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			if will != nil {
+				b.Publish(*will)
+			}
+			return
+		}
+		switch p.kind {
+		case publish:
+			m, id, err := parsePublish(p)
+			if err != nil {
+				return
+			}
+			if m.QoS == 1 {
+				s.write(ackPacket(puback, id))
+			} else if m.QoS == 2 {
+				s.write(ackPacket(pubrec, id))
+			}
+			b.Publish(m)
+		case pubrel:
+			r := reader{b: p.body}
+			s.write(ackPacket(pubcomp, r.uint16()))
+		case subscribe:
+			r := reader{b: p.body}
+			id := r.uint16()
+			var filters []string
+			granted := appendUint16(nil, id)
+			for len(r.b) > 0 && r.err == nil {
+				filter, qos := r.string(), r.byte()
+				if qos > 1 {
+					qos = 1
+				}
+				filters = append(filters, filter)
+				granted = append(granted, qos)
+				s.mu.Lock()
+				s.subscriptions[filter] = qos
+				s.mu.Unlock()
+			}
+			if r.err != nil {
+				return
+			}
+			s.write(packet{kind: suback, body: granted})
+			b.mu.Lock()
+			var retained []Message
+			for _, m := range b.retained {
+				for _, filter := range filters {
+					if Match(filter, m.Topic) {
+						retained = append(retained, m)
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+			for _, m := range retained {
+				s.deliver(m, true)
+			}
+		case unsubscribe:
+			r := reader{b: p.body}
+			id := r.uint16()
+			for len(r.b) > 0 && r.err == nil {
+				filter := r.string()
+				s.mu.Lock()
+				delete(s.subscriptions, filter)
+				s.mu.Unlock()
+			}
+			s.write(packet{kind: unsuback, body: appendUint16(nil, id)})
+		case pingreq:
+			s.write(packet{kind: pingresp})
+		case disconnect:
+			return
+		}
+	}
+}
+
+// parseConnect returns the will of a CONNECT packet, and false if its protocol
+// is not MQTT 3.1.1.
+func parseConnect(p packet) (*Message, bool) {
+	r := reader{b: p.body}
+	name, level, flags := r.string(), r.byte(), r.byte()
+	r.uint16()
+	r.string()
+	if r.err != nil || name != "MQTT" || level != 4 {
+		return nil, false
+	}
+	var will *Message
+	if flags&0x04 != 0 {
+		will = &Message{Topic: r.string(), Payload: r.bytes(), QoS: (flags >> 3) & 3, Retain: flags&0x20 != 0}
+	}
+	return will, r.err == nil
+}
@@ -0,0 +1,521 @@
+// Package mqtt is a minimal MQTT 3.1.1 client, with QoS 0, 1 and 2, retained
+// messages, last will and TLS, and a minimal broker to embed in tests and
+// small installations.
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Message is an application message published on a topic.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Options configures the connection to a broker. A Password needs a Username,
+// as MQTT 3.1.1 requires. KeepAlive is the interval between pings, none being
+// sent when 0. Timeout bounds the connection and the wait for
+// acknowledgements, 10s when 0. The connection is over TLS when TLS is set,
+// and Will is published by the broker if the connection is lost. When
+// Reconnect is set, a lost connection is dialed again, waiting from 1s doubling
+// up to 1min between failed attempts, and the subscriptions are renewed.
+type Options struct {
+	Address   string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	Timeout   time.Duration
+	TLS       *tls.Config
+	Will      *Message
+	Reconnect bool
+}
+
+// Client is a connection to a broker. It is safe for concurrent use.
+type Client struct {
+	opts          Options
+	writeMu       sync.Mutex
+	mu            sync.Mutex
+	conn          net.Conn
+	lost          chan struct{}
+	nextID        uint16
+	pending       map[uint16]chan packet
+	subscriptions []*subscription
+	messages      chan Message
+	done          chan struct{}
+	err           error
+}
+
+type subscription struct {
+	filter  string
+	qos     byte
+	handler func(Message)
+}
+
+var (
+	// ErrClosed is returned when using a client whose connection is closed.
+	ErrClosed = errors.New("mqtt: connection closed")
+	// ErrConnectionLost is returned when the connection of a reconnecting
+	// client is lost before an operation completes.
+	ErrConnectionLost = errors.New("mqtt: connection lost")
+)
+
+// Reconnection delays of clients with Options.Reconnect.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+func Connect(opts Options) (*Client, error) {
+	if opts.Password != "" && opts.Username == "" {
+		return nil, errors.New("mqtt: password without a user name")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	conn, r, err := handshake(opts)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		opts:     opts,
+		pending:  make(map[uint16]chan packet),
+		messages: make(chan Message, 64),
+		done:     make(chan struct{}),
+	}
+	c.start(conn, r)
+	go c.dispatch()
+	return c, nil
+}
+
+// handshake opens a connection and waits for the broker to accept it.
+func handshake(opts Options) (net.Conn, *bufio.Reader, error) {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	var conn net.Conn
+	var err error
+	if opts.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", opts.Address, opts.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", opts.Address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flags := byte(0x02)
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, 0)
+	body = appendUint16(body, uint16(opts.KeepAlive/time.Second))
+	body = appendString(body, opts.ClientID)
+	if opts.Will != nil {
+		flags |= 0x04 | opts.Will.QoS<<3
+		if opts.Will.Retain {
+			flags |= 0x20
+		}
+		body = appendString(body, opts.Will.Topic)
+		body = appendString(body, string(opts.Will.Payload))
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		body = appendString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+		body = appendString(body, opts.Password)
+	}
+	body[7] = flags
+
+	conn.SetDeadline(time.Now().Add(opts.Timeout))
+	r := bufio.NewReader(conn)
+	if _, err := conn.Write(packet{kind: connect, body: body}.encode()); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	p, err := readPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if p.kind != connack || len(p.body) != 2 {
+		conn.Close()
+		return nil, nil, errMalformed
+	}
+	if code := p.body[1]; code != 0 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("mqtt: connection refused: %s", connackErrors[code])
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// start reads and pings over a new connection, and returns false if the
+// client was closed in the meantime.
+func (c *Client) start(conn net.Conn, r *bufio.Reader) bool {
+	lost := make(chan struct{})
+	c.mu.Lock()
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		conn.Close()
+		return false
+	default:
+	}
+	c.conn, c.lost = conn, lost
+	c.mu.Unlock()
+	go c.read(conn, r, lost)
+	if c.opts.KeepAlive > 0 {
+		go c.ping(lost)
+	}
+	return true
+}
+
+// connection returns the current connection and the channel closed when it is
+// lost.
+func (c *Client) connection() (net.Conn, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn, c.lost
+}
+
+func (c *Client) write(p packet) error {
+	conn, lost := c.connection()
+	select {
+	case <-lost:
+		return c.lostErr()
+	default:
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := conn.Write(p.encode())
+	return err
+}
+
+// lostErr returns the error of an operation interrupted by the loss of the
+// connection.
+func (c *Client) lostErr() error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+		return ErrConnectionLost
+	}
+}
+
+func (c *Client) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.err = err
+	close(c.done)
+	select {
+	case <-c.lost:
+	default:
+		close(c.lost)
+	}
+	c.conn.Close()
+}
+
+// lose handles the loss of a connection, which is dialed again when the
+// client reconnects and closes the client otherwise.
+func (c *Client) lose(conn net.Conn, lost chan struct{}, err error) {
+	if !c.opts.Reconnect {
+		c.close(err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-lost:
+		return
+	default:
+	}
+	close(lost)
+	conn.Close()
+	go c.reconnect()
+}
+
+func (c *Client) reconnect() {
+	delay := minReconnectDelay
+	for {
+		conn, r, err := handshake(c.opts)
+		if err == nil {
+			if c.start(conn, r) {
+				c.resubscribe(conn)
+			}
+			return
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-c.done:
+			timer.Stop()
+			return
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// resubscribe renews the subscriptions over a new connection, which is lost
+// again if one fails.
+func (c *Client) resubscribe(conn net.Conn) {
+	c.mu.Lock()
+	subscriptions := append([]*subscription(nil), c.subscriptions...)
+	lost := c.lost
+	c.mu.Unlock()
+	for _, s := range subscriptions {
+		if err := c.subscribe(s.filter, s.qos); err != nil {
+			c.lose(conn, lost, err)
+			return
+		}
+	}
+}
+
+func (c *Client) read(conn net.Conn, r *bufio.Reader, lost chan struct{}) {
+	// QoS 2 messages are delivered once released, exactly once per packet
+	// identifier.
+	received := make(map[uint16]Message)
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			c.lose(conn, lost, err)
+			return
+		}
+		switch p.kind {
+		case publish:
+			m, id, err := parsePublish(p)
+			if err != nil {
+				c.lose(conn, lost, err)
+				return
+			}
+			if m.QoS == 1 {
+				c.write(ackPacket(puback, id))
+			} else if m.QoS == 2 {
+				if _, ok := received[id]; !ok {
+					received[id] = m
+				}
+				c.write(ackPacket(pubrec, id))
+				continue
+			}
+			if !c.deliver(m, lost) {
+				return
+			}
+		case pubrel:
+			r := reader{b: p.body}
+			id := r.uint16()
+			m, ok := received[id]
+			delete(received, id)
+			c.write(ackPacket(pubcomp, id))
+			if ok && !c.deliver(m, lost) {
+				return
+			}
+		case puback, pubrec, pubcomp, suback, unsuback:
+			r := reader{b: p.body}
+			id := r.uint16()
+			c.mu.Lock()
+			ch, ok := c.pending[id]
+			c.mu.Unlock()
+			if ok {
+				select {
+				case ch <- p:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// deliver queues a message for the handlers, and returns false if the
+// connection is lost first.
+func (c *Client) deliver(m Message, lost chan struct{}) bool {
+	select {
+	case c.messages <- m:
+		return true
+	case <-lost:
+		return false
+	}
+}
+
+func (c *Client) dispatch() {
+	for {
+		var m Message
+		select {
+		case m = <-c.messages:
+		case <-c.done:
+			return
+		}
+		c.mu.Lock()
+		var handlers []func(Message)
+		for _, s := range c.subscriptions {
+			if Match(s.filter, m.Topic) {
+				handlers = append(handlers, s.handler)
+			}
+		}
+		c.mu.Unlock()
+		for _, handler := range handlers {
+			handler(m)
+		}
+	}
+}
+
+func (c *Client) ping(lost chan struct{}) {
+	ticker := time.NewTicker(c.opts.KeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.write(packet{kind: pingreq})
+		case <-lost:
+			return
+		}
+	}
+}
+
+// register returns a new packet identifier and the channel its
+// acknowledgements are received on.
+func (c *Client) register() (uint16, chan packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		c.nextID++
+		if _, ok := c.pending[c.nextID]; c.nextID != 0 && !ok {
+			break
+		}
+	}
+	ch := make(chan packet, 1)
+	c.pending[c.nextID] = ch
+	return c.nextID, ch
+}
+
+func (c *Client) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *Client) await(ch chan packet, kind byte) (packet, error) {
+	_, lost := c.connection()
+	timer := time.NewTimer(c.opts.Timeout)
+	defer timer.Stop()
+	select {
+	case p := <-ch:
+		if p.kind != kind {
+			return p, errMalformed
+		}
+		return p, nil
+	case <-lost:
+		return packet{}, c.lostErr()
+	case <-timer.C:
+		return packet{}, errors.New("mqtt: acknowledgement timeout")
+	}
+}
+
+// Publish sends a message, and waits for it to be acknowledged with QoS 1 and 2.
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	if qos > 2 {
+		return fmt.Errorf("mqtt: invalid QoS %d", qos)
+	}
+	m := Message{Topic: topic, Payload: payload, QoS: qos, Retain: retain}
+	if qos == 0 {
+		return c.write(publishPacket(m, 0))
+	}
+	id, ch := c.register()
+	defer c.unregister(id)
+	if err := c.write(publishPacket(m, id)); err != nil {
+		return err
+	}
+	if qos == 1 {
+		_, err := c.await(ch, puback)
+		return err
+	}
+	if _, err := c.await(ch, pubrec); err != nil {
+		return err
+	}
+	if err := c.write(ackPacket(pubrel, id)); err != nil {
+		return err
+	}
+	_, err := c.await(ch, pubcomp)
+	return err
+}
+
+// Subscribe calls the handler with the messages published on the topics
+// matching the filter, one at a time in the order they are received. The
+// handler is not called if the subscription fails.
+func (c *Client) Subscribe(filter string, qos byte, handler func(Message)) error {
+	s := &subscription{filter: filter, qos: qos, handler: handler}
+	c.mu.Lock()
+	c.subscriptions = append(c.subscriptions, s)
+	c.mu.Unlock()
+	if err := c.subscribe(filter, qos); err != nil {
+		c.mu.Lock()
+		for i, subscription := range c.subscriptions {
+			if subscription == s {
+				c.subscriptions = append(c.subscriptions[:i], c.subscriptions[i+1:]...)
+				break
+			}
+		}
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// subscribe sends SUBSCRIBE and waits for its acknowledgement.
+func (c *Client) subscribe(filter string, qos byte) error {
+	id, ch := c.register()
+	defer c.unregister(id)
+	body := appendString(appendUint16(nil, id), filter)
+	if err := c.write(packet{kind: subscribe, flags: 2, body: append(body, qos)}); err != nil {
+		return err
+	}
+	p, err := c.await(ch, suback)
+	if err != nil {
+		return err
+	}
+	if len(p.body) < 3 || p.body[2] == 0x80 {
+		return fmt.Errorf("mqtt: subscription to %s refused", filter)
+	}
+	return nil
+}
+
+// Done is closed when the connection is closed, by Disconnect or, without
+// Options.Reconnect, by its loss.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection was closed.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Disconnect closes the connection, without the broker publishing the will.
+func (c *Client) Disconnect() error {
+	err := c.write(packet{kind: disconnect})
+	c.close(ErrClosed)
+	return err
+}
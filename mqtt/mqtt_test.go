@@ -0,0 +1,337 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func newBroker(t *testing.T) *Broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := NewBroker(listener)
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+func dial(t *testing.T, opts Options) *Client {
+	client, err := Connect(opts)
+	if err != nil {
+		t.Fatalf("Connect(%+v) = %v", opts, err)
+	}
+	t.Cleanup(func() { client.Disconnect() })
+	return client
+}
+
+func listen(t *testing.T, client *Client, filter string, qos byte) <-chan Message {
+	messages := make(chan Message, 16)
+	if err := client.Subscribe(filter, qos, func(m Message) { messages <- m }); err != nil {
+		t.Fatalf("Subscribe(%s) = %v", filter, err)
+	}
+	return messages
+}
+
+func receive(t *testing.T, messages <-chan Message) Message {
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return Message{}
+	}
+}
+
+func TestMatch(t *testing.T) {
+
+	matches := make(map[[2]string]bool)
+	matches[[2]string{"lights/kitchen", "lights/kitchen"}] = true
+	matches[[2]string{"lights/kitchen", "lights/office"}] = false
+	matches[[2]string{"lights/+", "lights/kitchen"}] = true
+	matches[[2]string{"lights/+", "lights/kitchen/set"}] = false
+	matches[[2]string{"lights/+/set", "lights/kitchen/set"}] = true
+	matches[[2]string{"lights/#", "lights/kitchen/set"}] = true
+	matches[[2]string{"lights/#", "lights"}] = true
+	matches[[2]string{"#", "lights/kitchen"}] = true
+	matches[[2]string{"lights/kitchen/set", "lights/kitchen"}] = false
+
+	for k, v := range matches {
+		if got := Match(k[0], k[1]); got != v {
+			t.Errorf("Match(%s, %s) = %v, expected %v", k[0], k[1], got, v)
+		}
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+
+	broker := newBroker(t)
+	subscriber := dial(t, Options{Address: broker.Addr(), ClientID: "subscriber"})
+	publisher := dial(t, Options{Address: broker.Addr(), ClientID: "publisher", KeepAlive: time.Second})
+	messages := listen(t, subscriber, "lights/+/state", 2)
+
+	for qos := byte(0); qos <= 2; qos++ {
+		payload := []byte{'0' + qos}
+		if err := publisher.Publish("lights/kitchen/state", payload, qos, false); err != nil {
+			t.Fatalf("Publish(qos %d) = %v", qos, err)
+		}
+		m := receive(t, messages)
+		expectedQoS := qos
+		if expectedQoS > 1 {
+			expectedQoS = 1
+		}
+		if m.Topic != "lights/kitchen/state" || string(m.Payload) != string(payload) || m.QoS != expectedQoS || m.Retain {
+			t.Errorf("message published with qos %d = %+v", qos, m)
+		}
+	}
+	if err := publisher.Publish("lights/kitchen", []byte("ignored"), 1, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-messages:
+		t.Errorf("unexpected message %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := publisher.Publish("lights/kitchen", nil, 3, false); err == nil {
+		t.Errorf("Publish(qos 3) succeeded")
+	}
+	if client, err := Connect(Options{Address: broker.Addr(), ClientID: "anonymous", Password: "secret"}); err == nil {
+		client.Disconnect()
+		t.Errorf("Connect() with a password without a user name succeeded")
+	}
+}
+
+func TestRetained(t *testing.T) {
+
+	broker := newBroker(t)
+	publisher := dial(t, Options{Address: broker.Addr(), ClientID: "publisher"})
+	if err := publisher.Publish("lights/kitchen", []byte("2700"), 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := broker.Retained("lights/kitchen"); !ok || string(m.Payload) != "2700" {
+		t.Errorf("broker.Retained(lights/kitchen) = %+v, %v", m, ok)
+	}
+
+	subscriber := dial(t, Options{Address: broker.Addr(), ClientID: "subscriber"})
+	messages := listen(t, subscriber, "lights/#", 1)
+	if m := receive(t, messages); string(m.Payload) != "2700" || !m.Retain {
+		t.Errorf("retained message = %+v", m)
+	}
+
+	if err := publisher.Publish("lights/kitchen", nil, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, messages)
+	if m, ok := broker.Retained("lights/kitchen"); ok {
+		t.Errorf("broker.Retained(lights/kitchen) = %+v after empty payload", m)
+	}
+}
+
+func TestWill(t *testing.T) {
+
+	broker := newBroker(t)
+	subscriber := dial(t, Options{Address: broker.Addr(), ClientID: "subscriber"})
+	messages := listen(t, subscriber, "status", 1)
+
+	will := &Message{Topic: "status", Payload: []byte("offline"), QoS: 1, Retain: true}
+	client, err := Connect(Options{Address: broker.Addr(), ClientID: "client", Will: will})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect()
+	select {
+	case m := <-messages:
+		t.Errorf("will published on clean disconnect: %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	client, err = Connect(Options{Address: broker.Addr(), ClientID: "client", Will: will})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.conn.Close()
+	if m := receive(t, messages); m.Topic != "status" || string(m.Payload) != "offline" {
+		t.Errorf("will = %+v", m)
+	}
+	if _, ok := broker.Retained("status"); !ok {
+		t.Errorf("retained will not kept")
+	}
+}
+
+func TestTLS(t *testing.T) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "broker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	broker := NewBroker(tls.NewListener(listener, config))
+	defer broker.Close()
+
+	if _, err := Connect(Options{Address: broker.Addr(), ClientID: "untrusted", TLS: &tls.Config{}, Timeout: time.Second}); err == nil {
+		t.Errorf("Connect() succeeded with an untrusted certificate")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	client := dial(t, Options{Address: broker.Addr(), ClientID: "client", TLS: &tls.Config{RootCAs: roots}})
+	messages := listen(t, client, "lights/kitchen", 1)
+	if err := client.Publish("lights/kitchen", []byte("2700"), 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, messages); string(m.Payload) != "2700" {
+		t.Errorf("message over TLS = %+v", m)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+
+	broker := newBroker(t)
+	address := broker.Addr()
+	subscriber := dial(t, Options{Address: address, ClientID: "subscriber", Reconnect: true, Timeout: time.Second})
+	messages := listen(t, subscriber, "lights/#", 1)
+	broker.Close()
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker = NewBroker(listener)
+	defer broker.Close()
+	publisher := dial(t, Options{Address: address, ClientID: "publisher"})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := publisher.Publish("lights/kitchen", []byte("2700"), 0, false); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-messages:
+			if string(m.Payload) != "2700" {
+				t.Errorf("message after reconnection = %+v", m)
+			}
+			return
+		case <-subscriber.Done():
+			t.Fatalf("connection closed: %v", subscriber.Err())
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscription not renewed after reconnection")
+		}
+	}
+}
+
+// accept accepts a client connection on behalf of a broker.
+func accept(t *testing.T, listener net.Listener) (net.Conn, *bufio.Reader) {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	if p, err := readPacket(r); err != nil || p.kind != connect {
+		t.Fatalf("CONNECT = %+v, %v", p, err)
+	}
+	conn.Write(packet{kind: connack, body: []byte{0, 0}}.encode())
+	return conn, r
+}
+
+// expect reads a packet of the given kind and returns its packet identifier.
+func expect(t *testing.T, r *bufio.Reader, kind byte) uint16 {
+	p, err := readPacket(r)
+	if err != nil || p.kind != kind {
+		t.Fatalf("packet = %+v, %v, expected kind %d", p, err, kind)
+	}
+	return (&reader{b: p.body}).uint16()
+}
+
+func TestSubscribeAndQoS2(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	connected := make(chan *Client, 1)
+	go func() {
+		client, err := Connect(Options{Address: listener.Addr().String(), ClientID: "client", Timeout: time.Second})
+		if err != nil {
+			t.Error(err)
+		}
+		connected <- client
+	}()
+	conn, r := accept(t, listener)
+	client := <-connected
+	if client == nil {
+		t.FailNow()
+	}
+	defer client.Disconnect()
+
+	// A refused subscription leaves no handler behind
+	messages := make(chan Message, 16)
+	subscribed := make(chan error, 1)
+	go func() { subscribed <- client.Subscribe("refused", 0, func(m Message) { messages <- m }) }()
+	id := expect(t, r, subscribe)
+	conn.Write(packet{kind: suback, body: append(appendUint16(nil, id), 0x80)}.encode())
+	if err := <-subscribed; err == nil {
+		t.Errorf("Subscribe(refused) succeeded")
+	}
+	go func() { subscribed <- client.Subscribe("lights/#", 2, func(m Message) { messages <- m }) }()
+	id = expect(t, r, subscribe)
+	conn.Write(packet{kind: suback, body: append(appendUint16(nil, id), 2)}.encode())
+	if err := <-subscribed; err != nil {
+		t.Fatalf("Subscribe(lights/#) = %v", err)
+	}
+	conn.Write(publishPacket(Message{Topic: "refused", Payload: []byte("ignored")}, 0).encode())
+
+	// QoS 2 messages are delivered once, on PUBREL
+	m := Message{Topic: "lights/kitchen", Payload: []byte("2700"), QoS: 2}
+	for i := 0; i < 2; i++ {
+		conn.Write(publishPacket(m, 7).encode())
+		if id := expect(t, r, pubrec); id != 7 {
+			t.Errorf("PUBREC for packet %d, expected 7", id)
+		}
+	}
+	select {
+	case m := <-messages:
+		t.Errorf("message %+v delivered before PUBREL", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Write(ackPacket(pubrel, 7).encode())
+	if id := expect(t, r, pubcomp); id != 7 {
+		t.Errorf("PUBCOMP for packet %d, expected 7", id)
+	}
+	if m := receive(t, messages); m.Topic != "lights/kitchen" || string(m.Payload) != "2700" {
+		t.Errorf("QoS 2 message = %+v", m)
+	}
+	select {
+	case m := <-messages:
+		t.Errorf("unexpected message %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,177 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Control packet types of MQTT 3.1.1.
+const (
+	connect     = 1
+	connack     = 2
+	publish     = 3
+	puback      = 4
+	pubrec      = 5
+	pubrel      = 6
+	pubcomp     = 7
+	subscribe   = 8
+	suback      = 9
+	unsubscribe = 10
+	unsuback    = 11
+	pingreq     = 12
+	pingresp    = 13
+	disconnect  = 14
+)
+
+var errMalformed = errors.New("mqtt: malformed packet")
+
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(b&127) * multiplier
+		if b&128 == 0 {
+			break
+		}
+		if i == 3 {
+			return packet{}, errMalformed
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{kind: header >> 4, flags: header & 15, body: body}, nil
+}
+
+func (p packet) encode() []byte {
+	b := []byte{p.kind<<4 | p.flags}
+	length := len(p.body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 128
+		}
+		b = append(b, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(b, p.body...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUint16(b, uint16(len(s))), s...)
+}
+
+// reader decodes the variable header and payload of a packet.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint16() uint16 {
+	if len(r.b) < 2 {
+		r.err = errMalformed
+		return 0
+	}
+	v := uint16(r.b[0])<<8 | uint16(r.b[1])
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	n := int(r.uint16())
+	if len(r.b) < n {
+		r.err = errMalformed
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+func (r *reader) byte() byte {
+	if len(r.b) < 1 {
+		r.err = errMalformed
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func publishPacket(m Message, id uint16) packet {
+	flags := m.QoS << 1
+	if m.Retain {
+		flags |= 1
+	}
+	body := appendString(nil, m.Topic)
+	if m.QoS > 0 {
+		body = appendUint16(body, id)
+	}
+	return packet{kind: publish, flags: flags, body: append(body, m.Payload...)}
+}
+
+func parsePublish(p packet) (Message, uint16, error) {
+	r := reader{b: p.body}
+	m := Message{Topic: r.string(), QoS: (p.flags >> 1) & 3, Retain: p.flags&1 == 1}
+	var id uint16
+	if m.QoS > 0 {
+		id = r.uint16()
+	}
+	if r.err != nil || m.QoS > 2 {
+		return Message{}, 0, errMalformed
+	}
+	m.Payload = r.b
+	return m, id, nil
+}
+
+func ackPacket(kind byte, id uint16) packet {
+	var flags byte
+	if kind == pubrel {
+		flags = 2
+	}
+	return packet{kind: kind, flags: flags, body: appendUint16(nil, id)}
+}
+
+// Match reports whether a topic matches a filter, in which "+" matches a
+// level and a trailing "#" any number of levels.
+func Match(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/mqtt"
+)
+
+// newTestBroker returns an embedded broker, a client connected with a will and
+// a remote client.
+func newTestBroker(t *testing.T) (*mqtt.Broker, *mqtt.Client, *mqtt.Client) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := mqtt.NewBroker(listener)
+	t.Cleanup(func() { broker.Close() })
+	will := &mqtt.Message{Topic: "circadian/status", Payload: []byte("offline"), Retain: true}
+	client, err := mqtt.Connect(mqtt.Options{Address: broker.Addr(), ClientID: "circadian", Will: will})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect() })
+	remote, err := mqtt.Connect(mqtt.Options{Address: broker.Addr(), ClientID: "remote"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { remote.Disconnect() })
+	return broker, client, remote
+}
+
+func newMQTTOutput(t *testing.T, controller *Controller) (*MQTTOutput, *mqtt.Broker, *mqtt.Client) {
+	broker, client, remote := newTestBroker(t)
+	output := &MQTTOutput{
+		Client:       client,
+		Controller:   controller,
+		Topic:        "circadian/{zone}",
+		CommandTopic: "circadian/{zone}/set",
+		QoS:          1,
+		Retain:       true,
+		Profiles:     map[string]Profile{"dim": {Name: "dim", BrightnessCurve: Curve{{0, 10}}}},
+	}
+	return output, broker, remote
+}
+
+func TestMQTTOutputPublish(t *testing.T) {
+
+	// Paris UTC
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	controller := NewController(48.87, 2.67, time.Minute, Zone{Name: "kitchen", Profile: DefaultProfile, Transition: 2 * time.Second})
+	output, broker, _ := newMQTTOutput(t, controller)
+	lighting := DefaultProfile.Lighting(date, 48.87, 2.67)
+	setpoint := Setpoint{Zone: "kitchen", Lighting: lighting, Transition: 2 * time.Second}
+
+	if err := output.Publish(setpoint); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := broker.Retained("circadian/kitchen")
+	var got MQTTSetpoint
+	if !ok || json.Unmarshal(m.Payload, &got) != nil {
+		t.Fatalf("circadian/kitchen = %q, %v", m.Payload, ok)
+	}
+	expected := MQTTSetpoint{ColorTemp: lighting.ColorTemp, Brightness: lighting.Brightness, Transition: 2}
+	if got != expected {
+		t.Errorf("circadian/kitchen = %+v, expected %+v", got, expected)
+	}
+
+	output.Format = PlainPayload
+	output.Topic = "lights/{zone}"
+	if err := output.Publish(setpoint); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]int64)
+	values["lights/kitchen/colorTemp"] = lighting.ColorTemp
+	values["lights/kitchen/brightness"] = lighting.Brightness
+	for k, v := range values {
+		m, ok := broker.Retained(k)
+		if got, err := strconv.ParseInt(string(m.Payload), 10, 64); !ok || err != nil || got != v {
+			t.Errorf("%s = %q, expected %d", k, m.Payload, v)
+		}
+	}
+
+	// Run ends with the channel of setpoints
+	channel := make(chan Setpoint, 1)
+	channel <- setpoint
+	close(channel)
+	if err := output.Run(context.Background(), channel); err != nil {
+		t.Errorf("output.Run() with a closed channel = %v, expected nil", err)
+	}
+}
+
+func TestMQTTOutputCommands(t *testing.T) {
+
+	// Paris UTC
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	controller := NewController(48.87, 2.67, time.Minute, Zone{Name: "kitchen", Profile: DefaultProfile})
+	controller.Clock = NewFakeClock(date)
+	controller.Overrides = &OverrideManager{Hold: time.Hour}
+	output, _, remote := newMQTTOutput(t, controller)
+	failures := make(chan error, 1)
+	if err := output.Subscribe(func(err error) { failures <- err }); err != nil {
+		t.Fatal(err)
+	}
+	setpoints := make(chan MQTTSetpoint, 16)
+	err := remote.Subscribe("circadian/+", 1, func(m mqtt.Message) {
+		var setpoint MQTTSetpoint
+		json.Unmarshal(m.Payload, &setpoint)
+		setpoints <- setpoint
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	channel := make(chan Setpoint)
+	go controller.Run(ctx, channel)
+	go output.Run(ctx, channel)
+
+	receive := func() MQTTSetpoint {
+		select {
+		case setpoint := <-setpoints:
+			return setpoint
+		case err := <-failures:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no setpoint published")
+		}
+		return MQTTSetpoint{}
+	}
+	circadian := DefaultProfile.Lighting(date, 48.87, 2.67)
+	commands := []struct {
+		payload  string
+		expected MQTTSetpoint
+	}{
+		{``, MQTTSetpoint{ColorTemp: circadian.ColorTemp, Brightness: circadian.Brightness}},
+		{`{"brightness": 20}`, MQTTSetpoint{ColorTemp: circadian.ColorTemp, Brightness: 20}},
+		{`{"colorTemp": 2200}`, MQTTSetpoint{ColorTemp: 2200, Brightness: 20}},
+		{`{"resume": true}`, MQTTSetpoint{ColorTemp: circadian.ColorTemp, Brightness: circadian.Brightness}},
+		{`{"profile": "dim"}`, MQTTSetpoint{ColorTemp: circadian.ColorTemp, Brightness: 10}},
+	}
+	for _, command := range commands {
+		if command.payload != "" {
+			if err := remote.Publish("circadian/kitchen/set", []byte(command.payload), 1, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := receive(); got != command.expected {
+			t.Errorf("setpoint after %s = %+v, expected %+v", command.payload, got, command.expected)
+		}
+	}
+
+	for _, payload := range []string{`{"brightness": 101}`, `{"brightness": -1}`, `{"colorTemp": -2700}`} {
+		remote.Publish("circadian/kitchen/set", []byte(payload), 1, false)
+		select {
+		case err := <-failures:
+			t.Logf("command %s: %v", payload, err)
+		case <-time.After(5 * time.Second):
+			t.Errorf("command %s accepted", payload)
+		}
+	}
+
+	remote.Publish("circadian/garage/set", []byte(`{"resume": true}`), 1, false)
+	select {
+	case err := <-failures:
+		t.Logf("command on an unknown zone: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("command on an unknown zone accepted")
+	}
+}
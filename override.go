@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+// Override is a manual setting of a light or zone, held until Until.
+type Override struct {
+	Lighting Lighting
+	Start    time.Time
+	Until    time.Time
+}
+
+// OverrideManager holds the manual settings of lights or zones. A setting is
+// held for Hold, or until the next solar event when Hold is 0, then fades back
+// into the circadian lighting over Fade. It is safe for concurrent use.
+type OverrideManager struct {
+	Hold      time.Duration
+	Fade      time.Duration
+	Latitude  float64
+	Longitude float64
+	mu        sync.Mutex
+	overrides map[string]Override
+}
+
+// Set records a manual setting of a light or zone at the given date.
+func (m *OverrideManager) Set(zone string, lighting Lighting, date time.Time) {
+	until := date.Add(m.Hold)
+	if m.Hold == 0 {
+		until = nextSolarEvent(date, m.Latitude, m.Longitude)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.overrides == nil {
+		m.overrides = make(map[string]Override)
+	}
+	m.overrides[zone] = Override{Lighting: lighting, Start: date, Until: until}
+}
+
+// Clear resumes the circadian lighting of a light or zone right away.
+func (m *OverrideManager) Clear(zone string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.overrides, zone)
+}
+
+// Override returns the manual setting of a light or zone still held or fading
+// at the given date.
+func (m *OverrideManager) Override(zone string, date time.Time) (Override, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	override, ok := m.overrides[zone]
+	if ok && !date.Before(override.Until.Add(m.Fade)) {
+		delete(m.overrides, zone)
+		return Override{}, false
+	}
+	return override, ok
+}
+
+// Apply returns the lighting of a light or zone at the given date: its manual
+// setting while held, then fading into the circadian lighting.
+func (m *OverrideManager) Apply(zone string, circadian Lighting, date time.Time) Lighting {
+	override, ok := m.Override(zone, date)
+	if !ok {
+		return circadian
+	}
+	if date.Before(override.Until) {
+		return override.Lighting
+	}
+	return blend(override.Lighting, circadian, float64(date.Sub(override.Until))/float64(m.Fade))
+}
+
+// blend returns the lighting a fraction of the way from one lighting to
+// another, linear in mireds for the color temperature. The color temperature is
+// the one of to when either has none.
+func blend(from Lighting, to Lighting, fraction float64) Lighting {
+	lighting := Lighting{
+		ColorTemp:  to.ColorTemp,
+		Brightness: int64(math.Round(float64(from.Brightness) + fraction*float64(to.Brightness-from.Brightness))),
+	}
+	if from.ColorTemp > 0 && to.ColorTemp > 0 {
+		mired := color.Mired(float64(from.ColorTemp)) + fraction*(color.Mired(float64(to.ColorTemp))-color.Mired(float64(from.ColorTemp)))
+		lighting.ColorTemp = int64(math.Round(color.Kelvin(mired)))
+	}
+	if lighting.ColorTemp > 0 && (from.Chromaticity != (color.XY{}) || to.Chromaticity != (color.XY{})) {
+		lighting.Chromaticity = color.CCTToXY(float64(lighting.ColorTemp), from.duv()+fraction*(to.duv()-from.duv()))
+	}
+	return lighting
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+func TestOverrideManager(t *testing.T) {
+
+	manager := OverrideManager{Hold: time.Hour, Fade: 30 * time.Minute}
+	start := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	manual := Lighting{ColorTemp: 2000, Brightness: 20}
+	circadian := Lighting{ColorTemp: 5000, Brightness: 100}
+	manager.Set("kitchen", manual, start)
+
+	dates := make(map[time.Time]Lighting)
+	dates[start] = manual
+	dates[start.Add(59*time.Minute)] = manual
+	dates[start.Add(75*time.Minute)] = Lighting{ColorTemp: 2857, Brightness: 60}
+	dates[start.Add(90*time.Minute)] = circadian
+
+	for _, k := range []time.Time{start, start.Add(59 * time.Minute), start.Add(75 * time.Minute), start.Add(90 * time.Minute)} {
+		v := dates[k]
+		got := manager.Apply("kitchen", circadian, k)
+		if got != v {
+			t.Errorf("manager.Apply(%v) = %+v, expected %+v", k, got, v)
+		} else {
+			t.Logf("manager.Apply(%v) = %+v, expected %+v", k, got, v)
+		}
+	}
+
+	if _, ok := manager.Override("kitchen", start); ok {
+		t.Errorf("manager.Override() after the fade is still active")
+	}
+	if got := manager.Apply("bedroom", circadian, start); got != circadian {
+		t.Errorf("manager.Apply() without override = %+v, expected %+v", got, circadian)
+	}
+
+	manager.Set("kitchen", manual, start)
+	manager.Clear("kitchen")
+	if got := manager.Apply("kitchen", circadian, start); got != circadian {
+		t.Errorf("manager.Apply() after Clear = %+v, expected %+v", got, circadian)
+	}
+
+}
+
+func TestOverrideManagerSolarEvent(t *testing.T) {
+
+	// Paris UTC, held until solar noon
+	manager := OverrideManager{Latitude: 48.87, Longitude: 2.67}
+	start := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	manager.Set("kitchen", Lighting{ColorTemp: 2000, Brightness: 20}, start)
+
+	override, ok := manager.Override("kitchen", start)
+	if expected := solarNoon(start, 2.67); !ok || !override.Until.Equal(expected) {
+		t.Errorf("manager.Override() = %+v, %t, expected until %v", override, ok, expected)
+	}
+	if _, ok := manager.Override("kitchen", override.Until); ok {
+		t.Errorf("manager.Override() at solar noon is still active")
+	}
+
+}
+
+func TestOverrideManagerConcurrency(t *testing.T) {
+
+	manager := OverrideManager{Hold: time.Hour}
+	start := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			manager.Set("kitchen", Lighting{ColorTemp: 2000}, start)
+			manager.Apply("kitchen", Lighting{ColorTemp: 5000}, start)
+			manager.Clear("kitchen")
+		}()
+	}
+	wg.Wait()
+
+}
+
+func TestBlend(t *testing.T) {
+
+	from := Lighting{ColorTemp: 2000, Brightness: 0, Chromaticity: color.CCTToXY(2000, -0.004)}
+	to := Lighting{ColorTemp: 4000, Brightness: 100, Chromaticity: color.CCTToXY(4000, 0.002)}
+	fractions := make(map[float64]Lighting)
+	fractions[0] = Lighting{ColorTemp: 2000, Brightness: 0}
+	fractions[0.5] = Lighting{ColorTemp: 2667, Brightness: 50}
+	fractions[1] = Lighting{ColorTemp: 4000, Brightness: 100}
+
+	for k, v := range fractions {
+		got := blend(from, to, k)
+		_, duv := color.XYToCCT(got.Chromaticity)
+		expected := -0.004 + k*0.006
+		if got.ColorTemp != v.ColorTemp || got.Brightness != v.Brightness || duv-expected > 0.0001 || expected-duv > 0.0001 {
+			t.Errorf("blend(%f) = %+v with Duv %f, expected %+v with Duv %f", k, got, duv, v, expected)
+		} else {
+			t.Logf("blend(%f) = %+v with Duv %f, expected %+v with Duv %f", k, got, duv, v, expected)
+		}
+	}
+
+	// A brightness only override keeps the circadian color temperature
+	dimmed := Lighting{Brightness: 20}
+	got := blend(dimmed, to, 0.5)
+	if _, duv := color.XYToCCT(got.Chromaticity); got.ColorTemp != 4000 || got.Brightness != 60 || duv-0.001 > 0.0001 || 0.001-duv > 0.0001 {
+		t.Errorf("blend(%+v, 0.5) = %+v with Duv %f, expected 4000 K, 60%% and Duv 0.001", dimmed, got, duv)
+	}
+	if got, expected := blend(to, Lighting{Brightness: 20}, 0.5), (Lighting{Brightness: 60}); got != expected {
+		t.Errorf("blend(%+v, 0.5) without a color temperature = %+v, expected %+v", to, got, expected)
+	}
+
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+// CurvePoint sets a value at a sun elevation in degrees.
+type CurvePoint struct {
+	Elevation float64
+	Value     float64
+}
+
+// Curve is a function of sun elevation, linear between its points which must
+// be sorted by increasing elevation, and constant beyond them. An empty curve
+// is 0.
+type Curve []CurvePoint
+
+func (c Curve) at(elevation float64) float64 {
+	if len(c) == 0 {
+		return 0
+	}
+	if elevation <= c[0].Elevation {
+		return c[0].Value
+	}
+	for i := 1; i < len(c); i++ {
+		if elevation <= c[i].Elevation {
+			return c[i-1].Value + (elevation-c[i-1].Elevation)*(c[i].Value-c[i-1].Value)/(c[i].Elevation-c[i-1].Elevation)
+		}
+	}
+	return c[len(c)-1].Value
+}
+
+// Lighting is a color temperature in Kelvin, a brightness percentage and the
+// exact chromaticity to drive a light with.
+type Lighting struct {
+	ColorTemp    int64
+	Brightness   int64
+	Chromaticity color.XY
+}
+
+// duv returns the distance of the lighting chromaticity to the Planckian
+// locus, 0 when it has no chromaticity.
+func (l Lighting) duv() float64 {
+	if l.Chromaticity == (color.XY{}) {
+		return 0
+	}
+	_, duv := color.XYToCCT(l.Chromaticity)
+	return duv
+}
+
+// rgb returns the gamma encoded sRGB color of the lighting, scaled so that its
+// brightest component is 1.
+func (l Lighting) rgb() color.RGB {
+	xy := l.Chromaticity
+	if xy == (color.XY{}) {
+		xy = color.CCTToXY(float64(l.ColorTemp), 0)
+	}
+	return xy.XYZ(1).LinearRGB().Normalize().SRGB()
+}
+
+// Profile describes how the lights follow the sun. An empty ColorTempCurve or
+// BrightnessCurve falls back to the ColorTemp and Brightness functions, and an
+// empty DuvCurve keeps the lights on the Planckian locus. Compensation selects
+// how the sun is followed at high latitudes and Shift moves the curves to
+// follow a person rather than the sun.
+type Profile struct {
+	Name              string
+	ColorTempCurve    Curve
+	BrightnessCurve   Curve
+	DuvCurve          Curve
+	Compensation      Compensation
+	ReferenceLatitude float64
+	MinDayLength      time.Duration
+	MaxDayLength      time.Duration
+	Shift             TimeShift
+}
+
+// DefaultProfile follows the ColorTemp and Brightness functions, slightly pink
+// like candlelight around twilight and slightly green like daylight during the
+// day.
+var DefaultProfile = Profile{
+	Name:     "default",
+	DuvCurve: Curve{{-6, -0.005}, {-0.833, -0.003}, {10, 0}, {30, 0.003}},
+}
+
+func (p Profile) ColorTemp(date time.Time, latitude float64, longitude float64) int64 {
+	return int64(math.Round(p.colorTemp(date, latitude, longitude)))
+}
+
+// colorTemp returns the color temperature of the profile before rounding.
+func (p Profile) colorTemp(date time.Time, latitude float64, longitude float64) float64 {
+	date = p.Shift.Time(date, longitude)
+	latitude = p.latitude(date, latitude)
+	if len(p.ColorTempCurve) == 0 {
+		return float64(ColorTemp(date, latitude, longitude))
+	}
+	return p.ColorTempCurve.at(toDegrees(elevation(date, latitude, longitude)))
+}
+
+func (p Profile) Brightness(date time.Time, latitude float64, longitude float64) int64 {
+	date = p.Shift.Time(date, longitude)
+	latitude = p.latitude(date, latitude)
+	if len(p.BrightnessCurve) == 0 {
+		return Brightness(date, latitude, longitude)
+	}
+	return int64(math.Round(p.BrightnessCurve.at(toDegrees(elevation(date, latitude, longitude)))))
+}
+
+func (p Profile) Duv(date time.Time, latitude float64, longitude float64) float64 {
+	if len(p.DuvCurve) == 0 {
+		return 0
+	}
+	date = p.Shift.Time(date, longitude)
+	latitude = p.latitude(date, latitude)
+	return p.DuvCurve.at(toDegrees(elevation(date, latitude, longitude)))
+}
+
+// Chromaticity returns the exact CIE 1931 xy coordinates of the profile color
+// temperature and Duv, for fixtures able to reproduce a tint.
+func (p Profile) Chromaticity(date time.Time, latitude float64, longitude float64) color.XY {
+	return color.CCTToXY(p.colorTemp(date, latitude, longitude), p.Duv(date, latitude, longitude))
+}
+
+// Lighting returns the profile color temperature, brightness and chromaticity.
+func (p Profile) Lighting(date time.Time, latitude float64, longitude float64) Lighting {
+	return Lighting{
+		ColorTemp:    p.ColorTemp(date, latitude, longitude),
+		Brightness:   p.Brightness(date, latitude, longitude),
+		Chromaticity: p.Chromaticity(date, latitude, longitude),
+	}
+}
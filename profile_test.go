@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+func TestCurve(t *testing.T) {
+
+	curve := Curve{{-6, 2000}, {0, 3000}, {30, 6000}}
+	elevations := make(map[float64]float64)
+	elevations[-90] = 2000
+	elevations[-6] = 2000
+	elevations[-3] = 2500
+	elevations[0] = 3000
+	elevations[15] = 4500
+	elevations[90] = 6000
+
+	for k, v := range elevations {
+		got := curve.at(k)
+		if math.Abs(got-v) > 1e-9 {
+			t.Errorf("curve.at(%f) = %f, expected %f", k, got, v)
+		} else {
+			t.Logf("curve.at(%f) = %f, expected %f", k, got, v)
+		}
+	}
+
+	if got := (Curve{}).at(10); got != 0 {
+		t.Errorf("Curve{}.at(10) = %f, expected 0", got)
+	}
+
+}
+
+func TestDefaultProfile(t *testing.T) {
+
+	// Paris UTC
+	latitude := 48.87
+	longitude := 2.67
+	for h := 0; h < 24; h++ {
+		d := time.Date(2021, 6, 21, h, 0, 0, 0, time.UTC)
+		if got, expected := DefaultProfile.ColorTemp(d, latitude, longitude), ColorTemp(d, latitude, longitude); got != expected {
+			t.Errorf("DefaultProfile.ColorTemp(%v) = %d, expected %d", d, got, expected)
+		}
+		if got, expected := DefaultProfile.Brightness(d, latitude, longitude), Brightness(d, latitude, longitude); got != expected {
+			t.Errorf("DefaultProfile.Brightness(%v) = %d, expected %d", d, got, expected)
+		}
+	}
+
+	duvs := make(map[time.Time]float64)
+	duvs[time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC)] = -0.005
+	duvs[time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC)] = 0.003
+
+	for k, v := range duvs {
+		got := DefaultProfile.Duv(k, latitude, longitude)
+		if math.Abs(got-v) > 1e-9 {
+			t.Errorf("DefaultProfile.Duv(%v) = %f, expected %f", k, got, v)
+		} else {
+			t.Logf("DefaultProfile.Duv(%v) = %f, expected %f", k, got, v)
+		}
+		cct, duv := color.XYToCCT(DefaultProfile.Chromaticity(k, latitude, longitude))
+		if math.Abs(cct-float64(ColorTemp(k, latitude, longitude))) > 5 || math.Abs(duv-v) > 0.0001 {
+			t.Errorf("DefaultProfile.Chromaticity(%v) has CCT %f and Duv %f, expected %d and %f", k, cct, duv, ColorTemp(k, latitude, longitude), v)
+		}
+	}
+
+}
+
+func TestProfileCurves(t *testing.T) {
+
+	// Paris UTC
+	latitude := 48.87
+	longitude := 2.67
+	profile := Profile{
+		Name:            "office",
+		ColorTempCurve:  Curve{{-6, 2700}, {30, 6500}},
+		BrightnessCurve: Curve{{-6, 10}, {0, 80}},
+	}
+	night := time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC)
+	noon := time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC)
+
+	if got := profile.ColorTemp(night, latitude, longitude); got != 2700 {
+		t.Errorf("profile.ColorTemp(%v) = %d, expected 2700", night, got)
+	}
+	if got := profile.ColorTemp(noon, latitude, longitude); got != 6500 {
+		t.Errorf("profile.ColorTemp(%v) = %d, expected 6500", noon, got)
+	}
+	if got := profile.Brightness(night, latitude, longitude); got != 10 {
+		t.Errorf("profile.Brightness(%v) = %d, expected 10", night, got)
+	}
+	if got := profile.Brightness(noon, latitude, longitude); got != 80 {
+		t.Errorf("profile.Brightness(%v) = %d, expected 80", noon, got)
+	}
+	if got := profile.Duv(noon, latitude, longitude); got != 0 {
+		t.Errorf("profile.Duv(%v) = %f, expected 0", noon, got)
+	}
+
+	// Empty curves fall back like nil ones.
+	empty := Profile{ColorTempCurve: Curve{}, BrightnessCurve: Curve{}, DuvCurve: Curve{}}
+	if got, expected := empty.Lighting(noon, latitude, longitude), (Profile{}).Lighting(noon, latitude, longitude); got != expected {
+		t.Errorf("empty.Lighting(%v) = %v, expected %v", noon, got, expected)
+	}
+
+	// The chromaticity follows the exact color temperature, not the rounded one.
+	exact := Profile{ColorTempCurve: Curve{{-90, 2700.4}, {90, 2700.4}}}
+	if got, expected := exact.Chromaticity(noon, latitude, longitude), color.CCTToXY(2700.4, 0); got != expected {
+		t.Errorf("exact.Chromaticity(%v) = %v, expected %v", noon, got, expected)
+	}
+
+}
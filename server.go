@@ -0,0 +1,718 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server serves the sun position, the solar events and the lighting of a
+// controller as JSON over HTTP, for applications not written in Go:
+//
+//	GET /v1/sun?lat=&lon=&t=
+//	GET /v1/events?lat=&lon=&date=&tz=
+//	GET /v1/lighting?zone=&t=
+//	GET /v1/lighting?profile=&lat=&lon=&t=
+//	GET, POST /v1/profiles
+//	GET, PUT, DELETE /v1/profiles/{name}
+//
+// Coordinates default to the location of the controller, times to now on its
+// Clock, or on the real clock without a controller, and dates to today in UTC or in the time zone tz. Profiles created or
+// replaced are applied to the zones following a profile of the same name.
+type Server struct {
+	Controller *Controller
+	mu         sync.Mutex
+	profiles   map[string]Profile
+}
+
+// NewServer returns a server for the controller, with DefaultProfile and the
+// given profiles.
+func NewServer(controller *Controller, profiles ...Profile) *Server {
+	s := &Server{Controller: controller, profiles: map[string]Profile{DefaultProfile.Name: DefaultProfile}}
+	for _, profile := range profiles {
+		s.profiles[profile.Name] = profile
+	}
+	return s
+}
+
+// Profile returns the profile with the given name.
+func (s *Server) Profile(name string) (Profile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	profile, ok := s.profiles[name]
+	return profile, ok
+}
+
+// apiError is an error answered with an HTTP status.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+func notFound(format string, a ...interface{}) error {
+	return &apiError{http.StatusNotFound, fmt.Sprintf(format, a...)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var e *apiError
+	if errors.As(err, &e) {
+		status = e.status
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var handler func(r *http.Request) (int, interface{}, error)
+	allowed := []string{http.MethodGet}
+	switch {
+	case r.URL.Path == "/v1/sun":
+		handler = s.sun
+	case r.URL.Path == "/v1/events":
+		handler = s.events
+	case r.URL.Path == "/v1/lighting":
+		handler = s.lighting
+	case r.URL.Path == "/v1/profiles":
+		handler, allowed = s.profileList, []string{http.MethodGet, http.MethodPost}
+	case strings.HasPrefix(r.URL.Path, "/v1/profiles/"):
+		handler, allowed = s.profile, []string{http.MethodGet, http.MethodPut, http.MethodDelete}
+	default:
+		writeError(w, notFound("no such endpoint %s", r.URL.Path))
+		return
+	}
+	ok := false
+	for _, method := range allowed {
+		ok = ok || r.Method == method
+	}
+	if !ok {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, &apiError{http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method)})
+		return
+	}
+	status, v, err := handler(r)
+	if err != nil {
+		writeError(w, err)
+	} else if v == nil {
+		w.WriteHeader(status)
+	} else {
+		writeJSON(w, status, v)
+	}
+}
+
+// validCoordinates reports whether a latitude and longitude in degrees are
+// within ±90 and ±180.
+func validCoordinates(latitude float64, longitude float64) bool {
+	return latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180
+}
+
+// coordinates returns the latitude and longitude of a request, the location of
+// the controller when both are missing.
+func (s *Server) coordinates(r *http.Request) (float64, float64, error) {
+	lat, lon := r.URL.Query().Get("lat"), r.URL.Query().Get("lon")
+	if lat == "" && lon == "" && s.Controller != nil {
+		latitude, longitude := s.Controller.Location()
+		return latitude, longitude, nil
+	}
+	latitude, err := strconv.ParseFloat(lat, 64)
+	if err != nil || !validCoordinates(latitude, 0) {
+		return 0, 0, badRequest("invalid latitude %q, expected degrees between -90 and 90", lat)
+	}
+	longitude, err := strconv.ParseFloat(lon, 64)
+	if err != nil || !validCoordinates(0, longitude) {
+		return 0, 0, badRequest("invalid longitude %q, expected degrees between -180 and 180", lon)
+	}
+	return latitude, longitude, nil
+}
+
+// now returns the time of a request, now on the clock of the controller when
+// missing.
+func (s *Server) now(r *http.Request) (time.Time, error) {
+	t := r.URL.Query().Get("t")
+	if t == "" {
+		if s.Controller != nil {
+			return s.Controller.Clock.Now(), nil
+		}
+		return RealClock{}.Now(), nil
+	}
+	date, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		return time.Time{}, badRequest("invalid time %q, expected RFC 3339", t)
+	}
+	return date, nil
+}
+
+type sunResponse struct {
+	Time      time.Time `json:"time"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Elevation float64   `json:"elevation"`
+	Azimuth   float64   `json:"azimuth"`
+}
+
+func (s *Server) sun(r *http.Request) (int, interface{}, error) {
+	latitude, longitude, err := s.coordinates(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	date, err := s.now(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, sunResponse{
+		Time:      date,
+		Latitude:  latitude,
+		Longitude: longitude,
+		Elevation: toDegrees(elevation(date, latitude, longitude)),
+		Azimuth:   toDegrees(azimuth(date, latitude, longitude)),
+	}, nil
+}
+
+// eventsResponse has no sunrise and sunset during the polar night and the
+// midnight sun.
+type eventsResponse struct {
+	Date          string     `json:"date"`
+	Latitude      float64    `json:"latitude"`
+	Longitude     float64    `json:"longitude"`
+	SolarMidnight time.Time  `json:"solarMidnight"`
+	Sunrise       *time.Time `json:"sunrise,omitempty"`
+	SolarNoon     time.Time  `json:"solarNoon"`
+	Sunset        *time.Time `json:"sunset,omitempty"`
+}
+
+func (s *Server) events(r *http.Request) (int, interface{}, error) {
+	latitude, longitude, err := s.coordinates(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	location := time.UTC
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		if location, err = time.LoadLocation(tz); err != nil {
+			return 0, nil, badRequest("invalid time zone %q", tz)
+		}
+	}
+	var date time.Time
+	if d := r.URL.Query().Get("date"); d != "" {
+		if date, err = time.ParseInLocation("2006-01-02", d, location); err != nil {
+			return 0, nil, badRequest("invalid date %q, expected YYYY-MM-DD", d)
+		}
+	} else {
+		now, _ := s.now(r)
+		now = now.In(location)
+		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	}
+	response := eventsResponse{
+		Date:          date.Format("2006-01-02"),
+		Latitude:      latitude,
+		Longitude:     longitude,
+		SolarMidnight: solarMidnight(date, longitude),
+		SolarNoon:     solarNoon(date, longitude),
+	}
+	if !math.IsNaN(hASunrise(date, latitude)) {
+		sunrise := sunrise(date, latitude, longitude)
+		response.Sunrise = &sunrise
+	}
+	if !math.IsNaN(hASunset(date, latitude)) {
+		sunset := sunset(date, latitude, longitude)
+		response.Sunset = &sunset
+	}
+	return http.StatusOK, response, nil
+}
+
+type lightingResponse struct {
+	Zone         string    `json:"zone,omitempty"`
+	Profile      string    `json:"profile,omitempty"`
+	Time         time.Time `json:"time"`
+	ColorTemp    int64     `json:"colorTemp"`
+	Brightness   int64     `json:"brightness"`
+	Chromaticity apiXY     `json:"chromaticity"`
+}
+
+// apiXY is a CIE 1931 chromaticity.
+type apiXY struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// lighting returns the lighting of a zone of the controller, or of a profile
+// at the coordinates of the request.
+func (s *Server) lighting(r *http.Request) (int, interface{}, error) {
+	date, err := s.now(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	response := lightingResponse{Time: date}
+	var lighting Lighting
+	if zone := r.URL.Query().Get("zone"); zone != "" {
+		var ok bool
+		if s.Controller != nil {
+			lighting, ok = s.Controller.Lighting(zone, date)
+		}
+		if !ok {
+			return 0, nil, notFound("%v %q", ErrUnknownZone, zone)
+		}
+		response.Zone = zone
+	} else {
+		latitude, longitude, err := s.coordinates(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		name := r.URL.Query().Get("profile")
+		if name == "" {
+			name = DefaultProfile.Name
+		}
+		profile, ok := s.Profile(name)
+		if !ok {
+			return 0, nil, notFound("unknown profile %q", name)
+		}
+		lighting = profile.Lighting(date, latitude, longitude)
+		response.Profile = name
+	}
+	response.ColorTemp, response.Brightness = lighting.ColorTemp, lighting.Brightness
+	response.Chromaticity = apiXY{X: lighting.Chromaticity.X, Y: lighting.Chromaticity.Y}
+	return http.StatusOK, response, nil
+}
+
+func (s *Server) profileList(r *http.Request) (int, interface{}, error) {
+	if r.Method == http.MethodPost {
+		profile, err := decodeProfile(r, "")
+		if err != nil {
+			return 0, nil, err
+		}
+		s.mu.Lock()
+		_, exists := s.profiles[profile.Name]
+		if !exists {
+			s.profiles[profile.Name] = profile
+		}
+		s.mu.Unlock()
+		if exists {
+			return 0, nil, &apiError{http.StatusConflict, fmt.Sprintf("profile %q already exists", profile.Name)}
+		}
+		if s.Controller != nil {
+			s.Controller.UpdateProfile(profile)
+		}
+		return http.StatusCreated, profileJSON(profile), nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	profiles := []apiProfile{}
+	for _, profile := range s.profiles {
+		profiles = append(profiles, profileJSON(profile))
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return http.StatusOK, profiles, nil
+}
+
+func (s *Server) profile(r *http.Request) (int, interface{}, error) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/profiles/")
+	if name == "" || strings.Contains(name, "/") {
+		return 0, nil, badRequest("invalid profile name %q", name)
+	}
+	switch r.Method {
+	case http.MethodPut:
+		profile, err := decodeProfile(r, name)
+		if err != nil {
+			return 0, nil, err
+		}
+		s.mu.Lock()
+		s.profiles[profile.Name] = profile
+		s.mu.Unlock()
+		if s.Controller != nil {
+			s.Controller.UpdateProfile(profile)
+		}
+		return http.StatusOK, profileJSON(profile), nil
+	case http.MethodDelete:
+		// The default profile is served without a profile parameter, and zones
+		// following a deleted profile keep it.
+		if name == DefaultProfile.Name {
+			return 0, nil, badRequest("the %s profile cannot be deleted", name)
+		}
+		s.mu.Lock()
+		_, ok := s.profiles[name]
+		delete(s.profiles, name)
+		s.mu.Unlock()
+		if !ok {
+			return 0, nil, notFound("unknown profile %q", name)
+		}
+		return http.StatusNoContent, nil, nil
+	}
+	profile, ok := s.Profile(name)
+	if !ok {
+		return 0, nil, notFound("unknown profile %q", name)
+	}
+	return http.StatusOK, profileJSON(profile), nil
+}
+
+// apiProfile is the JSON representation of a profile. Curves are lists of
+// [elevation, value] pairs and durations are strings such as "1h30m".
+type apiProfile struct {
+	Name              string        `json:"name"`
+	ColorTempCurve    [][2]float64  `json:"colorTempCurve,omitempty"`
+	BrightnessCurve   [][2]float64  `json:"brightnessCurve,omitempty"`
+	DuvCurve          [][2]float64  `json:"duvCurve,omitempty"`
+	Compensation      string        `json:"compensation,omitempty"`
+	ReferenceLatitude float64       `json:"referenceLatitude,omitempty"`
+	MinDayLength      string        `json:"minDayLength,omitempty"`
+	MaxDayLength      string        `json:"maxDayLength,omitempty"`
+	Shift             *apiTimeShift `json:"shift,omitempty"`
+}
+
+// apiTimeShift has its schedule by lowercase weekday name.
+type apiTimeShift struct {
+	Offset   string            `json:"offset,omitempty"`
+	Schedule map[string]string `json:"schedule,omitempty"`
+	MEQ      int               `json:"meq,omitempty"`
+	Stretch  float64           `json:"stretch,omitempty"`
+}
+
+var compensations = map[Compensation]string{
+	NoCompensation:  "",
+	VirtualLatitude: "virtualLatitude",
+	ComfortDay:      "comfortDay",
+}
+
+func curveJSON(c Curve) [][2]float64 {
+	var points [][2]float64
+	for _, p := range c {
+		points = append(points, [2]float64{p.Elevation, p.Value})
+	}
+	return points
+}
+
+func durationJSON(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func profileJSON(p Profile) apiProfile {
+	profile := apiProfile{
+		Name:              p.Name,
+		ColorTempCurve:    curveJSON(p.ColorTempCurve),
+		BrightnessCurve:   curveJSON(p.BrightnessCurve),
+		DuvCurve:          curveJSON(p.DuvCurve),
+		Compensation:      compensations[p.Compensation],
+		ReferenceLatitude: p.ReferenceLatitude,
+		MinDayLength:      durationJSON(p.MinDayLength),
+		MaxDayLength:      durationJSON(p.MaxDayLength),
+	}
+	if p.Shift.Offset != 0 || p.Shift.Schedule != nil || p.Shift.MEQ != 0 || p.Shift.Stretch != 0 {
+		shift := &apiTimeShift{Offset: durationJSON(p.Shift.Offset), MEQ: p.Shift.MEQ, Stretch: p.Shift.Stretch}
+		for day, offset := range p.Shift.Schedule {
+			if shift.Schedule == nil {
+				shift.Schedule = make(map[string]string)
+			}
+			shift.Schedule[strings.ToLower(day.String())] = offset.String()
+		}
+		profile.Shift = shift
+	}
+	return profile
+}
+
+// Bounds of the values of the curves of profiles: color temperatures the
+// color package converts, brightness in percent, and Duv within the range of
+// white light.
+const (
+	minProfileColorTemp = 1000
+	maxProfileColorTemp = 25000
+	maxProfileDuv       = 0.05
+)
+
+// curve decodes a curve, whose elevations must be sorted and values between
+// min and max.
+func (p apiProfile) curve(name string, points [][2]float64, min float64, max float64) (Curve, error) {
+	var c Curve
+	for i, point := range points {
+		if i > 0 && point[0] < points[i-1][0] {
+			return nil, badRequest("%s: elevations not sorted", name)
+		}
+		if !(point[1] >= min && point[1] <= max) {
+			return nil, badRequest("%s: value %v at elevation %v, expected between %v and %v", name, point[1], point[0], min, max)
+		}
+		c = append(c, CurvePoint{Elevation: point[0], Value: point[1]})
+	}
+	return c, nil
+}
+
+func (p apiProfile) duration(name string, s string) (time.Duration, error) {
+	d, err := parseDuration(s)
+	if err != nil {
+		return 0, badRequest("%s: invalid duration %q", name, s)
+	}
+	return d, nil
+}
+
+func (p apiProfile) profile() (Profile, error) {
+	profile := Profile{Name: p.Name, ReferenceLatitude: p.ReferenceLatitude}
+	var err error
+	if profile.ColorTempCurve, err = p.curve("colorTempCurve", p.ColorTempCurve, minProfileColorTemp, maxProfileColorTemp); err != nil {
+		return Profile{}, err
+	}
+	if profile.BrightnessCurve, err = p.curve("brightnessCurve", p.BrightnessCurve, 0, 100); err != nil {
+		return Profile{}, err
+	}
+	if profile.DuvCurve, err = p.curve("duvCurve", p.DuvCurve, -maxProfileDuv, maxProfileDuv); err != nil {
+		return Profile{}, err
+	}
+	found := false
+	for compensation, name := range compensations {
+		if name == p.Compensation {
+			profile.Compensation, found = compensation, true
+		}
+	}
+	if !found {
+		return Profile{}, badRequest("invalid compensation %q", p.Compensation)
+	}
+	if p.ReferenceLatitude < -90 || p.ReferenceLatitude > 90 {
+		return Profile{}, badRequest("invalid reference latitude %v", p.ReferenceLatitude)
+	}
+	if profile.MinDayLength, err = p.duration("minDayLength", p.MinDayLength); err != nil {
+		return Profile{}, err
+	}
+	if profile.MaxDayLength, err = p.duration("maxDayLength", p.MaxDayLength); err != nil {
+		return Profile{}, err
+	}
+	if profile.MinDayLength < 0 || profile.MaxDayLength < 0 || profile.MaxDayLength > 0 && profile.MinDayLength > profile.MaxDayLength {
+		return Profile{}, badRequest("invalid day lengths %v and %v, expected minDayLength ≤ maxDayLength", profile.MinDayLength, profile.MaxDayLength)
+	}
+	if p.Shift != nil {
+		profile.Shift = TimeShift{MEQ: p.Shift.MEQ, Stretch: p.Shift.Stretch}
+		if profile.Shift.Offset, err = p.duration("shift.offset", p.Shift.Offset); err != nil {
+			return Profile{}, err
+		}
+		for name, offset := range p.Shift.Schedule {
+			day := -1
+			for d := time.Sunday; d <= time.Saturday; d++ {
+				if strings.ToLower(d.String()) == name {
+					day = int(d)
+				}
+			}
+			if day < 0 {
+				return Profile{}, badRequest("shift.schedule: invalid weekday %q", name)
+			}
+			if profile.Shift.Schedule == nil {
+				profile.Shift.Schedule = make(map[time.Weekday]time.Duration)
+			}
+			if profile.Shift.Schedule[time.Weekday(day)], err = p.duration("shift.schedule."+name, offset); err != nil {
+				return Profile{}, err
+			}
+		}
+	}
+	return profile, nil
+}
+
+// decodeProfile decodes the profile in the body of a request, named name when
+// not empty.
+func decodeProfile(r *http.Request, name string) (Profile, error) {
+	var p apiProfile
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return Profile{}, badRequest("invalid profile: %v", err)
+	}
+	if name != "" {
+		if p.Name != "" && p.Name != name {
+			return Profile{}, badRequest("profile name %q does not match %q", p.Name, name)
+		}
+		p.Name = name
+	}
+	if p.Name == "" {
+		return Profile{}, badRequest("missing profile name")
+	}
+	return p.profile()
+}
+
+// serveConfig is the configuration file of the serve command: profiles in
+// the JSON representation of the API, the profile of each zone by name, and
+// the drivers setting the lights of the zones.
+type serveConfig struct {
+	Profiles []apiProfile      `json:"profiles"`
+	Zones    map[string]string `json:"zones"`
+	Drivers  []DriverConfig    `json:"drivers"`
+}
+
+// readServeConfig reads the configuration file at path, returning its
+// profiles, its zones, or the zones of names following DefaultProfile when it
+// has none, and its drivers.
+func readServeConfig(path string, names []string) ([]Profile, []Zone, []DriverConfig, error) {
+	var config serveConfig
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := json.Unmarshal(b, &config); err != nil {
+			return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	profiles := map[string]Profile{DefaultProfile.Name: DefaultProfile}
+	var list []Profile
+	for _, p := range config.Profiles {
+		profile, err := p.profile()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s: profile %q: %w", path, p.Name, err)
+		}
+		profiles[profile.Name] = profile
+		list = append(list, profile)
+	}
+	var zones []Zone
+	if len(config.Zones) == 0 {
+		for _, name := range names {
+			zones = append(zones, Zone{Name: name, Profile: DefaultProfile})
+		}
+	}
+	for name, profileName := range config.Zones {
+		profile, ok := profiles[profileName]
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("%s: zone %q: unknown profile %q", path, name, profileName)
+		}
+		zones = append(zones, Zone{Name: name, Profile: profile})
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		return zones[i].Name < zones[j].Name
+	})
+	return list, zones, config.Drivers, nil
+}
+
+// broadcast sends the setpoints it receives to all the outputs until the
+// context is done, and returns the context error.
+func broadcast(ctx context.Context, setpoints <-chan Setpoint, outputs ...chan<- Setpoint) error {
+	for {
+		select {
+		case setpoint := <-setpoints:
+			for _, output := range outputs {
+				select {
+				case output <- setpoint:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// serve runs the serve command until the context is done, serving the API
+// for the zones and setting their lights with the drivers of -config, and the
+// gRPC API over TLS when -grpc-addr is set. It returns nil once the context
+// is done, or the first error of the servers, the controller or the drivers.
+func serve(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	grpcAddr := flags.String("grpc-addr", "", "address to serve gRPC on, over TLS only, with -cert and -key")
+	cert := flags.String("cert", "", "TLS certificate file of the gRPC server")
+	key := flags.String("key", "", "TLS key file of the gRPC server")
+	latitude := flags.Float64("lat", 48.87, "latitude in degrees")
+	longitude := flags.Float64("lon", 2.67, "longitude in degrees")
+	zones := flags.String("zones", "default", "comma separated names of the zones following the default profile, without zones in -config")
+	configPath := flags.String("config", "", "JSON file of the profiles, the zones and the drivers")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !validCoordinates(*latitude, *longitude) {
+		return fmt.Errorf("invalid coordinates %v, %v", *latitude, *longitude)
+	}
+	// net/http only serves HTTP/2, which gRPC requires, over TLS: h2c needs
+	// Go 1.24.
+	if *grpcAddr != "" && (*cert == "" || *key == "") {
+		return errors.New("-grpc-addr requires -cert and -key")
+	}
+	var names []string
+	for _, name := range strings.Split(*zones, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	profiles, z, configs, err := readServeConfig(*configPath, names)
+	if err != nil {
+		return err
+	}
+	controller := NewController(*latitude, *longitude, DefaultInterval, z...)
+	controller.Overrides = &OverrideManager{Latitude: *latitude, Longitude: *longitude}
+	for i := range configs {
+		configs[i].Clock, configs[i].Overrides = controller.Clock, controller.Overrides
+	}
+	drivers, err := NewDrivers(configs)
+	if err != nil {
+		return err
+	}
+	dispatcher := &Dispatcher{
+		Drivers: drivers,
+		Clock:   controller.Clock,
+		Report: func(driver string, err error) {
+			fmt.Fprintf(os.Stderr, "driver %s: %v\n", driver, err)
+		},
+	}
+	defer dispatcher.Close()
+
+	// The drivers are closed once everything using them has returned.
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	errs := make(chan error, 6)
+	run := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- f()
+		}()
+	}
+	setpoints := make(chan Setpoint)
+	dispatched := make(chan Setpoint)
+	outputs := []chan<- Setpoint{dispatched}
+	run(func() error { return controller.Run(ctx, setpoints) })
+	run(func() error { return dispatcher.Run(ctx, dispatched) })
+
+	server := &http.Server{Addr: *addr, Handler: NewServer(controller, profiles...)}
+	defer server.Close()
+	run(server.ListenAndServe)
+	if *grpcAddr != "" {
+		service := &GRPCService{Controller: controller}
+		watched := make(chan Setpoint)
+		outputs = append(outputs, watched)
+		run(func() error { return service.Run(ctx, watched) })
+		grpcServer := &http.Server{Addr: *grpcAddr, Handler: service.Server()}
+		defer grpcServer.Close()
+		run(func() error { return grpcServer.ListenAndServeTLS(*cert, *key) })
+	}
+	run(func() error { return broadcast(ctx, setpoints, outputs...) })
+
+	select {
+	case err := <-errs:
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
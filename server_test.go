@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// request serves a request with the server, decoding its JSON response.
+func request(t *testing.T, s *Server, method string, target string, body string, response interface{}) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if response != nil && recorder.Body.Len() > 0 {
+		if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+			t.Fatalf("%s %s = %s, expected JSON: %v", method, target, recorder.Body, err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestServerSun(t *testing.T) {
+
+	// Paris UTC
+	s := NewServer(nil)
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	var got sunResponse
+	if code := request(t, s, "GET", "/v1/sun?lat=48.87&lon=2.67&t=2021-06-21T10:00:00Z", "", &got); code != http.StatusOK {
+		t.Fatalf("GET /v1/sun = %d, expected %d", code, http.StatusOK)
+	}
+	expected := sunResponse{Time: date, Latitude: 48.87, Longitude: 2.67, Elevation: toDegrees(elevation(date, 48.87, 2.67)), Azimuth: toDegrees(azimuth(date, 48.87, 2.67))}
+	if !got.Time.Equal(expected.Time) || got.Elevation != expected.Elevation || got.Azimuth != expected.Azimuth {
+		t.Errorf("GET /v1/sun = %+v, expected %+v", got, expected)
+	}
+
+	invalid := []string{
+		"/v1/sun?lat=91&lon=2.67",
+		"/v1/sun?lat=48.87&lon=-181",
+		"/v1/sun?lat=NaN&lon=2.67",
+		"/v1/sun?lat=north&lon=2.67",
+		"/v1/sun?lat=48.87",
+		"/v1/sun?lat=48.87&lon=2.67&t=noon",
+	}
+	for _, target := range invalid {
+		var e map[string]string
+		if code := request(t, s, "GET", target, "", &e); code != http.StatusBadRequest || e["error"] == "" {
+			t.Errorf("GET %s = %d %v, expected %d with an error", target, code, e, http.StatusBadRequest)
+		}
+	}
+	if code := request(t, s, "POST", "/v1/sun?lat=48.87&lon=2.67", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /v1/sun = %d, expected %d", code, http.StatusMethodNotAllowed)
+	}
+
+}
+
+func TestServerEvents(t *testing.T) {
+
+	// Paris UTC, and Tromsø in the midnight sun
+	controller := NewController(48.87, 2.67, time.Minute)
+	s := NewServer(controller)
+	date := time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC)
+	var got eventsResponse
+	if code := request(t, s, "GET", "/v1/events?date=2021-06-21", "", &got); code != http.StatusOK {
+		t.Fatalf("GET /v1/events = %d, expected %d", code, http.StatusOK)
+	}
+	if got.Sunrise == nil || !got.Sunrise.Equal(sunrise(date, 48.87, 2.67)) || !got.SolarNoon.Equal(solarNoon(date, 2.67)) || got.Sunset == nil || !got.Sunset.Equal(sunset(date, 48.87, 2.67)) {
+		t.Errorf("GET /v1/events = %+v, expected the events in Paris", got)
+	}
+
+	got = eventsResponse{}
+	if code := request(t, s, "GET", "/v1/events?lat=69.65&lon=18.96&date=2021-06-21", "", &got); code != http.StatusOK || got.Sunrise != nil || got.Sunset != nil {
+		t.Errorf("GET /v1/events in Tromsø = %d %+v, expected no sunrise nor sunset", code, got)
+	}
+	if code := request(t, s, "GET", "/v1/events?date=21/06/2021", "", nil); code != http.StatusBadRequest {
+		t.Errorf("GET /v1/events with an invalid date = %d, expected %d", code, http.StatusBadRequest)
+	}
+
+}
+
+func TestServerLighting(t *testing.T) {
+
+	// Paris UTC
+	office := Profile{Name: "office", BrightnessCurve: Curve{{-6, 10}, {0, 80}}}
+	controller := NewController(48.87, 2.67, time.Minute, Zone{Name: "office", Profile: office})
+	s := NewServer(controller, office)
+	date := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+
+	targets := map[string]Lighting{
+		"/v1/lighting?zone=office&t=2021-06-21T10:00:00Z":                office.Lighting(date, 48.87, 2.67),
+		"/v1/lighting?lat=35.68&lon=139.67&t=2021-06-21T10:00:00Z":       DefaultProfile.Lighting(date, 35.68, 139.67),
+		"/v1/lighting?profile=office&lat=0&lon=0&t=2021-06-21T10:00:00Z": office.Lighting(date, 0, 0),
+	}
+	for target, expected := range targets {
+		var got lightingResponse
+		if code := request(t, s, "GET", target, "", &got); code != http.StatusOK || got.ColorTemp != expected.ColorTemp || got.Brightness != expected.Brightness || got.Chromaticity.X != expected.Chromaticity.X {
+			t.Errorf("GET %s = %d %+v, expected %+v", target, code, got, expected)
+		}
+	}
+	for _, target := range []string{"/v1/lighting?zone=garage", "/v1/lighting?profile=reading"} {
+		if code := request(t, s, "GET", target, "", nil); code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, expected %d", target, code, http.StatusNotFound)
+		}
+	}
+
+}
+
+func TestServerProfiles(t *testing.T) {
+
+	controller := NewController(48.87, 2.67, time.Minute, Zone{Name: "office", Profile: Profile{Name: "office"}})
+	s := NewServer(controller)
+
+	body := `{"name": "office", "brightnessCurve": [[-6, 10], [0, 80]], "compensation": "comfortDay", "minDayLength": "8h", "shift": {"schedule": {"saturday": "1h"}}}`
+	var created apiProfile
+	if code := request(t, s, "POST", "/v1/profiles", body, &created); code != http.StatusCreated {
+		t.Fatalf("POST /v1/profiles = %d, expected %d", code, http.StatusCreated)
+	}
+	profile, _ := s.Profile("office")
+	if profile.Compensation != ComfortDay || profile.MinDayLength != 8*time.Hour || profile.Shift.Schedule[time.Saturday] != time.Hour || len(profile.BrightnessCurve) != 2 {
+		t.Errorf("POST /v1/profiles created %+v", profile)
+	}
+	if controller.Zones[0].Profile.Compensation != ComfortDay {
+		t.Errorf("POST /v1/profiles did not update the zone following office")
+	}
+	if code := request(t, s, "POST", "/v1/profiles", body, nil); code != http.StatusConflict {
+		t.Errorf("POST /v1/profiles again = %d, expected %d", code, http.StatusConflict)
+	}
+
+	var list []apiProfile
+	if code := request(t, s, "GET", "/v1/profiles", "", &list); code != http.StatusOK || len(list) != 2 || list[0].Name != "default" || list[1].Name != "office" {
+		t.Errorf("GET /v1/profiles = %d %+v, expected default and office", code, list)
+	}
+
+	var replaced apiProfile
+	if code := request(t, s, "PUT", "/v1/profiles/office", `{"colorTempCurve": [[-6, 2200], [10, 5000]]}`, &replaced); code != http.StatusOK || replaced.Name != "office" || len(replaced.ColorTempCurve) != 2 {
+		t.Errorf("PUT /v1/profiles/office = %d %+v", code, replaced)
+	}
+	invalid := map[string]string{
+		"unsorted curve": `{"colorTempCurve": [[10, 5000], [-6, 2200]]}`,
+		"compensation":   `{"compensation": "polar"}`,
+		"duration":       `{"maxDayLength": "long"}`,
+		"weekday":        `{"shift": {"schedule": {"caturday": "1h"}}}`,
+		"unknown field":  `{"colour": 2700}`,
+		"other name":     `{"name": "reading"}`,
+		"color temp":     `{"colorTempCurve": [[-6, 0], [10, 5000]]}`,
+		"brightness":     `{"brightnessCurve": [[-6, 10], [0, 120]]}`,
+		"negative":       `{"brightnessCurve": [[-6, -1]]}`,
+		"duv":            `{"duvCurve": [[0, 0.25]]}`,
+		"day lengths":    `{"minDayLength": "12h", "maxDayLength": "8h"}`,
+		"day length":     `{"minDayLength": "-1h"}`,
+	}
+	for k, body := range invalid {
+		if code := request(t, s, "PUT", "/v1/profiles/office", body, nil); code != http.StatusBadRequest {
+			t.Errorf("PUT /v1/profiles/office with an invalid %s = %d, expected %d", k, code, http.StatusBadRequest)
+		}
+	}
+
+	// Profiles are stored under their name, which the path must hold.
+	for _, target := range []string{"/v1/profiles/", "/v1/profiles/a/b"} {
+		if code := request(t, s, "PUT", target, `{"name": "foo"}`, nil); code != http.StatusBadRequest {
+			t.Errorf("PUT %s = %d, expected %d", target, code, http.StatusBadRequest)
+		}
+	}
+	if _, ok := s.Profile("foo"); ok {
+		t.Errorf("PUT /v1/profiles/ stored the profile foo")
+	}
+	if code := request(t, s, "DELETE", "/v1/profiles/default", "", nil); code != http.StatusBadRequest {
+		t.Errorf("DELETE /v1/profiles/default = %d, expected %d", code, http.StatusBadRequest)
+	}
+	if code := request(t, s, "GET", "/v1/lighting?lat=48.87&lon=2.67", "", nil); code != http.StatusOK {
+		t.Errorf("GET /v1/lighting after deleting the default profile = %d, expected %d", code, http.StatusOK)
+	}
+
+	if code := request(t, s, "DELETE", "/v1/profiles/office", "", nil); code != http.StatusNoContent {
+		t.Errorf("DELETE /v1/profiles/office = %d, expected %d", code, http.StatusNoContent)
+	}
+	if code := request(t, s, "GET", "/v1/profiles/office", "", nil); code != http.StatusNotFound {
+		t.Errorf("GET /v1/profiles/office after deleting it = %d, expected %d", code, http.StatusNotFound)
+	}
+
+}
+
+func TestServe(t *testing.T) {
+
+	driver := &fakeDriver{applied: make(chan Setpoint, 1)}
+	configs := make(chan DriverConfig, 1)
+	RegisterDriver("serve", func(config DriverConfig) (Driver, error) {
+		configs <- config
+		return driver, nil
+	})
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{
+		"profiles": [{"name": "office", "brightnessCurve": [[-6, 10], [0, 80]]}],
+		"zones": {"office": "office"},
+		"drivers": [{"name": "lights", "type": "serve", "zones": {"office": ["lamp"]}}]
+	}`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, []string{"-addr", "127.0.0.1:0", "-config", path})
+	}()
+
+	select {
+	case setpoint := <-driver.applied:
+		if setpoint.Zone != "office" || setpoint.Brightness < 10 || setpoint.Brightness > 80 {
+			t.Errorf("serve applied %+v, expected the office profile", setpoint)
+		}
+	case err := <-done:
+		t.Fatalf("serve() = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve applied no setpoint in 5s")
+	}
+	if c := <-configs; c.Clock == nil || c.Overrides == nil || len(c.Zones["office"]) != 1 {
+		t.Errorf("serve created the driver with %+v, expected its zones, clock and overrides", c)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve() = %v, expected nil once canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve did not return once canceled")
+	}
+	if !driver.closed {
+		t.Errorf("serve left the driver open")
+	}
+
+	invalid := map[string]string{
+		"unknown profile": `{"zones": {"office": "reading"}}`,
+		"unknown driver":  `{"drivers": [{"name": "lights", "type": "x10"}]}`,
+		"invalid profile": `{"profiles": [{"name": "office", "compensation": "none"}]}`,
+	}
+	for k, config := range invalid {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := serve(context.Background(), []string{"-addr", "127.0.0.1:0", "-config", path}); err == nil {
+			t.Errorf("serve() with %s = nil, expected an error", k)
+		}
+	}
+	if err := serve(context.Background(), []string{"-grpc-addr", "127.0.0.1:0"}); err == nil {
+		t.Errorf("serve() with -grpc-addr without -cert = nil, expected an error")
+	}
+
+}
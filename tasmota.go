@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/color"
+	"github.com/sundae-party/circadian-lighting/mqtt"
+)
+
+// tasmotaCapabilities is the color temperature range of Tasmota lights with
+// color temperature support.
+var tasmotaCapabilities = Capabilities{MinMired: 153, MaxMired: 500}
+
+// Tasmota drives lights running Tasmota. Without MQTT, commands are sent over
+// HTTP to the hosts the zones are mapped to in Zones, with Username and
+// Password when the web interface is protected. With MQTT, commands are
+// published on cmnd/<topic>/ for the device topics the zones are mapped to,
+// and responses read from stat/<topic>/RESULT. Timeout bounds the wait for
+// responses over MQTT, 5s when 0. A nil Client is http.DefaultClient.
+type Tasmota struct {
+	Client   *http.Client
+	Username string
+	Password string
+	MQTT     *mqtt.Client
+	QoS      byte
+	Zones    map[string][]string
+	Timeout  time.Duration
+
+	// ownsMQTT is set when the MQTT client was connected by NewDriver.
+	ownsMQTT bool
+
+	mu         sync.Mutex
+	subscribed bool
+	results    map[string]chan map[string]json.RawMessage
+	lights     map[string]Light
+}
+
+func (t *Tasmota) timeout() time.Duration {
+	if t.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return t.Timeout
+}
+
+// resultChannel returns the channel the results of a device are received on.
+func (t *Tasmota) resultChannel(device string) chan map[string]json.RawMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.results == nil {
+		t.results = make(map[string]chan map[string]json.RawMessage)
+	}
+	ch, ok := t.results[device]
+	if !ok {
+		ch = make(chan map[string]json.RawMessage, 16)
+		t.results[device] = ch
+	}
+	return ch
+}
+
+// subscribe subscribes to the results of the devices once it succeeds.
+func (t *Tasmota) subscribe() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.subscribed {
+		return nil
+	}
+	err := t.MQTT.Subscribe("stat/+/RESULT", t.QoS, func(m mqtt.Message) {
+		var result map[string]json.RawMessage
+		if json.Unmarshal(m.Payload, &result) != nil {
+			return
+		}
+		device := strings.TrimSuffix(strings.TrimPrefix(m.Topic, "stat/"), "/RESULT")
+		select {
+		case t.resultChannel(device) <- result:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	t.subscribed = true
+	return nil
+}
+
+// command sends a command to a device. With key, it returns the first result
+// containing it, otherwise it does not wait for a result over MQTT.
+func (t *Tasmota) command(ctx context.Context, device string, command string, key string) (map[string]json.RawMessage, error) {
+	if t.MQTT == nil {
+		query := url.Values{}
+		if t.Username != "" {
+			query.Set("user", t.Username)
+			query.Set("password", t.Password)
+		}
+		query.Set("cmnd", command)
+		var result map[string]json.RawMessage
+		if err := requestJSON(ctx, t.Client, http.MethodGet, "http://"+device+"/cm?"+query.Encode(), nil, &result); err != nil {
+			return nil, fmt.Errorf("tasmota: %w", err)
+		}
+		if _, ok := result[key]; key != "" && !ok {
+			return nil, fmt.Errorf("tasmota: %s: %s: unexpected result", device, command)
+		}
+		return result, nil
+	}
+
+	if err := t.subscribe(); err != nil {
+		return nil, err
+	}
+	ch := t.resultChannel(device)
+	for len(ch) > 0 {
+		<-ch
+	}
+	name, payload := command, ""
+	if i := strings.Index(command, " "); i >= 0 {
+		name, payload = command[:i], command[i+1:]
+	}
+	if err := t.MQTT.Publish("cmnd/"+device+"/"+name, []byte(payload), t.QoS, false); err != nil {
+		return nil, fmt.Errorf("tasmota: %s: %w", device, err)
+	}
+	if key == "" {
+		return nil, nil
+	}
+	timer := time.NewTimer(t.timeout())
+	defer timer.Stop()
+	for {
+		select {
+		case result := <-ch:
+			if _, ok := result[key]; ok {
+				return result, nil
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("tasmota: %s: %s: no response", device, command)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Discover returns the devices of the zones, with their device name.
+func (t *Tasmota) Discover(ctx context.Context) ([]Light, error) {
+	lights := make(map[string]Light)
+	var discovered []Light
+	for _, zone := range t.Zones {
+		for _, device := range zone {
+			if _, ok := lights[device]; ok {
+				continue
+			}
+			state, err := t.command(ctx, device, "State", "POWER")
+			if err != nil {
+				return nil, err
+			}
+			name, err := t.command(ctx, device, "DeviceName", "DeviceName")
+			if err != nil {
+				return nil, err
+			}
+			light := Light{ID: device}
+			json.Unmarshal(name["DeviceName"], &light.Name)
+			if _, ok := state["CT"]; ok {
+				light.Capabilities = tasmotaCapabilities
+			}
+			lights[device] = light
+			discovered = append(discovered, light)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lights = lights
+	return discovered, nil
+}
+
+// Capabilities returns what a discovered device supports.
+func (t *Tasmota) Capabilities(light string) (Capabilities, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.lights[light]
+	return l.Capabilities, ok
+}
+
+// Apply sets the devices of the zone of the setpoint with a single Backlog of
+// CT and Dimmer commands, each fading at the one-shot Speed2 of the transition,
+// or not at all with Fade2 0. Devices not discovered yet are assumed to support
+// color temperature.
+func (t *Tasmota) Apply(ctx context.Context, setpoint Setpoint) error {
+	devices, ok := t.Zones[setpoint.Zone]
+	if !ok {
+		return fmt.Errorf("tasmota: %w %q", ErrUnknownZone, setpoint.Zone)
+	}
+	for _, device := range devices {
+		c, ok := t.Capabilities(device)
+		if !ok {
+			c = tasmotaCapabilities
+		}
+		lighting, _ := c.Map(setpoint.Lighting)
+		// Fade2 and Speed2 only apply to the next command, leaving the Fade and
+		// Speed settings of the device untouched. Speed is the time to fade
+		// over, in half seconds from 1 to 40.
+		fade := "Fade2 0"
+		if setpoint.Transition > 0 {
+			speed := math.Max(1, math.Min(40, math.Round(2*setpoint.Transition.Seconds())))
+			fade = fmt.Sprintf("Speed2 %d", int(speed))
+		}
+		var commands []string
+		if c.MaxMired > 0 {
+			commands = append(commands, fade, fmt.Sprintf("CT %d", int64(math.Round(color.Mired(float64(lighting.ColorTemp))))))
+		}
+		commands = append(commands, fade, fmt.Sprintf("Dimmer %d", c.Level(lighting.Brightness)))
+		if _, err := t.command(ctx, device, "Backlog "+strings.Join(commands, "; "), ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// State returns the current lighting of a device.
+func (t *Tasmota) State(ctx context.Context, light string) (Lighting, error) {
+	state, err := t.command(ctx, light, "State", "POWER")
+	if err != nil {
+		return Lighting{}, err
+	}
+	var power string
+	var dimmer, ct float64
+	json.Unmarshal(state["POWER"], &power)
+	json.Unmarshal(state["Dimmer"], &dimmer)
+	json.Unmarshal(state["CT"], &ct)
+	var lighting Lighting
+	if ct > 0 {
+		lighting.ColorTemp = int64(math.Round(color.Kelvin(ct)))
+	}
+	if power == "ON" {
+		lighting.Brightness = int64(dimmer)
+	}
+	return lighting, nil
+}
+
+// Close closes the idle connections to the devices. The MQTT client is
+// disconnected when it was connected by NewDriver, and otherwise left
+// connected, as it may be shared with other outputs.
+func (t *Tasmota) Close() error {
+	if t.Client != nil {
+		t.Client.CloseIdleConnections()
+	}
+	if t.ownsMQTT {
+		return t.MQTT.Disconnect()
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/mqtt"
+)
+
+// fakeTasmota is a stand-in of a Tasmota light, executing the commands it
+// receives and recording them.
+type fakeTasmota struct {
+	mu       sync.Mutex
+	state    map[string]interface{}
+	commands []string
+}
+
+func newFakeTasmota() *fakeTasmota {
+	return &fakeTasmota{state: map[string]interface{}{"POWER": "ON", "Dimmer": 100, "CT": 250}}
+}
+
+// execute executes a command and returns its result.
+func (d *fakeTasmota) execute(command string) map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.commands = append(d.commands, command)
+	result := make(map[string]interface{})
+	for _, c := range strings.Split(strings.TrimPrefix(command, "Backlog "), "; ") {
+		fields := strings.Fields(c)
+		switch {
+		case fields[0] == "State":
+			for k, v := range d.state {
+				result[k] = v
+			}
+		case fields[0] == "DeviceName":
+			result["DeviceName"] = "Desk lamp"
+		case len(fields) == 2 && (fields[0] == "CT" || fields[0] == "Dimmer"):
+			d.state[fields[0]], _ = strconv.Atoi(fields[1])
+			result[fields[0]] = d.state[fields[0]]
+		}
+	}
+	return result
+}
+
+func (d *fakeTasmota) sent() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	commands := d.commands
+	d.commands = nil
+	return commands
+}
+
+func (d *fakeTasmota) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if r.URL.Path != "/cm" || query.Get("user") != "admin" || query.Get("password") != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(d.execute(query.Get("cmnd")))
+}
+
+func testTasmota(t *testing.T, tasmota *Tasmota, device *fakeTasmota, id string) {
+	ctx := context.Background()
+	lights, err := tasmota.Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lights) != 1 || lights[0] != (Light{ID: id, Name: "Desk lamp", Capabilities: tasmotaCapabilities}) {
+		t.Errorf("tasmota.Discover() = %+v", lights)
+	}
+	device.sent()
+
+	setpoints := []struct {
+		setpoint Setpoint
+		expected string
+	}{
+		{Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 2700, Brightness: 50}, Transition: 2 * time.Second}, "Backlog Speed2 4; CT 370; Speed2 4; Dimmer 50"},
+		{Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 1800, Brightness: 100}}, "Backlog Fade2 0; CT 500; Fade2 0; Dimmer 100"},
+		{Setpoint{Zone: "office", Lighting: Lighting{ColorTemp: 6500, Brightness: 10}, Transition: time.Minute}, "Backlog Speed2 40; CT 154; Speed2 40; Dimmer 10"},
+	}
+	for _, s := range setpoints {
+		if err := tasmota.Apply(ctx, s.setpoint); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		deadline := time.Now().Add(5 * time.Second)
+		for len(got) == 0 && time.Now().Before(deadline) {
+			got = device.sent()
+			time.Sleep(time.Millisecond)
+		}
+		if len(got) != 1 || got[0] != s.expected {
+			t.Errorf("tasmota.Apply(%+v) = %v, expected %s", s.setpoint, got, s.expected)
+		}
+	}
+
+	state, err := tasmota.State(ctx, id)
+	expected := Lighting{ColorTemp: 6494, Brightness: 10}
+	if err != nil || state != expected {
+		t.Errorf("tasmota.State(%s) = %+v, %v, expected %+v", id, state, err, expected)
+	}
+	if err := tasmota.Apply(ctx, Setpoint{Zone: "garage"}); err == nil {
+		t.Errorf("tasmota.Apply() succeeded on an unknown zone")
+	}
+}
+
+func TestTasmotaHTTP(t *testing.T) {
+
+	device := newFakeTasmota()
+	server := httptest.NewServer(device)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	tasmota := &Tasmota{Username: "admin", Password: "secret", Zones: map[string][]string{"office": {host}}}
+	defer tasmota.Close()
+	testTasmota(t, tasmota, device, host)
+
+	tasmota.Password = "wrong"
+	if _, err := tasmota.State(context.Background(), host); err == nil {
+		t.Errorf("tasmota.State() succeeded with a wrong password")
+	}
+}
+
+func TestTasmotaMQTT(t *testing.T) {
+
+	device := newFakeTasmota()
+	_, client, remote := newTestBroker(t)
+	err := remote.Subscribe("cmnd/desk/+", 1, func(m mqtt.Message) {
+		command := strings.TrimPrefix(m.Topic, "cmnd/desk/")
+		if len(m.Payload) > 0 {
+			command += " " + string(m.Payload)
+		}
+		result, _ := json.Marshal(device.execute(command))
+		remote.Publish("stat/desk/RESULT", result, 0, false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasmota := &Tasmota{MQTT: client, QoS: 1, Zones: map[string][]string{"office": {"desk"}}}
+	defer tasmota.Close()
+	testTasmota(t, tasmota, device, "desk")
+
+	// A failed subscription is tried again
+	client.Disconnect()
+	failing := &Tasmota{MQTT: client, QoS: 1}
+	if err := failing.subscribe(); err == nil || failing.subscribed {
+		t.Errorf("tasmota.subscribe() without a connection = %v, subscribed %v, expected an error", err, failing.subscribed)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// TimeShift moves the circadian curve to follow a person rather than the sun:
+// the curve is evaluated at the time the sun is where it would be for that
+// person. Schedule overrides Offset on its weekdays, MEQ adds the shift of the
+// person chronotype and Stretch lengthens the day around solar noon. A shifted
+// day keeps the offset of the weekday it started on until it ends, so that a
+// night shift crossing midnight follows a single offset.
+type TimeShift struct {
+	Offset   time.Duration
+	Schedule map[time.Weekday]time.Duration
+	MEQ      int
+	Stretch  float64
+}
+
+// chronotypeOffset returns the shift of a Horne-Östberg morningness-
+// eveningness questionnaire score, from about 2 hours earlier for a definite
+// morning type (86) to 2 hours later for a definite evening type (16). A zero
+// score is no shift.
+func chronotypeOffset(meq int) time.Duration {
+	if meq == 0 {
+		return 0
+	}
+	return time.Duration(50-meq) * 4 * time.Minute
+}
+
+// dayOffset returns the offset of the days starting on a weekday.
+func (s TimeShift) dayOffset(weekday time.Weekday) time.Duration {
+	offset := s.Offset
+	if o, ok := s.Schedule[weekday]; ok {
+		offset = o
+	}
+	return offset + chronotypeOffset(s.MEQ)
+}
+
+// offset returns the offset of the earliest shifted day still running at the
+// date, that of the date weekday between two shifted days.
+func (s TimeShift) offset(date time.Time) time.Duration {
+	y, m, d := date.Date()
+	for k := -1; k <= 1; k++ {
+		day := time.Date(y, m, d+k, 0, 0, 0, 0, date.Location())
+		offset := s.dayOffset(day.Weekday())
+		if sy, sm, sd := date.Add(-offset).Date(); sy == day.Year() && sm == day.Month() && sd == day.Day() {
+			return offset
+		}
+	}
+	return s.dayOffset(date.Weekday())
+}
+
+// Time returns the time at which the sun is where it is for the person at the
+// given date.
+func (s TimeShift) Time(date time.Time, longitude float64) time.Time {
+	date = date.Add(-s.offset(date))
+	if s.Stretch > 0 && s.Stretch != 1 {
+		noon := solarNoon(time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, date.Location()), longitude)
+		date = noon.Add(time.Duration(math.Round(float64(date.Sub(noon)) / s.Stretch)))
+	}
+	return date
+}
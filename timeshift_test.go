@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChronotypeOffset(t *testing.T) {
+
+	scores := make(map[int]time.Duration)
+	scores[0] = 0
+	scores[16] = 136 * time.Minute
+	scores[50] = 0
+	scores[80] = -2 * time.Hour
+	scores[86] = -144 * time.Minute
+
+	for k, v := range scores {
+		got := chronotypeOffset(k)
+		if got != v {
+			t.Errorf("chronotypeOffset(%d) = %v, expected %v", k, got, v)
+		} else {
+			t.Logf("chronotypeOffset(%d) = %v, expected %v", k, got, v)
+		}
+	}
+
+}
+
+func TestTimeShift(t *testing.T) {
+
+	// Paris UTC, 2021-06-21 is a Monday
+	longitude := 2.67
+	nightShift := TimeShift{Schedule: map[time.Weekday]time.Duration{time.Monday: 13 * time.Hour, time.Tuesday: 13 * time.Hour}}
+	monday := time.Date(2021, 6, 21, 20, 0, 0, 0, time.UTC)
+	sunday := time.Date(2021, 6, 20, 20, 0, 0, 0, time.UTC)
+	wednesday := time.Date(2021, 6, 23, 5, 0, 0, 0, time.UTC)
+	noon := solarNoon(time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC), longitude)
+
+	shifts := []struct {
+		shift    TimeShift
+		date     time.Time
+		expected time.Time
+	}{
+		{TimeShift{}, monday, monday},
+		{TimeShift{Offset: 13 * time.Hour}, monday, monday.Add(-13 * time.Hour)},
+		{TimeShift{Offset: time.Hour, MEQ: 20}, monday, monday.Add(-3 * time.Hour)},
+		{TimeShift{Stretch: 2}, noon, noon},
+		{TimeShift{Stretch: 2}, noon.Add(2 * time.Hour), noon.Add(time.Hour)},
+		{TimeShift{Stretch: 2}, noon.Add(-4 * time.Hour), noon.Add(-2 * time.Hour)},
+		{nightShift, monday, monday.Add(-13 * time.Hour)},
+		{nightShift, sunday, sunday},
+		// The Tuesday night shift continues past midnight.
+		{nightShift, wednesday, wednesday.Add(-13 * time.Hour)},
+		{nightShift, wednesday.Add(8 * time.Hour), wednesday.Add(8 * time.Hour)},
+	}
+
+	for _, s := range shifts {
+		got := s.shift.Time(s.date, longitude)
+		if !got.Equal(s.expected) {
+			t.Errorf("%+v.Time(%v) = %v, expected %v", s.shift, s.date, got, s.expected)
+		} else {
+			t.Logf("%+v.Time(%v) = %v, expected %v", s.shift, s.date, got, s.expected)
+		}
+	}
+
+}
+
+func TestProfileTimeShift(t *testing.T) {
+
+	// Paris UTC
+	latitude := 48.87
+	longitude := 2.67
+	profile := Profile{Shift: TimeShift{Offset: 13 * time.Hour}}
+
+	for h := 0; h < 24; h++ {
+		d := time.Date(2021, 12, 21, h, 0, 0, 0, time.UTC)
+		if got, expected := profile.ColorTemp(d, latitude, longitude), ColorTemp(d.Add(-13*time.Hour), latitude, longitude); got != expected {
+			t.Errorf("profile.ColorTemp(%v) = %d, expected %d", d, got, expected)
+		}
+		if got, expected := profile.Brightness(d, latitude, longitude), Brightness(d.Add(-13*time.Hour), latitude, longitude); got != expected {
+			t.Errorf("profile.Brightness(%v) = %d, expected %d", d, got, expected)
+		}
+	}
+
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+// Phase is a part of the day delimited by the sun elevation.
+type Phase int
+
+const (
+	Night Phase = iota
+	NauticalTwilight
+	CivilTwilight
+	Day
+)
+
+// Sun elevations in degrees between phases.
+var phaseBoundaries = [...]float64{-12, -6, -0.833}
+
+func phaseOf(elevation float64) Phase {
+	phase := Night
+	for i, boundary := range phaseBoundaries {
+		if elevation > boundary {
+			phase = Phase(i + 1)
+		}
+	}
+	return phase
+}
+
+// Smoother turns the lighting computed at each tick into as few device
+// commands as possible without visible steps. Color temperature and
+// brightness changes are limited to ColorTempRate Kelvin and BrightnessRate
+// percent per minute (unlimited when 0), changes below both ColorTempThreshold
+// and BrightnessThreshold are not sent unless the phase of the day changes, and
+// the phase of the day only changes once the sun is Hysteresis degrees past the
+// boundary, so that a sun hovering around a boundary does not force updates.
+type Smoother struct {
+	ColorTempRate       float64
+	BrightnessRate      float64
+	ColorTempThreshold  int64
+	BrightnessThreshold int64
+	Hysteresis          float64
+	started             bool
+	phase               Phase
+	last                Lighting
+	lastTime            time.Time
+}
+
+func limit(from int64, to int64, rate float64, minutes float64) int64 {
+	if rate == 0 {
+		return to
+	}
+	step := int64(math.Floor(rate * minutes))
+	if to > from+step {
+		return from + step
+	} else if to < from-step {
+		return from - step
+	}
+	return to
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Next returns the lighting to send to the device at the given date and sun
+// elevation in degrees, the transition time the device should fade over, and
+// false when nothing should be sent.
+func (s *Smoother) Next(target Lighting, elevation float64, date time.Time) (Lighting, time.Duration, bool) {
+	if !s.started {
+		s.started, s.phase, s.last, s.lastTime = true, phaseOf(elevation), target, date
+		return target, 0, true
+	}
+
+	phaseChanged := false
+	if phase := phaseOf(elevation); phase > s.phase && elevation > phaseBoundaries[s.phase]+s.Hysteresis {
+		s.phase, phaseChanged = phase, true
+	} else if phase < s.phase && elevation < phaseBoundaries[s.phase-1]-s.Hysteresis {
+		s.phase, phaseChanged = phase, true
+	}
+
+	minutes := date.Sub(s.lastTime).Minutes()
+	next := target
+	next.ColorTemp = limit(s.last.ColorTemp, target.ColorTemp, s.ColorTempRate, minutes)
+	next.Brightness = limit(s.last.Brightness, target.Brightness, s.BrightnessRate, minutes)
+	if next.ColorTemp != target.ColorTemp && target.Chromaticity != (color.XY{}) {
+		next.Chromaticity = color.CCTToXY(float64(next.ColorTemp), target.duv())
+	}
+
+	colorTempChange := abs(next.ColorTemp - s.last.ColorTemp)
+	brightnessChange := abs(next.Brightness - s.last.Brightness)
+	if colorTempChange == 0 && brightnessChange == 0 {
+		return s.last, 0, false
+	}
+	if !phaseChanged && (colorTempChange == 0 || colorTempChange < s.ColorTempThreshold) && (brightnessChange == 0 || brightnessChange < s.BrightnessThreshold) {
+		return s.last, 0, false
+	}
+
+	var transition time.Duration
+	if s.ColorTempRate > 0 {
+		transition = time.Duration(float64(colorTempChange) / s.ColorTempRate * float64(time.Minute))
+	}
+	if s.BrightnessRate > 0 {
+		if t := time.Duration(float64(brightnessChange) / s.BrightnessRate * float64(time.Minute)); t > transition {
+			transition = t
+		}
+	}
+	s.last, s.lastTime = next, date
+	return next, transition, true
+}
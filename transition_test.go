@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPhaseOf(t *testing.T) {
+
+	elevations := make(map[float64]Phase)
+	elevations[-90] = Night
+	elevations[-12] = Night
+	elevations[-8] = NauticalTwilight
+	elevations[-3] = CivilTwilight
+	elevations[-0.833] = CivilTwilight
+	elevations[45] = Day
+
+	for k, v := range elevations {
+		got := phaseOf(k)
+		if got != v {
+			t.Errorf("phaseOf(%f) = %d, expected %d", k, got, v)
+		} else {
+			t.Logf("phaseOf(%f) = %d, expected %d", k, got, v)
+		}
+	}
+
+}
+
+func TestSmootherRate(t *testing.T) {
+
+	smoother := Smoother{ColorTempRate: 100, BrightnessRate: 10}
+	start := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	smoother.Next(Lighting{ColorTemp: 2000, Brightness: 50}, 30, start)
+
+	steps := []struct {
+		target     Lighting
+		minutes    int
+		expected   Lighting
+		transition time.Duration
+	}{
+		{Lighting{ColorTemp: 5000, Brightness: 100}, 1, Lighting{ColorTemp: 2100, Brightness: 60}, time.Minute},
+		{Lighting{ColorTemp: 5000, Brightness: 100}, 3, Lighting{ColorTemp: 2300, Brightness: 80}, 2 * time.Minute},
+		{Lighting{ColorTemp: 2350, Brightness: 85}, 10, Lighting{ColorTemp: 2350, Brightness: 85}, 30 * time.Second},
+		{Lighting{ColorTemp: 2000, Brightness: 85}, 11, Lighting{ColorTemp: 2250, Brightness: 85}, time.Minute},
+	}
+
+	for _, s := range steps {
+		got, transition, ok := smoother.Next(s.target, 30, start.Add(time.Duration(s.minutes)*time.Minute))
+		if !ok || got != s.expected || transition != s.transition {
+			t.Errorf("smoother.Next(%+v) at %d min = %+v, %v, %t, expected %+v, %v", s.target, s.minutes, got, transition, ok, s.expected, s.transition)
+		} else {
+			t.Logf("smoother.Next(%+v) at %d min = %+v, %v, %t, expected %+v, %v", s.target, s.minutes, got, transition, ok, s.expected, s.transition)
+		}
+	}
+
+}
+
+func TestSmootherThreshold(t *testing.T) {
+
+	smoother := Smoother{ColorTempThreshold: 50, BrightnessThreshold: 5}
+	start := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	smoother.Next(Lighting{ColorTemp: 4000, Brightness: 50}, 30, start)
+
+	steps := []struct {
+		target Lighting
+		ok     bool
+	}{
+		{Lighting{ColorTemp: 4000, Brightness: 50}, false},
+		{Lighting{ColorTemp: 4030, Brightness: 52}, false},
+		{Lighting{ColorTemp: 4050, Brightness: 50}, true},
+		{Lighting{ColorTemp: 4050, Brightness: 55}, true},
+		{Lighting{ColorTemp: 4050, Brightness: 55}, false},
+	}
+
+	for i, s := range steps {
+		got, _, ok := smoother.Next(s.target, 30, start.Add(time.Duration(i+1)*time.Minute))
+		if ok != s.ok || (ok && got != s.target) {
+			t.Errorf("smoother.Next(%+v) = %+v, %t, expected %t", s.target, got, ok, s.ok)
+		} else {
+			t.Logf("smoother.Next(%+v) = %+v, %t, expected %t", s.target, got, ok, s.ok)
+		}
+	}
+
+}
+
+func TestSmootherHysteresis(t *testing.T) {
+
+	// Changes below the threshold are only sent when the phase changes
+	smoother := Smoother{ColorTempThreshold: 1000, Hysteresis: 0.5}
+	start := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	smoother.Next(Lighting{ColorTemp: 2500, Brightness: 100}, -1.5, start)
+
+	steps := []struct {
+		elevation float64
+		target    Lighting
+		expected  Lighting
+		ok        bool
+	}{
+		{-1, Lighting{ColorTemp: 2600, Brightness: 100}, Lighting{ColorTemp: 2500, Brightness: 100}, false},
+		{-0.5, Lighting{ColorTemp: 2700, Brightness: 100}, Lighting{ColorTemp: 2500, Brightness: 100}, false},
+		{-0.5, Lighting{ColorTemp: 2700, Brightness: 50}, Lighting{ColorTemp: 2700, Brightness: 50}, true},
+		{0, Lighting{ColorTemp: 2800, Brightness: 50}, Lighting{ColorTemp: 2800, Brightness: 50}, true},
+		{-1, Lighting{ColorTemp: 2750, Brightness: 50}, Lighting{ColorTemp: 2800, Brightness: 50}, false},
+		{-1.5, Lighting{ColorTemp: 2600, Brightness: 50}, Lighting{ColorTemp: 2600, Brightness: 50}, true},
+	}
+
+	for i, s := range steps {
+		got, _, ok := smoother.Next(s.target, s.elevation, start.Add(time.Duration(i+1)*time.Minute))
+		if ok != s.ok || got != s.expected {
+			t.Errorf("smoother.Next(%+v) at %f° = %+v, %t, expected %+v, %t", s.target, s.elevation, got, ok, s.expected, s.ok)
+		} else {
+			t.Logf("smoother.Next(%+v) at %f° = %+v, %t, expected %+v, %t", s.target, s.elevation, got, ok, s.expected, s.ok)
+		}
+	}
+
+}
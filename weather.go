@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+// Weather is the sky condition at a time. CloudCover is between 0 (clear) and
+// 1 (overcast), Visibility in meters (0 when unknown) and Precipitation in mm
+// per hour.
+type Weather struct {
+	Time          time.Time `json:"time"`
+	CloudCover    float64   `json:"cloudCover"`
+	Visibility    float64   `json:"visibility"`
+	Precipitation float64   `json:"precipitation"`
+}
+
+// WeatherProvider returns the weather at a place and time.
+type WeatherProvider interface {
+	Weather(date time.Time, latitude float64, longitude float64) (Weather, error)
+}
+
+// Color temperature of an overcast sky, and how much the lights are bluer and
+// dimmer under it.
+const (
+	overcastColorTemp  = 6500
+	overcastBlending   = 0.5
+	overcastBrightness = 0.7
+)
+
+// overcast returns how much the sky is overcast, between 0 and 1, fog and rain
+// darkening the sky as much as clouds.
+func (w Weather) overcast() float64 {
+	overcast := w.CloudCover
+	if w.Visibility > 0 && w.Visibility < 10000 {
+		overcast = math.Max(overcast, 1-w.Visibility/10000)
+	}
+	overcast = math.Max(overcast, w.Precipitation/4)
+	return math.Max(0, math.Min(1, overcast))
+}
+
+// Adjust makes day lighting bluer and dimmer when the sky is overcast, keeping
+// the Duv of its chromaticity when set. Night lighting, whose color
+// temperature is at most 3000K, is left untouched.
+func (w Weather) Adjust(lighting Lighting) Lighting {
+	if lighting.ColorTemp <= 3000 {
+		return lighting
+	}
+	overcast := w.overcast()
+	if lighting.ColorTemp < overcastColorTemp {
+		lighting.ColorTemp += int64(math.Round(overcast * overcastBlending * float64(overcastColorTemp-lighting.ColorTemp)))
+	}
+	lighting.Brightness = int64(math.Round(float64(lighting.Brightness) * (1 - overcast*(1-overcastBrightness))))
+	if lighting.Chromaticity != (color.XY{}) {
+		lighting.Chromaticity = color.CCTToXY(float64(lighting.ColorTemp), lighting.duv())
+	}
+	return lighting
+}
+
+// FileWeatherProvider reads the weather from a JSON file holding an array of
+// Weather sorted by time. The weather at a time is the last one before it.
+type FileWeatherProvider struct {
+	Path string
+}
+
+func (p FileWeatherProvider) Weather(date time.Time, latitude float64, longitude float64) (Weather, error) {
+	b, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return Weather{}, err
+	}
+	var forecast []Weather
+	if err := json.Unmarshal(b, &forecast); err != nil {
+		return Weather{}, fmt.Errorf("parsing %s: %w", p.Path, err)
+	}
+	return lastWeather(forecast, date)
+}
+
+func lastWeather(forecast []Weather, date time.Time) (Weather, error) {
+	for i := len(forecast) - 1; i >= 0; i-- {
+		if !forecast[i].Time.After(date) {
+			return forecast[i], nil
+		}
+	}
+	return Weather{}, fmt.Errorf("no weather before %v", date)
+}
+
+// HTTPWeatherProvider fetches the hourly weather from an Open-Meteo compatible
+// forecast endpoint such as https://api.open-meteo.com/v1/forecast, keeping
+// the query of the URL, within Timeout, 10s by default. A nil Client is
+// http.DefaultClient.
+type HTTPWeatherProvider struct {
+	URL     string
+	Client  *http.Client
+	Timeout time.Duration
+}
+
+type openMeteoForecast struct {
+	Hourly struct {
+		Time          []string  `json:"time"`
+		CloudCover    []float64 `json:"cloud_cover"`
+		Visibility    []float64 `json:"visibility"`
+		Precipitation []float64 `json:"precipitation"`
+	} `json:"hourly"`
+}
+
+func (p HTTPWeatherProvider) Weather(date time.Time, latitude float64, longitude float64) (Weather, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return Weather{}, fmt.Errorf("fetching weather: %w", err)
+	}
+	day := date.UTC().Format("2006-01-02")
+	query := u.Query()
+	query.Set("latitude", fmt.Sprintf("%f", latitude))
+	query.Set("longitude", fmt.Sprintf("%f", longitude))
+	query.Set("hourly", "cloud_cover,visibility,precipitation")
+	query.Set("timezone", "GMT")
+	query.Set("start_date", day)
+	query.Set("end_date", day)
+	u.RawQuery = query.Encode()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return Weather{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Weather{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Weather{}, fmt.Errorf("fetching weather from %s: %s", p.URL, resp.Status)
+	}
+	var response openMeteoForecast
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return Weather{}, fmt.Errorf("parsing weather from %s: %w", p.URL, err)
+	}
+	hourly := response.Hourly
+	if len(hourly.CloudCover) != len(hourly.Time) || len(hourly.Visibility) != len(hourly.Time) || len(hourly.Precipitation) != len(hourly.Time) {
+		return Weather{}, fmt.Errorf("parsing weather from %s: hourly series of different lengths", p.URL)
+	}
+	forecast := make([]Weather, len(hourly.Time))
+	for i, t := range hourly.Time {
+		forecast[i].Time, err = time.Parse("2006-01-02T15:04", t)
+		if err != nil {
+			return Weather{}, fmt.Errorf("parsing weather from %s: %w", p.URL, err)
+		}
+		forecast[i].CloudCover = hourly.CloudCover[i] / 100
+		forecast[i].Visibility = hourly.Visibility[i]
+		forecast[i].Precipitation = hourly.Precipitation[i]
+	}
+	return lastWeather(forecast, date)
+}
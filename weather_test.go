@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+func TestWeatherAdjust(t *testing.T) {
+
+	day := Lighting{ColorTemp: 4500, Brightness: 100, Chromaticity: color.CCTToXY(4500, 0.002)}
+	night := Lighting{ColorTemp: 2000, Brightness: 50, Chromaticity: color.CCTToXY(2000, 0)}
+	weathers := make(map[Weather][2]Lighting)
+	weathers[Weather{}] = [2]Lighting{day, night}
+	weathers[Weather{CloudCover: 1}] = [2]Lighting{{ColorTemp: 5500, Brightness: 70}, night}
+	weathers[Weather{CloudCover: 0.2, Visibility: 5000}] = [2]Lighting{{ColorTemp: 5000, Brightness: 85}, night}
+	weathers[Weather{Precipitation: 8}] = [2]Lighting{{ColorTemp: 5500, Brightness: 70}, night}
+
+	for k, v := range weathers {
+		for i, lighting := range []Lighting{day, night} {
+			got := k.Adjust(lighting)
+			if got.ColorTemp != v[i].ColorTemp || got.Brightness != v[i].Brightness {
+				t.Errorf("%+v.Adjust(%d, %d) = %d, %d, expected %d, %d", k, lighting.ColorTemp, lighting.Brightness, got.ColorTemp, got.Brightness, v[i].ColorTemp, v[i].Brightness)
+			} else {
+				t.Logf("%+v.Adjust(%d, %d) = %d, %d, expected %d, %d", k, lighting.ColorTemp, lighting.Brightness, got.ColorTemp, got.Brightness, v[i].ColorTemp, v[i].Brightness)
+			}
+			cct, duv := color.XYToCCT(got.Chromaticity)
+			_, expectedDuv := color.XYToCCT(lighting.Chromaticity)
+			if math.Abs(cct-float64(got.ColorTemp)) > 5 || math.Abs(duv-expectedDuv) > 0.0001 {
+				t.Errorf("%+v.Adjust(%d, %d) chromaticity has CCT %f and Duv %f", k, lighting.ColorTemp, lighting.Brightness, cct, duv)
+			}
+		}
+	}
+
+	// Lighting without chromaticity keeps none
+	plain := Lighting{ColorTemp: 4500, Brightness: 100}
+	if got := (Weather{CloudCover: 1}).Adjust(plain); got.ColorTemp != 5500 || got.Chromaticity != (color.XY{}) {
+		t.Errorf("Adjust(%+v) = %+v, expected 5500K without chromaticity", plain, got)
+	}
+
+}
+
+func TestFileWeatherProvider(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "weather.json")
+	forecast := `[
+		{"time": "2021-06-21T10:00:00Z", "cloudCover": 0.1, "visibility": 20000, "precipitation": 0},
+		{"time": "2021-06-21T11:00:00Z", "cloudCover": 0.9, "visibility": 8000, "precipitation": 1.5}
+	]`
+	if err := ioutil.WriteFile(path, []byte(forecast), 0644); err != nil {
+		t.Fatal(err)
+	}
+	provider := FileWeatherProvider{Path: path}
+
+	dates := make(map[time.Time]float64)
+	dates[time.Date(2021, 6, 21, 10, 30, 0, 0, time.UTC)] = 0.1
+	dates[time.Date(2021, 6, 21, 11, 0, 0, 0, time.UTC)] = 0.9
+	dates[time.Date(2021, 6, 21, 18, 0, 0, 0, time.UTC)] = 0.9
+
+	for k, v := range dates {
+		got, err := provider.Weather(k, 48.87, 2.67)
+		if err != nil || got.CloudCover != v {
+			t.Errorf("provider.Weather(%v) = %+v, %v, expected cloud cover %f", k, got, err, v)
+		} else {
+			t.Logf("provider.Weather(%v) = %+v, %v, expected cloud cover %f", k, got, err, v)
+		}
+	}
+
+	if got, err := provider.Weather(time.Date(2021, 6, 21, 9, 0, 0, 0, time.UTC), 48.87, 2.67); err == nil {
+		t.Errorf("provider.Weather() before the forecast = %+v, expected an error", got)
+	}
+	if got, err := (FileWeatherProvider{Path: filepath.Join(t.TempDir(), "missing.json")}).Weather(time.Now(), 48.87, 2.67); err == nil {
+		t.Errorf("provider.Weather() from a missing file = %+v, expected an error", got)
+	}
+
+}
+
+func TestHTTPWeatherProvider(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/v1/forecast" || q.Get("apikey") != "secret" || q.Get("latitude") != "48.870000" || q.Get("longitude") != "2.670000" || q.Get("start_date") != "2021-06-21" {
+			http.Error(w, "unexpected query", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{
+			"latitude": 48.87,
+			"longitude": 2.67,
+			"hourly": {
+				"time": ["2021-06-21T00:00", "2021-06-21T01:00", "2021-06-21T02:00"],
+				"cloud_cover": [0, 50, 100],
+				"visibility": [24140, 24140, 1200],
+				"precipitation": [0, 0, 2.4]
+			}
+		}`)
+	}))
+	defer server.Close()
+	provider := HTTPWeatherProvider{URL: server.URL + "/v1/forecast?apikey=secret"}
+
+	dates := make(map[time.Time]Weather)
+	dates[time.Date(2021, 6, 21, 0, 30, 0, 0, time.UTC)] = Weather{Time: time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC), CloudCover: 0, Visibility: 24140}
+	dates[time.Date(2021, 6, 21, 1, 0, 0, 0, time.UTC)] = Weather{Time: time.Date(2021, 6, 21, 1, 0, 0, 0, time.UTC), CloudCover: 0.5, Visibility: 24140}
+	dates[time.Date(2021, 6, 21, 4, 0, 0, 0, time.FixedZone("CEST", 2*60*60))] = Weather{Time: time.Date(2021, 6, 21, 2, 0, 0, 0, time.UTC), CloudCover: 1, Visibility: 1200, Precipitation: 2.4}
+
+	for k, v := range dates {
+		got, err := provider.Weather(k, 48.87, 2.67)
+		if err != nil || !got.Time.Equal(v.Time) || got.CloudCover != v.CloudCover || got.Visibility != v.Visibility || got.Precipitation != v.Precipitation {
+			t.Errorf("provider.Weather(%v) = %+v, %v, expected %+v", k, got, err, v)
+		} else {
+			t.Logf("provider.Weather(%v) = %+v, %v, expected %+v", k, got, err, v)
+		}
+	}
+
+	if got, err := provider.Weather(time.Date(2021, 6, 21, 1, 0, 0, 0, time.UTC), 0, 0); err == nil {
+		t.Errorf("provider.Weather() with a bad request = %+v, expected an error", got)
+	}
+
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+	provider = HTTPWeatherProvider{URL: hanging.URL, Timeout: 50 * time.Millisecond}
+	if got, err := provider.Weather(time.Date(2021, 6, 21, 1, 0, 0, 0, time.UTC), 48.87, 2.67); err == nil {
+		t.Errorf("provider.Weather() without a response = %+v, expected an error", got)
+	}
+
+}
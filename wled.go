@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sundae-party/circadian-lighting/color"
+)
+
+// WLED drives LED strips running WLED through its JSON API. Zones maps the
+// zones to segments, as "<host>/<segment id>", or to the main segment of a
+// strip as "<host>". Segments with color temperature support are set with
+// their white channels, RGB segments with the sRGB color of the color
+// temperature, and white segments only dimmed. A nil Client is http.DefaultClient.
+type WLED struct {
+	Client *http.Client
+	Zones  map[string][]string
+
+	mu     sync.Mutex
+	lights map[string]Light
+}
+
+type wledInfo struct {
+	Name string `json:"name"`
+	LEDs struct {
+		SegmentCapabilities []int `json:"seglc"`
+	} `json:"leds"`
+}
+
+type wledSegment struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"n,omitempty"`
+	On         *bool     `json:"on,omitempty"`
+	Brightness *int64    `json:"bri,omitempty"`
+	Colors     [][]int64 `json:"col,omitempty"`
+	ColorTemp  *int64    `json:"cct,omitempty"`
+}
+
+type wledState struct {
+	On         *bool         `json:"on,omitempty"`
+	Brightness *int64        `json:"bri,omitempty"`
+	Transition *int64        `json:"tt,omitempty"`
+	Segments   []wledSegment `json:"seg"`
+}
+
+// Segment capabilities reported by WLED.
+const (
+	wledRGB = 1
+	wledCCT = 4
+)
+
+var (
+	wledCCTCapabilities = Capabilities{MinColorTemp: 1900, MaxColorTemp: 10091, BrightnessSteps: 255}
+	wledRGBCapabilities = Capabilities{BrightnessSteps: 255, Gamut: GamutSRGB}
+)
+
+// requestJSON sends a request with a JSON body, when not nil, and decodes the
+// JSON response into result, when not nil.
+func requestJSON(ctx context.Context, client *http.Client, method string, url string, body interface{}, result interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("%s %s: %w", method, url, err)
+	}
+	return nil
+}
+
+// rgb255 returns the sRGB color of the lighting with 8 bit components.
+func rgb255(lighting Lighting) []int64 {
+	rgb := lighting.rgb()
+	return []int64{int64(math.Round(255 * rgb.R)), int64(math.Round(255 * rgb.G)), int64(math.Round(255 * rgb.B))}
+}
+
+// wledSegmentID splits a segment into its host and segment id.
+func wledSegmentID(light string) (string, int, error) {
+	i := strings.LastIndex(light, "/")
+	if i < 0 {
+		return light, 0, nil
+	}
+	id, err := strconv.Atoi(light[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("wled: invalid segment %q", light)
+	}
+	return light[:i], id, nil
+}
+
+// hosts returns the hosts of the zones.
+func (w *WLED) hosts() ([]string, error) {
+	hosts := make(map[string]bool)
+	for _, lights := range w.Zones {
+		for _, light := range lights {
+			host, _, err := wledSegmentID(light)
+			if err != nil {
+				return nil, err
+			}
+			hosts[host] = true
+		}
+	}
+	var sorted []string
+	for host := range hosts {
+		sorted = append(sorted, host)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// Discover returns the segments of the strips of the zones, as
+// "<host>/<segment id>".
+func (w *WLED) Discover(ctx context.Context) ([]Light, error) {
+	hosts, err := w.hosts()
+	if err != nil {
+		return nil, err
+	}
+	lights := make(map[string]Light)
+	var discovered []Light
+	for _, host := range hosts {
+		var response struct {
+			State wledState `json:"state"`
+			Info  wledInfo  `json:"info"`
+		}
+		if err := requestJSON(ctx, w.Client, http.MethodGet, "http://"+host+"/json", nil, &response); err != nil {
+			return nil, fmt.Errorf("wled: %w", err)
+		}
+		for i, segment := range response.State.Segments {
+			light := Light{ID: fmt.Sprintf("%s/%d", host, segment.ID), Name: response.Info.Name, Capabilities: wledRGBCapabilities}
+			if segment.Name != "" {
+				light.Name += " " + segment.Name
+			}
+			if i < len(response.Info.LEDs.SegmentCapabilities) {
+				switch capabilities := response.Info.LEDs.SegmentCapabilities[i]; {
+				case capabilities&wledCCT != 0:
+					light.Capabilities = wledCCTCapabilities
+				case capabilities&wledRGB == 0:
+					light.Capabilities = Capabilities{BrightnessSteps: 255}
+				}
+			}
+			lights[light.ID] = light
+			discovered = append(discovered, light)
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lights = lights
+	return discovered, nil
+}
+
+// Capabilities returns what a discovered segment supports.
+func (w *WLED) Capabilities(light string) (Capabilities, bool) {
+	host, id, err := wledSegmentID(light)
+	if err != nil {
+		return Capabilities{}, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	l, ok := w.lights[fmt.Sprintf("%s/%d", host, id)]
+	return l.Capabilities, ok
+}
+
+// Apply sets the segments of the zone of the setpoint, with its transition,
+// turning the strips on and the segments on or off with their brightness.
+// Color temperature segments are set with their white channel at full scale,
+// the color temperature splitting it between the warm and cold LEDs. Segments
+// not discovered yet are set as RGB segments.
+func (w *WLED) Apply(ctx context.Context, setpoint Setpoint) error {
+	lights, ok := w.Zones[setpoint.Zone]
+	if !ok {
+		return fmt.Errorf("wled: %w %q", ErrUnknownZone, setpoint.Zone)
+	}
+	transition := int64(math.Round(float64(setpoint.Transition.Milliseconds()) / 100))
+	on := true
+	states := make(map[string]*wledState)
+	var hosts []string
+	for _, light := range lights {
+		host, id, err := wledSegmentID(light)
+		if err != nil {
+			return err
+		}
+		c, ok := w.Capabilities(light)
+		if !ok {
+			c = wledRGBCapabilities
+		}
+		lighting, _ := c.Map(setpoint.Lighting)
+		level := c.Level(lighting.Brightness)
+		lit := level > 0
+		segment := wledSegment{ID: id, On: &lit, Brightness: &level}
+		if c.MaxColorTemp > 0 {
+			segment.ColorTemp = &lighting.ColorTemp
+			segment.Colors = [][]int64{{0, 0, 0, 255}}
+		} else if c.Gamut != ([3]color.XY{}) {
+			segment.Colors = [][]int64{rgb255(lighting)}
+		}
+		if states[host] == nil {
+			states[host] = &wledState{On: &on, Transition: &transition}
+			hosts = append(hosts, host)
+		}
+		states[host].Segments = append(states[host].Segments, segment)
+	}
+	for _, host := range hosts {
+		if err := requestJSON(ctx, w.Client, http.MethodPost, "http://"+host+"/json/state", states[host], nil); err != nil {
+			return fmt.Errorf("wled: %w", err)
+		}
+	}
+	return nil
+}
+
+// State returns the current lighting of a segment.
+func (w *WLED) State(ctx context.Context, light string) (Lighting, error) {
+	host, id, err := wledSegmentID(light)
+	if err != nil {
+		return Lighting{}, err
+	}
+	var state wledState
+	if err := requestJSON(ctx, w.Client, http.MethodGet, "http://"+host+"/json/state", nil, &state); err != nil {
+		return Lighting{}, fmt.Errorf("wled: %w", err)
+	}
+	for _, segment := range state.Segments {
+		if segment.ID != id {
+			continue
+		}
+		var lighting Lighting
+		if segment.ColorTemp != nil && *segment.ColorTemp > 255 {
+			lighting.ColorTemp = *segment.ColorTemp
+		} else if len(segment.Colors) > 0 && len(segment.Colors[0]) >= 3 {
+			c := segment.Colors[0]
+			cct, _ := color.RGBToCCT(color.RGB{R: float64(c[0]) / 255, G: float64(c[1]) / 255, B: float64(c[2]) / 255})
+			lighting.ColorTemp = int64(math.Round(cct))
+		}
+		brightness := 255.0
+		if state.Brightness != nil {
+			brightness = float64(*state.Brightness)
+		}
+		if segment.Brightness != nil {
+			brightness *= float64(*segment.Brightness) / 255
+		}
+		lighting.Brightness = int64(math.Round(brightness * 100 / 255))
+		if state.On != nil && !*state.On || segment.On != nil && !*segment.On {
+			lighting.Brightness = 0
+		}
+		return lighting, nil
+	}
+	return Lighting{}, fmt.Errorf("wled: unknown segment %s", light)
+}
+
+// Close closes the idle connections to the strips.
+func (w *WLED) Close() error {
+	if w.Client != nil {
+		w.Client.CloseIdleConnections()
+	}
+	return nil
+}
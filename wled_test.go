@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWLED is a stand-in of a WLED strip with a CCT segment and an RGB
+// segment, recording the state updates it receives.
+type fakeWLED struct {
+	mu      sync.Mutex
+	state   wledState
+	updates []string
+}
+
+func newFakeWLED(t *testing.T) (*fakeWLED, string) {
+	on, brightness, full := true, int64(128), int64(255)
+	cct := int64(2700)
+	strip := &fakeWLED{state: wledState{On: &on, Brightness: &brightness, Segments: []wledSegment{
+		{ID: 0, Name: "White", Brightness: &full, ColorTemp: &cct},
+		{ID: 1, Name: "Color", Brightness: &full, Colors: [][]int64{{255, 160, 80}, {0, 0, 0}, {0, 0, 0}}},
+	}}}
+	server := httptest.NewServer(strip)
+	t.Cleanup(server.Close)
+	return strip, strings.TrimPrefix(server.URL, "http://")
+}
+
+func (s *fakeWLED) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/json":
+		info := map[string]interface{}{"name": "Shelf", "leds": map[string]interface{}{"count": 60, "seglc": []int{6, 1}}}
+		json.NewEncoder(w).Encode(map[string]interface{}{"state": s.state, "info": info})
+	case r.Method == http.MethodGet && r.URL.Path == "/json/state":
+		json.NewEncoder(w).Encode(s.state)
+	case r.Method == http.MethodPost && r.URL.Path == "/json/state":
+		var body json.RawMessage
+		var update wledState
+		if json.NewDecoder(r.Body).Decode(&body) != nil || json.Unmarshal(body, &update) != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		s.updates = append(s.updates, string(body))
+		for _, segment := range update.Segments {
+			current := &s.state.Segments[segment.ID]
+			if segment.On != nil {
+				current.On = segment.On
+			}
+			if segment.Brightness != nil {
+				current.Brightness = segment.Brightness
+			}
+			if segment.ColorTemp != nil {
+				current.ColorTemp = segment.ColorTemp
+			}
+			if segment.Colors != nil {
+				current.Colors = segment.Colors
+			}
+		}
+		json.NewEncoder(w).Encode(s.state)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeWLED) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updates := s.updates
+	s.updates = nil
+	return updates
+}
+
+func TestWLED(t *testing.T) {
+
+	strip, host := newFakeWLED(t)
+	wled := &WLED{Zones: map[string][]string{"shelf": {host + "/0", host + "/1"}, "bar": {host + "/1"}}}
+	defer wled.Close()
+	ctx := context.Background()
+
+	lights, err := wled.Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Light{
+		{ID: host + "/0", Name: "Shelf White", Capabilities: wledCCTCapabilities},
+		{ID: host + "/1", Name: "Shelf Color", Capabilities: wledRGBCapabilities},
+	}
+	if len(lights) != len(expected) {
+		t.Fatalf("wled.Discover() = %+v, expected %+v", lights, expected)
+	}
+	for i := range expected {
+		if lights[i] != expected[i] {
+			t.Errorf("wled.Discover()[%d] = %+v, expected %+v", i, lights[i], expected[i])
+		}
+	}
+
+	setpoints := []struct {
+		setpoint Setpoint
+		expected string
+	}{
+		{
+			Setpoint{Zone: "shelf", Lighting: Lighting{ColorTemp: 2700, Brightness: 50}, Transition: 2 * time.Second},
+			`{"on":true,"tt":20,"seg":[{"id":0,"on":true,"bri":128,"col":[[0,0,0,255]],"cct":2700},{"id":1,"on":true,"bri":128,"col":[[255,173,88]]}]}`,
+		},
+		{
+			Setpoint{Zone: "bar", Lighting: Lighting{ColorTemp: 6500, Brightness: 100}},
+			`{"on":true,"tt":0,"seg":[{"id":1,"on":true,"bri":255,"col":[[255,248,254]]}]}`,
+		},
+		{
+			Setpoint{Zone: "shelf", Lighting: Lighting{ColorTemp: 1500, Brightness: 20}, Transition: 250 * time.Millisecond},
+			`{"on":true,"tt":3,"seg":[{"id":0,"on":true,"bri":51,"col":[[0,0,0,255]],"cct":1900},{"id":1,"on":true,"bri":51,"col":[[255,102,0]]}]}`,
+		},
+	}
+	for _, s := range setpoints {
+		if err := wled.Apply(ctx, s.setpoint); err != nil {
+			t.Fatal(err)
+		}
+		if got := strip.sent(); len(got) != 1 || got[0] != s.expected {
+			t.Errorf("wled.Apply(%+v) = %v, expected %s", s.setpoint, got, s.expected)
+		}
+	}
+
+	states := make(map[string]Lighting)
+	states[host+"/0"] = Lighting{ColorTemp: 1900, Brightness: 10}
+	states[host+"/1"] = Lighting{ColorTemp: 1521, Brightness: 10}
+	for k, v := range states {
+		if got, err := wled.State(ctx, k); err != nil || got != v {
+			t.Errorf("wled.State(%s) = %+v, %v, expected %+v", k, got, err, v)
+		}
+	}
+	if err := wled.Apply(ctx, Setpoint{Zone: "garage"}); err == nil {
+		t.Errorf("wled.Apply() succeeded on an unknown zone")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// yeelightCapabilities are the color temperature range and brightness of
+// Yeelight bulbs, which cannot be dimmed to 0.
+var yeelightCapabilities = Capabilities{MinColorTemp: 1700, MaxColorTemp: 6500, MinBrightness: 1}
+
+// Yeelight drives Yeelight bulbs with their LAN control protocol, JSON-RPC
+// over TCP. Zones maps the zones to the addresses of the bulbs, with LAN
+// control enabled, as "<host>:55443". Bulbs accept about one command per
+// second, so with Music set the driver opens a music mode connection to each
+// bulb, on which commands are not limited nor answered. Timeout bounds the
+// connections and responses, 5s when 0.
+type Yeelight struct {
+	Zones   map[string][]string
+	Music   bool
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	bulbs map[string]*yeelightBulb
+}
+
+// yeelightBulb is the connection to a bulb, and its music mode connection.
+type yeelightBulb struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	music  net.Conn
+	id     int
+}
+
+type yeelightRequest struct {
+	ID     int           `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+type yeelightResponse struct {
+	ID     int               `json:"id"`
+	Result []json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (y *Yeelight) timeout() time.Duration {
+	if y.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return y.Timeout
+}
+
+// bulb returns the connection to a bulb, connecting it when needed.
+func (y *Yeelight) bulb(ctx context.Context, address string) (*yeelightBulb, error) {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	if b, ok := y.bulbs[address]; ok {
+		return b, nil
+	}
+	dialer := net.Dialer{Timeout: y.timeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("yeelight: %w", err)
+	}
+	if y.bulbs == nil {
+		y.bulbs = make(map[string]*yeelightBulb)
+	}
+	b := &yeelightBulb{conn: conn, reader: bufio.NewReader(conn)}
+	y.bulbs[address] = b
+	return b, nil
+}
+
+// drop closes the connections to a bulb after an error, so that the next
+// command connects again.
+func (y *Yeelight) drop(address string, b *yeelightBulb) {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	if y.bulbs[address] == b {
+		delete(y.bulbs, address)
+	}
+	b.conn.Close()
+	if b.music != nil {
+		b.music.Close()
+	}
+}
+
+// call sends a command to a bulb and returns its result, skipping the
+// notifications sent meanwhile.
+func (y *Yeelight) call(ctx context.Context, address string, method string, params ...interface{}) ([]json.RawMessage, error) {
+	b, err := y.bulb(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result, err := y.send(b, method, params)
+	if err != nil {
+		y.drop(address, b)
+		return nil, fmt.Errorf("yeelight: %s: %s: %w", address, method, err)
+	}
+	return result, nil
+}
+
+func (y *Yeelight) send(b *yeelightBulb, method string, params []interface{}) ([]json.RawMessage, error) {
+	b.id++
+	request, err := json.Marshal(yeelightRequest{ID: b.id, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	b.conn.SetDeadline(time.Now().Add(y.timeout()))
+	if _, err := b.conn.Write(append(request, '\r', '\n')); err != nil {
+		return nil, err
+	}
+	for {
+		line, err := b.reader.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		var response yeelightResponse
+		if err := json.Unmarshal(line, &response); err != nil {
+			return nil, err
+		}
+		if response.ID != b.id {
+			continue
+		}
+		if response.Error != nil {
+			return nil, fmt.Errorf("error %d: %s", response.Error.Code, response.Error.Message)
+		}
+		return response.Result, nil
+	}
+}
+
+// startMusic asks a bulb to connect back to the driver, and returns the music
+// mode connection.
+func (y *Yeelight) startMusic(b *yeelightBulb) (net.Conn, error) {
+	host := b.conn.LocalAddr().(*net.TCPAddr).IP
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: host})
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	if _, err := y.send(b, "set_music", []interface{}{1, host.String(), port}); err != nil {
+		return nil, err
+	}
+	listener.SetDeadline(time.Now().Add(y.timeout()))
+	return listener.Accept()
+}
+
+// commands sends commands to a bulb, on its music mode connection with Music.
+func (y *Yeelight) commands(ctx context.Context, address string, commands []yeelightRequest) error {
+	if !y.Music {
+		for _, command := range commands {
+			if _, err := y.call(ctx, address, command.Method, command.Params...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	b, err := y.bulb(ctx, address)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.music == nil {
+		if b.music, err = y.startMusic(b); err != nil {
+			y.drop(address, b)
+			return fmt.Errorf("yeelight: %s: music mode: %w", address, err)
+		}
+	}
+	for _, command := range commands {
+		b.id++
+		command.ID = b.id
+		request, err := json.Marshal(command)
+		if err != nil {
+			return err
+		}
+		b.music.SetWriteDeadline(time.Now().Add(y.timeout()))
+		if _, err := b.music.Write(append(request, '\r', '\n')); err != nil {
+			y.drop(address, b)
+			return fmt.Errorf("yeelight: %s: %s: %w", address, command.Method, err)
+		}
+	}
+	return nil
+}
+
+// Discover returns the bulbs of the zones, with their name.
+func (y *Yeelight) Discover(ctx context.Context) ([]Light, error) {
+	var lights []Light
+	discovered := make(map[string]bool)
+	for _, zone := range y.Zones {
+		for _, address := range zone {
+			if discovered[address] {
+				continue
+			}
+			result, err := y.call(ctx, address, "get_prop", "name")
+			if err != nil {
+				return nil, err
+			}
+			light := Light{ID: address, Capabilities: yeelightCapabilities}
+			if len(result) > 0 {
+				json.Unmarshal(result[0], &light.Name)
+			}
+			lights = append(lights, light)
+			discovered[address] = true
+		}
+	}
+	return lights, nil
+}
+
+// Capabilities returns what the bulbs support.
+func (y *Yeelight) Capabilities(light string) (Capabilities, bool) {
+	return yeelightCapabilities, true
+}
+
+// Apply sets the bulbs of the zone of the setpoint, with its transition.
+func (y *Yeelight) Apply(ctx context.Context, setpoint Setpoint) error {
+	addresses, ok := y.Zones[setpoint.Zone]
+	if !ok {
+		return fmt.Errorf("yeelight: %w %q", ErrUnknownZone, setpoint.Zone)
+	}
+	lighting, _ := yeelightCapabilities.Map(setpoint.Lighting)
+	effect, duration := "sudden", int64(0)
+	if setpoint.Transition >= 30*time.Millisecond {
+		effect, duration = "smooth", setpoint.Transition.Milliseconds()
+	}
+	commands := []yeelightRequest{
+		{Method: "set_ct_abx", Params: []interface{}{lighting.ColorTemp, effect, duration}},
+		{Method: "set_bright", Params: []interface{}{yeelightCapabilities.Level(lighting.Brightness), effect, duration}},
+	}
+	for _, address := range addresses {
+		if err := y.commands(ctx, address, commands); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// State returns the current lighting of a bulb.
+func (y *Yeelight) State(ctx context.Context, light string) (Lighting, error) {
+	result, err := y.call(ctx, light, "get_prop", "power", "bright", "ct")
+	if err != nil {
+		return Lighting{}, err
+	}
+	values := make([]string, 3)
+	for i := range values {
+		if i < len(result) {
+			json.Unmarshal(result[i], &values[i])
+		}
+	}
+	var lighting Lighting
+	lighting.Brightness, _ = strconv.ParseInt(values[1], 10, 64)
+	lighting.ColorTemp, _ = strconv.ParseInt(values[2], 10, 64)
+	if values[0] != "on" {
+		lighting.Brightness = 0
+	}
+	return lighting, nil
+}
+
+// Close closes the connections to the bulbs.
+func (y *Yeelight) Close() error {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	for address, b := range y.bulbs {
+		b.conn.Close()
+		if b.music != nil {
+			b.music.Close()
+		}
+		delete(y.bulbs, address)
+	}
+	return nil
+}
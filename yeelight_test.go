@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeYeelight is a stand-in of a Yeelight bulb, recording the commands it
+// receives on its control and music mode connections.
+type fakeYeelight struct {
+	listener net.Listener
+	mu       sync.Mutex
+	props    map[string]string
+	commands []string
+}
+
+func newFakeYeelight(t *testing.T, name string) *fakeYeelight {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	bulb := &fakeYeelight{listener: listener, props: map[string]string{"name": name, "power": "on", "bright": "100", "ct": "4000"}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go bulb.serve(conn, true)
+		}
+	}()
+	return bulb
+}
+
+func (b *fakeYeelight) serve(conn net.Conn, respond bool) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var request yeelightRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.commands = append(b.commands, fmt.Sprint(request.Method, request.Params))
+		var result []interface{}
+		switch request.Method {
+		case "get_prop":
+			for _, p := range request.Params {
+				result = append(result, b.props[p.(string)])
+			}
+		case "set_ct_abx":
+			b.props["ct"] = fmt.Sprint(request.Params[0])
+		case "set_bright":
+			b.props["bright"] = fmt.Sprint(request.Params[0])
+		case "set_music":
+			music, err := net.Dial("tcp", fmt.Sprintf("%s:%v", request.Params[1], request.Params[2]))
+			if err == nil {
+				go b.serve(music, false)
+			}
+		}
+		b.mu.Unlock()
+		if !respond {
+			continue
+		}
+		if result == nil {
+			result = []interface{}{"ok"}
+		}
+		// Notifications are sent to all the connections when properties change.
+		fmt.Fprintf(conn, "{\"method\":\"props\",\"params\":{\"power\":\"on\"}}\r\n")
+		response, _ := json.Marshal(map[string]interface{}{"id": request.ID, "result": result})
+		conn.Write(append(response, '\r', '\n'))
+	}
+}
+
+func (b *fakeYeelight) received(n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		commands := b.commands
+		if len(commands) >= n || time.Now().After(deadline) {
+			b.commands = nil
+			b.mu.Unlock()
+			return commands
+		}
+		b.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestYeelight(t *testing.T) {
+
+	bulb := newFakeYeelight(t, "Bedside")
+	address := bulb.listener.Addr().String()
+	yeelight := &Yeelight{Zones: map[string][]string{"bedroom": {address}}}
+	defer yeelight.Close()
+	ctx := context.Background()
+
+	lights, err := yeelight.Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lights) != 1 || lights[0] != (Light{ID: address, Name: "Bedside", Capabilities: yeelightCapabilities}) {
+		t.Errorf("yeelight.Discover() = %+v", lights)
+	}
+	bulb.received(1)
+
+	setpoint := Setpoint{Zone: "bedroom", Lighting: Lighting{ColorTemp: 1500, Brightness: 0}, Transition: 2 * time.Second}
+	if err := yeelight.Apply(ctx, setpoint); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[set_ct_abx[1700 smooth 2000] set_bright[1 smooth 2000]]"
+	if got := bulb.received(2); fmt.Sprint(got) != expected {
+		t.Errorf("yeelight.Apply(%+v) = %v, expected %s", setpoint, got, expected)
+	}
+	state, err := yeelight.State(ctx, address)
+	if err != nil || state != (Lighting{ColorTemp: 1700, Brightness: 1}) {
+		t.Errorf("yeelight.State() = %+v, %v", state, err)
+	}
+	bulb.received(1)
+
+	yeelight.Music = true
+	for i, brightness := range []int64{40, 50, 60} {
+		setpoint := Setpoint{Zone: "bedroom", Lighting: Lighting{ColorTemp: 2700, Brightness: brightness}, Transition: 10 * time.Millisecond}
+		if err := yeelight.Apply(ctx, setpoint); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"set_ct_abx[2700 sudden 0]", fmt.Sprintf("set_bright[%d sudden 0]", brightness)}
+		if i == 0 {
+			// The music mode connection is opened once, on a port not known in
+			// advance.
+			got := bulb.received(3)
+			if len(got) == 0 || !strings.HasPrefix(got[0], "set_music[1 127.0.0.1 ") {
+				t.Fatalf("yeelight.Apply(%+v) in music mode = %v, expected set_music first", setpoint, got)
+			}
+			if fmt.Sprint(got[1:]) != fmt.Sprint(expected) {
+				t.Errorf("yeelight.Apply(%+v) in music mode = %v, expected %v", setpoint, got[1:], expected)
+			}
+		} else if got := bulb.received(2); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("yeelight.Apply(%+v) in music mode = %v, expected %v", setpoint, got, expected)
+		}
+	}
+
+	if err := yeelight.Apply(ctx, Setpoint{Zone: "garage"}); err == nil {
+		t.Errorf("yeelight.Apply() succeeded on an unknown zone")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/sundae-party/circadian-lighting/color"
+	"github.com/sundae-party/circadian-lighting/mqtt"
+)
+
+// Zigbee2MQTT drives lights behind Zigbee2MQTT. Zones maps the zones to the
+// friendly names of the devices and groups of lights they contain. Topics
+// start with BaseTopic, "zigbee2mqtt" when empty. The color temperature is
+// clamped to the range each light reports in the device list of the bridge,
+// the range of a group being the one all its members support.
+type Zigbee2MQTT struct {
+	Client    *mqtt.Client
+	BaseTopic string
+	Zones     map[string][]string
+	QoS       byte
+
+	// ownsClient is set when the client was connected by NewDriver.
+	ownsClient bool
+
+	// subscribeMu serializes the subscriptions, without holding mu while
+	// the broker answers.
+	subscribeMu sync.Mutex
+
+	mu         sync.Mutex
+	subscribed bool
+	closed     bool
+	devices    []z2mDevice
+	groups     []z2mGroup
+	lights     map[string]Light
+	states     map[string]Lighting
+	// received is closed and replaced when the device list, the group list or
+	// a state is received.
+	received chan struct{}
+}
+
+type z2mFeature struct {
+	Type     string       `json:"type"`
+	Name     string       `json:"name"`
+	ValueMin float64      `json:"value_min"`
+	ValueMax float64      `json:"value_max"`
+	Features []z2mFeature `json:"features"`
+}
+
+type z2mDevice struct {
+	FriendlyName string `json:"friendly_name"`
+	IEEEAddress  string `json:"ieee_address"`
+	Definition   *struct {
+		Exposes []z2mFeature `json:"exposes"`
+	} `json:"definition"`
+}
+
+type z2mGroup struct {
+	FriendlyName string `json:"friendly_name"`
+	Members      []struct {
+		IEEEAddress string `json:"ieee_address"`
+	} `json:"members"`
+}
+
+// z2mCommand is the payload setting a light. The transition is in seconds.
+type z2mCommand struct {
+	ColorTemp  int64   `json:"color_temp,omitempty"`
+	Brightness int64   `json:"brightness"`
+	Transition float64 `json:"transition"`
+}
+
+type z2mState struct {
+	State      string   `json:"state"`
+	ColorTemp  *float64 `json:"color_temp"`
+	Brightness *float64 `json:"brightness"`
+}
+
+// z2mBrightnessSteps is the brightness of a light at 100%.
+const z2mBrightnessSteps = 254
+
+func (z *Zigbee2MQTT) baseTopic() string {
+	if z.BaseTopic == "" {
+		return "zigbee2mqtt"
+	}
+	return z.BaseTopic
+}
+
+// z2mCapabilities returns what the features exposed by a device support, and
+// false if it is not a dimmable light.
+func z2mCapabilities(features []z2mFeature) (Capabilities, bool) {
+	var c Capabilities
+	var ok bool
+	for _, feature := range features {
+		switch feature.Name {
+		case "brightness":
+			c.BrightnessSteps, ok = int64(feature.ValueMax), true
+		case "color_temp":
+			c.MinMired, c.MaxMired = int64(feature.ValueMin), int64(feature.ValueMax)
+		}
+		if sub, light := z2mCapabilities(feature.Features); light {
+			c.BrightnessSteps, ok = sub.BrightnessSteps, true
+			if sub.MaxMired > 0 {
+				c.MinMired, c.MaxMired = sub.MinMired, sub.MaxMired
+			}
+		}
+	}
+	return c, ok
+}
+
+// discovered computes the lights from the device and group lists.
+func (z *Zigbee2MQTT) discovered() {
+	lights := make(map[string]Light)
+	addresses := make(map[string]Capabilities)
+	for _, device := range z.devices {
+		if device.Definition == nil {
+			continue
+		}
+		if c, ok := z2mCapabilities(device.Definition.Exposes); ok {
+			lights[device.FriendlyName] = Light{ID: device.FriendlyName, Name: device.FriendlyName, Capabilities: c}
+			addresses[device.IEEEAddress] = c
+		}
+	}
+	for _, group := range z.groups {
+		var members []Light
+		for _, member := range group.Members {
+			if c, ok := addresses[member.IEEEAddress]; ok {
+				members = append(members, Light{Capabilities: c})
+			}
+		}
+		if len(members) > 0 {
+			c := intersect(members)
+			c.BrightnessSteps = z2mBrightnessSteps
+			lights[group.FriendlyName] = Light{ID: group.FriendlyName, Name: group.FriendlyName, Capabilities: c}
+		}
+	}
+	z.lights = lights
+}
+
+func (z *Zigbee2MQTT) receive(m mqtt.Message) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.closed {
+		return
+	}
+	base := z.baseTopic() + "/"
+	name := strings.TrimPrefix(m.Topic, base)
+	switch {
+	case name == "bridge/devices":
+		var devices []z2mDevice
+		if json.Unmarshal(m.Payload, &devices) != nil {
+			return
+		}
+		z.devices = devices
+		z.discovered()
+	case name == "bridge/groups":
+		var groups []z2mGroup
+		if json.Unmarshal(m.Payload, &groups) != nil {
+			return
+		}
+		z.groups = groups
+		z.discovered()
+	case strings.HasPrefix(name, "bridge/") || strings.HasSuffix(name, "/set") || strings.HasSuffix(name, "/get") || strings.HasSuffix(name, "/availability"):
+		return
+	default:
+		var state z2mState
+		if json.Unmarshal(m.Payload, &state) != nil {
+			return
+		}
+		lighting := z.states[name]
+		if state.ColorTemp != nil && *state.ColorTemp > 0 {
+			lighting.ColorTemp = int64(math.Round(color.Kelvin(*state.ColorTemp)))
+		}
+		if state.Brightness != nil {
+			lighting.Brightness = int64(math.Round(*state.Brightness * 100 / z2mBrightnessSteps))
+		}
+		if state.State == "OFF" {
+			lighting.Brightness = 0
+		}
+		if z.states == nil {
+			z.states = make(map[string]Lighting)
+		}
+		z.states[name] = lighting
+	}
+	close(z.received)
+	z.received = make(chan struct{})
+}
+
+// wait waits until the condition holds, checking it each time a message is
+// received.
+func (z *Zigbee2MQTT) wait(ctx context.Context, condition func() bool) error {
+	for {
+		z.mu.Lock()
+		ok, received := condition(), z.received
+		z.mu.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-received:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// subscribe subscribes to the bridge and the states of the lights once it
+// succeeds.
+func (z *Zigbee2MQTT) subscribe() error {
+	z.subscribeMu.Lock()
+	defer z.subscribeMu.Unlock()
+	z.mu.Lock()
+	if z.subscribed {
+		z.mu.Unlock()
+		return nil
+	}
+	if z.received == nil {
+		z.received = make(chan struct{})
+	}
+	z.mu.Unlock()
+	if err := z.Client.Subscribe(z.baseTopic()+"/#", z.QoS, z.receive); err != nil {
+		return err
+	}
+	z.mu.Lock()
+	z.subscribed = true
+	z.mu.Unlock()
+	return nil
+}
+
+// Discover returns the lights and groups of lights listed by the bridge.
+func (z *Zigbee2MQTT) Discover(ctx context.Context) ([]Light, error) {
+	if err := z.subscribe(); err != nil {
+		return nil, err
+	}
+	err := z.wait(ctx, func() bool { return z.devices != nil && z.groups != nil })
+	if err != nil {
+		return nil, fmt.Errorf("zigbee2mqtt: device list: %w", err)
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var lights []Light
+	for _, light := range z.lights {
+		lights = append(lights, light)
+	}
+	return lights, nil
+}
+
+// Capabilities returns what a discovered light or group supports.
+func (z *Zigbee2MQTT) Capabilities(light string) (Capabilities, bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	c, ok := z.lights[light]
+	return c.Capabilities, ok
+}
+
+// Apply sets the lights of the zone of the setpoint, with its transition.
+// Lights not discovered yet are clamped to 150 to 500 mireds.
+func (z *Zigbee2MQTT) Apply(ctx context.Context, setpoint Setpoint) error {
+	names, ok := z.Zones[setpoint.Zone]
+	if !ok {
+		return fmt.Errorf("zigbee2mqtt: %w %q", ErrUnknownZone, setpoint.Zone)
+	}
+	for _, name := range names {
+		c, ok := z.Capabilities(name)
+		if !ok {
+			c = Capabilities{MinMired: 150, MaxMired: 500, BrightnessSteps: z2mBrightnessSteps}
+		}
+		lighting, _ := c.Map(setpoint.Lighting)
+		command := z2mCommand{Brightness: c.Level(lighting.Brightness), Transition: setpoint.Transition.Seconds()}
+		if c.MaxMired > 0 {
+			command.ColorTemp = int64(math.Round(color.Mired(float64(lighting.ColorTemp))))
+		}
+		payload, err := json.Marshal(command)
+		if err != nil {
+			return err
+		}
+		if err := z.Client.Publish(z.baseTopic()+"/"+name+"/set", payload, z.QoS, false); err != nil {
+			return fmt.Errorf("zigbee2mqtt: %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// State returns the last state published by a light, asking the light for it
+// when none was received yet.
+func (z *Zigbee2MQTT) State(ctx context.Context, light string) (Lighting, error) {
+	if err := z.subscribe(); err != nil {
+		return Lighting{}, err
+	}
+	z.mu.Lock()
+	_, ok := z.states[light]
+	z.mu.Unlock()
+	if !ok {
+		payload := []byte(`{"state": "", "brightness": "", "color_temp": ""}`)
+		if err := z.Client.Publish(z.baseTopic()+"/"+light+"/get", payload, z.QoS, false); err != nil {
+			return Lighting{}, err
+		}
+	}
+	var state Lighting
+	err := z.wait(ctx, func() bool {
+		state, ok = z.states[light]
+		return ok
+	})
+	if err != nil {
+		return Lighting{}, fmt.Errorf("zigbee2mqtt: %s: %w", light, err)
+	}
+	return state, nil
+}
+
+// Close stops following the bridge. The client is disconnected when it was
+// connected by NewDriver, and otherwise left connected, as it may be shared
+// with other outputs.
+func (z *Zigbee2MQTT) Close() error {
+	z.mu.Lock()
+	z.closed = true
+	z.mu.Unlock()
+	if z.ownsClient {
+		return z.Client.Disconnect()
+	}
+	return nil
+}
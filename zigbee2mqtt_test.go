@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sundae-party/circadian-lighting/mqtt"
+)
+
+// Bridge messages recorded from Zigbee2MQTT, trimmed to the fields read.
+const (
+	z2mDevices = `[
+		{"friendly_name": "Coordinator", "ieee_address": "0x00124b0000000000", "type": "Coordinator", "definition": null},
+		{"friendly_name": "kitchen/ceiling", "ieee_address": "0x0017880100000001", "definition": {"exposes": [
+			{"type": "light", "features": [
+				{"type": "binary", "name": "state"},
+				{"type": "numeric", "name": "brightness", "value_min": 0, "value_max": 254},
+				{"type": "numeric", "name": "color_temp", "value_min": 153, "value_max": 454}
+			]},
+			{"type": "numeric", "name": "linkquality", "value_min": 0, "value_max": 255}
+		]}},
+		{"friendly_name": "kitchen/strip", "ieee_address": "0x0017880100000002", "definition": {"exposes": [
+			{"type": "light", "features": [
+				{"type": "numeric", "name": "brightness", "value_min": 0, "value_max": 254},
+				{"type": "numeric", "name": "color_temp", "value_min": 250, "value_max": 454}
+			]}
+		]}},
+		{"friendly_name": "hallway", "ieee_address": "0x0017880100000003", "definition": {"exposes": [
+			{"type": "light", "features": [
+				{"type": "numeric", "name": "brightness", "value_min": 0, "value_max": 254}
+			]}
+		]}},
+		{"friendly_name": "door", "ieee_address": "0x0017880100000004", "definition": {"exposes": [
+			{"type": "binary", "name": "contact"}
+		]}}
+	]`
+	z2mGroups = `[
+		{"friendly_name": "kitchen", "id": 1, "members": [
+			{"ieee_address": "0x0017880100000001", "endpoint": 11},
+			{"ieee_address": "0x0017880100000002", "endpoint": 11}
+		]}
+	]`
+)
+
+func TestZigbee2MQTTDiscover(t *testing.T) {
+
+	broker, client, _ := newTestBroker(t)
+	broker.Publish(mqtt.Message{Topic: "zigbee2mqtt/bridge/devices", Payload: []byte(z2mDevices), Retain: true})
+	broker.Publish(mqtt.Message{Topic: "zigbee2mqtt/bridge/groups", Payload: []byte(z2mGroups), Retain: true})
+	driver := &Zigbee2MQTT{Client: client}
+	defer driver.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lights, err := driver.Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]Capabilities)
+	expected["kitchen/ceiling"] = Capabilities{MinMired: 153, MaxMired: 454, BrightnessSteps: 254}
+	expected["kitchen/strip"] = Capabilities{MinMired: 250, MaxMired: 454, BrightnessSteps: 254}
+	expected["hallway"] = Capabilities{BrightnessSteps: 254}
+	expected["kitchen"] = Capabilities{MinMired: 250, MaxMired: 454, BrightnessSteps: 254}
+
+	if len(lights) != len(expected) {
+		t.Errorf("driver.Discover() = %+v, expected %d lights", lights, len(expected))
+	}
+	for k, v := range expected {
+		if got, ok := driver.Capabilities(k); !ok || got != v {
+			t.Errorf("driver.Capabilities(%s) = %+v, %v, expected %+v", k, got, ok, v)
+		}
+	}
+
+	// A failed subscription is tried again
+	client.Disconnect()
+	failing := &Zigbee2MQTT{Client: client}
+	if _, err := failing.Discover(ctx); err == nil || failing.subscribed {
+		t.Errorf("driver.Discover() without a connection = %v, subscribed %v, expected an error", err, failing.subscribed)
+	}
+}
+
+func TestZigbee2MQTTApply(t *testing.T) {
+
+	broker, client, remote := newTestBroker(t)
+	broker.Publish(mqtt.Message{Topic: "zigbee2mqtt/bridge/devices", Payload: []byte(z2mDevices), Retain: true})
+	broker.Publish(mqtt.Message{Topic: "zigbee2mqtt/bridge/groups", Payload: []byte(z2mGroups), Retain: true})
+	driver := &Zigbee2MQTT{Client: client, Zones: map[string][]string{"kitchen": {"kitchen"}, "hallway": {"hallway", "unknown"}}}
+	defer driver.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := driver.Discover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commands := make(chan mqtt.Message, 16)
+	if err := remote.Subscribe("zigbee2mqtt/+/set", 1, func(m mqtt.Message) { commands <- m }); err != nil {
+		t.Fatal(err)
+	}
+
+	setpoints := []struct {
+		setpoint Setpoint
+		expected map[string]z2mCommand
+	}{
+		{
+			Setpoint{Zone: "kitchen", Lighting: Lighting{ColorTemp: 5000, Brightness: 100}, Transition: 2 * time.Second},
+			map[string]z2mCommand{"zigbee2mqtt/kitchen/set": {ColorTemp: 250, Brightness: 254, Transition: 2}},
+		},
+		{
+			Setpoint{Zone: "kitchen", Lighting: Lighting{ColorTemp: 2700, Brightness: 50}},
+			map[string]z2mCommand{"zigbee2mqtt/kitchen/set": {ColorTemp: 370, Brightness: 127}},
+		},
+		{
+			Setpoint{Zone: "hallway", Lighting: Lighting{ColorTemp: 1800, Brightness: 1}, Transition: 500 * time.Millisecond},
+			map[string]z2mCommand{
+				"zigbee2mqtt/hallway/set": {Brightness: 3, Transition: 0.5},
+				"zigbee2mqtt/unknown/set": {ColorTemp: 500, Brightness: 3, Transition: 0.5},
+			},
+		},
+	}
+	for _, s := range setpoints {
+		if err := driver.Apply(ctx, s.setpoint); err != nil {
+			t.Fatal(err)
+		}
+		for range s.expected {
+			select {
+			case m := <-commands:
+				var got z2mCommand
+				if err := json.Unmarshal(m.Payload, &got); err != nil || got != s.expected[m.Topic] {
+					t.Errorf("driver.Apply(%+v): %s = %s, expected %+v", s.setpoint, m.Topic, m.Payload, s.expected[m.Topic])
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("driver.Apply(%+v): no command sent", s.setpoint)
+			}
+		}
+	}
+	if err := driver.Apply(ctx, Setpoint{Zone: "garage"}); err == nil {
+		t.Errorf("driver.Apply() succeeded on an unknown zone")
+	}
+}
+
+func TestZigbee2MQTTState(t *testing.T) {
+
+	_, client, remote := newTestBroker(t)
+	driver := &Zigbee2MQTT{Client: client}
+	defer driver.Close()
+	err := remote.Subscribe("zigbee2mqtt/kitchen/ceiling/get", 1, func(m mqtt.Message) {
+		remote.Publish("zigbee2mqtt/kitchen/ceiling", []byte(`{"state": "ON", "brightness": 127, "color_temp": 370, "linkquality": 120}`), 0, false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	state, err := driver.State(ctx, "kitchen/ceiling")
+	expected := Lighting{ColorTemp: 2703, Brightness: 50}
+	if err != nil || state != expected {
+		t.Errorf("driver.State(kitchen/ceiling) = %+v, %v, expected %+v", state, err, expected)
+	}
+
+	remote.Publish("zigbee2mqtt/kitchen/ceiling", []byte(`{"state": "OFF"}`), 0, false)
+	deadline := time.Now().Add(5 * time.Second)
+	for state.Brightness != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		state, _ = driver.State(ctx, "kitchen/ceiling")
+	}
+	if state.Brightness != 0 {
+		t.Errorf("driver.State(kitchen/ceiling) = %+v after turning off", state)
+	}
+}